@@ -0,0 +1,613 @@
+package dwgd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-plugins-helpers/network"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	AdminHealthzPath   = "/healthz"
+	AdminNetworksPath  = "/v1/networks"
+	AdminClientsPath   = "/v1/clients"
+	AdminDevicesPath   = "/v1/devices"
+	AdminRootlessPath  = "/v1/rootless"
+	AdminReconcilePath = "/v1/reconcile"
+	AdminGCPath        = "/v1/gc"
+)
+
+// NetworkInfo describes a network managed by dwgd, as returned by the admin
+// API. Secrets, i.e. seeds and private keys, are never included.
+type NetworkInfo struct {
+	ID             string       `json:"id"`
+	Owner          uint32       `json:"owner"`
+	Ifname         string       `json:"ifname,omitempty"`
+	IfnameNetns    string       `json:"ifname_netns,omitempty"`
+	Endpoint       string       `json:"endpoint,omitempty"`
+	PublicKey      string       `json:"public_key"`
+	Route          string       `json:"route,omitempty"`
+	AllowedIPs     []string     `json:"allowed_ips,omitempty"`
+	Keepalive      int          `json:"keepalive,omitempty"`
+	MTU            int          `json:"mtu,omitempty"`
+	CreateServer   bool         `json:"create_server,omitempty"`
+	Address        string       `json:"address,omitempty"`
+	ListenPort     int          `json:"listen_port,omitempty"`
+	Mesh           string       `json:"mesh,omitempty"`
+	Agent          string       `json:"agent,omitempty"`
+	Provisioner    string       `json:"provisioner,omitempty"`
+	Persist        string       `json:"persist,omitempty"`
+	PersistPath    string       `json:"persist_path,omitempty"`
+	Keymode        string       `json:"keymode,omitempty"`
+	Keydir         string       `json:"keydir,omitempty"`
+	Profile        string       `json:"profile,omitempty"`
+	ProfileVersion string       `json:"profile_version,omitempty"`
+	StaleAfter     int          `json:"stale_after,omitempty"`    // seconds, see Network.StaleAfter
+	WaitHandshake  int          `json:"wait_handshake,omitempty"` // seconds, with WaitPolicy when set
+	WaitPolicy     string       `json:"wait_handshake_policy,omitempty"`
+	Clients        []ClientInfo `json:"clients,omitempty"` // set only when inspecting a single network
+}
+
+func newNetworkInfo(n *Network) NetworkInfo {
+	info := NetworkInfo{
+		ID:             n.id,
+		Owner:          n.owner,
+		Ifname:         n.ifname,
+		IfnameNetns:    n.ifnameNetns,
+		PublicKey:      n.pubkey.String(),
+		Route:          n.route,
+		Keepalive:      n.keepalive,
+		MTU:            n.mtu,
+		CreateServer:   n.createServer,
+		Address:        n.address,
+		ListenPort:     n.listenPort,
+		Mesh:           n.mesh,
+		Agent:          n.agent,
+		Provisioner:    n.provisioner,
+		Persist:        n.persist,
+		PersistPath:    n.persistPath,
+		Keymode:        n.keymode,
+		Keydir:         n.keydir,
+		Profile:        n.profile,
+		ProfileVersion: n.profileVersion,
+		StaleAfter:     int(n.StaleAfter().Seconds()),
+		WaitHandshake:  n.waitHandshake,
+	}
+	if n.waitHandshake > 0 {
+		info.WaitPolicy = n.WaitHandshakePolicy()
+	}
+	if n.endpoint != nil {
+		info.Endpoint = n.endpoint.String()
+	}
+	for _, ipnet := range n.allowedIPs {
+		info.AllowedIPs = append(info.AllowedIPs, ipnet.String())
+	}
+	return info
+}
+
+// ClientInfo describes an endpoint of a network managed by dwgd, as
+// returned by the admin API.
+type ClientInfo struct {
+	ID         string `json:"id"`
+	NetworkID  string `json:"network_id"`
+	Owner      uint32 `json:"owner"`
+	IP         string `json:"ip"`
+	Ifname     string `json:"ifname"`
+	PublicKey  string `json:"public_key"`
+	Keyfile    string `json:"keyfile,omitempty"`
+	Joined     bool   `json:"joined"`
+	Netns      string `json:"netns,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+}
+
+func newClientInfo(c *Client) ClientInfo {
+	return ClientInfo{
+		ID:         c.id,
+		NetworkID:  c.network.id,
+		Owner:      c.owner,
+		IP:         c.ip.String(),
+		Ifname:     c.ifname,
+		PublicKey:  c.PrivateKey().PublicKey().String(),
+		Keyfile:    c.keyfile,
+		Joined:     c.netns != "",
+		Netns:      c.netns,
+		ListenPort: c.listenPort,
+	}
+}
+
+// PeerInfo holds the live state of a peer of a WireGuard interface.
+type PeerInfo struct {
+	PublicKey     string    `json:"public_key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	AllowedIPs    []string  `json:"allowed_ips"`
+	LastHandshake time.Time `json:"last_handshake"` // zero if no handshake happened yet
+	ReceiveBytes  int64     `json:"receive_bytes"`
+	TransmitBytes int64     `json:"transmit_bytes"`
+}
+
+// DeviceInfo holds the live state of a WireGuard interface managed by dwgd:
+// the interface of a network or the one of a joined endpoint.
+type DeviceInfo struct {
+	NetworkID  string     `json:"network_id"`
+	EndpointID string     `json:"endpoint_id,omitempty"` // empty for the interface of the network
+	Netns      string     `json:"netns,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	PublicKey  string     `json:"public_key,omitempty"`
+	ListenPort int        `json:"listen_port,omitempty"`
+	Peers      []PeerInfo `json:"peers,omitempty"`
+	Error      string     `json:"error,omitempty"` // set if the interface couldn't be read
+}
+
+func newDeviceInfo(info DeviceInfo, dev *wgtypes.Device, err error) DeviceInfo {
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	info.Name = dev.Name
+	info.PublicKey = dev.PublicKey.String()
+	info.ListenPort = dev.ListenPort
+	for _, p := range dev.Peers {
+		peer := PeerInfo{
+			PublicKey:     p.PublicKey.String(),
+			AllowedIPs:    make([]string, 0, len(p.AllowedIPs)),
+			LastHandshake: p.LastHandshakeTime,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		}
+		if p.Endpoint != nil {
+			peer.Endpoint = p.Endpoint.String()
+		}
+		for _, ipnet := range p.AllowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, ipnet.String())
+		}
+		info.Peers = append(info.Peers, peer)
+	}
+	return info
+}
+
+// NetworkInfos returns the description of every network.
+func (d *Driver) NetworkInfos() ([]NetworkInfo, error) {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]NetworkInfo, 0, len(networks))
+	for _, n := range networks {
+		infos = append(infos, newNetworkInfo(n))
+	}
+	return infos, nil
+}
+
+// NetworkInfo returns the description of the network with the given id,
+// together with its clients, or nil if it doesn't exist.
+func (d *Driver) NetworkInfo(id string) (*NetworkInfo, error) {
+	n, err := d.s.GetNetwork(id)
+	if err != nil || n == nil {
+		return nil, err
+	}
+	clients, err := d.s.ListClients(n.id)
+	if err != nil {
+		return nil, err
+	}
+
+	info := newNetworkInfo(n)
+	info.Clients = make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		info.Clients = append(info.Clients, newClientInfo(c))
+	}
+	return &info, nil
+}
+
+// ClientInfos returns the description of the clients of every network, or
+// of the one with the given id if not empty.
+func (d *Driver) ClientInfos(networkID string) ([]ClientInfo, error) {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ClientInfo, 0)
+	for _, n := range networks {
+		if networkID != "" && n.id != networkID {
+			continue
+		}
+		clients, err := d.s.ListClients(n.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clients {
+			infos = append(infos, newClientInfo(c))
+		}
+	}
+	return infos, nil
+}
+
+// Devices returns the live state of the WireGuard interfaces of the
+// networks and of their joined endpoints. Interfaces that can't be read
+// are reported with an error instead of failing the whole listing.
+func (d *Driver) Devices() ([]DeviceInfo, error) {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]DeviceInfo, 0)
+	for _, n := range networks {
+		if n.ifname != "" {
+			dev, err := d.wgcFor(n.ifnameNetns).Device(n.ifname)
+			devices = append(devices, newDeviceInfo(DeviceInfo{NetworkID: n.id, Netns: n.ifnameNetns}, dev, err))
+		}
+
+		clients, err := d.s.ListClients(n.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clients {
+			if c.netns == "" {
+				continue
+			}
+			dev, err := d.clientDevice(c)
+			devices = append(devices, newDeviceInfo(DeviceInfo{NetworkID: n.id, EndpointID: c.id, Netns: c.netns}, dev, err))
+		}
+	}
+	return devices, nil
+}
+
+// Reconcile brings the WireGuard state in line with the database: the
+// missing server interfaces are recreated, the joined endpoints are
+// registered again with the peers of their networks, the persisted peers
+// are rewritten and the global mesh is synced.
+func (d *Driver) Reconcile() error {
+	if err := d.restoreServers(); err != nil {
+		return err
+	}
+
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		l := Logger.With("network_id", n.id)
+		clients, err := d.s.ListClients(n.id)
+		if err != nil {
+			return err
+		}
+		for _, c := range clients {
+			if c.netns == "" {
+				continue
+			}
+			if err := d.updateNetworkPeer(l.With("endpoint_id", c.id), n, c.PeerConfig()); err != nil {
+				l.Info("Couldn't register endpoint with its network", "endpoint_id", c.id, "error", err)
+			}
+		}
+		if err := d.persistPeers(l, n); err != nil {
+			l.Info("Couldn't persist peers", "error", err)
+		}
+	}
+
+	if d.store != nil {
+		d.triggerMeshSync()
+	}
+	return nil
+}
+
+// A GCResult reports what has been cleaned up by a garbage collection.
+type GCResult struct {
+	Left       []string `json:"left"`       // endpoints whose sandbox was gone, made to leave it
+	Interfaces []string `json:"interfaces"` // leftover client interfaces that have been deleted
+}
+
+// GC cleans up the state left behind when docker didn't tell dwgd about
+// it, e.g. because dwgd wasn't running: endpoints joined to sandboxes that
+// don't exist anymore leave them, and client interfaces in dwgd's network
+// namespace that don't belong to any endpoint are deleted. Only interfaces
+// peering with the server of one of the networks of this instance are
+// considered, so that those of other instances, or created by hand, are
+// left alone.
+func (d *Driver) GC() (*GCResult, error) {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GCResult{Left: make([]string, 0), Interfaces: make([]string, 0)}
+	servers := make(map[wgtypes.Key]bool)
+	for _, n := range networks {
+		servers[n.pubkey] = true
+
+		clients, err := d.s.ListClients(n.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clients {
+			if c.netns == "" {
+				continue
+			}
+			if _, err := d.c.Stat(c.netns); !errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			DiagnosticsLog.Printf("Sandbox %s of EndpointID %s is gone, leaving it\n", c.netns, c.id)
+			if err := d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: c.id}); err != nil {
+				return nil, err
+			}
+			result.Left = append(result.Left, c.id)
+		}
+	}
+
+	devices, err := d.wgc.Devices()
+	if err != nil {
+		return nil, err
+	}
+	// the interfaces are known only after listing them: an endpoint joining
+	// in the meantime is stored before its interface is created, so that it
+	// is never mistaken for a leftover one
+	known, err := d.knownIfnames()
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range devices {
+		if !strings.HasPrefix(dev.Name, "wg-") || known[dev.Name] || !peersWith(dev, servers) {
+			continue
+		}
+
+		DiagnosticsLog.Printf("Deleting leftover interface %s\n", dev.Name)
+		if err := d.links.Delete("", dev.Name); err != nil {
+			return nil, err
+		}
+		result.Interfaces = append(result.Interfaces, dev.Name)
+	}
+	sort.Strings(result.Interfaces)
+	return result, nil
+}
+
+// knownIfnames returns the names of the interfaces in dwgd's network
+// namespace that belong to a network or an endpoint.
+func (d *Driver) knownIfnames() (map[string]bool, error) {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, n := range networks {
+		if n.ifnameNetns == "" {
+			known[n.ifname] = true
+		}
+
+		clients, err := d.s.ListClients(n.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clients {
+			known[c.ifname] = true
+		}
+	}
+	return known, nil
+}
+
+// peersWith reports whether dev has one of servers as a peer, as the client
+// interfaces created by dwgd do.
+func peersWith(dev *wgtypes.Device, servers map[wgtypes.Key]bool) bool {
+	for _, peer := range dev.Peers {
+		if servers[peer.PublicKey] {
+			return true
+		}
+	}
+	return false
+}
+
+// adminHandler serves the admin API, letting the administrators of the host
+// look at the state of dwgd and repair it.
+type adminHandler struct {
+	d         *Driver
+	symlinker *RootlessSymlinker // nil if not running in rootless mode
+}
+
+func newAdminHandler(d *Driver, symlinker *RootlessSymlinker) http.Handler {
+	h := &adminHandler{d: d, symlinker: symlinker}
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminHealthzPath, h.handleHealthz)
+	mux.HandleFunc(AdminNetworksPath, h.handleNetworks)
+	mux.HandleFunc(AdminNetworksPath+"/", h.handleNetwork)
+	mux.HandleFunc(AdminClientsPath, h.handleClients)
+	mux.HandleFunc(AdminDevicesPath, h.handleDevices)
+	mux.HandleFunc(AdminRootlessPath, h.handleRootless)
+	mux.HandleFunc(AdminReconcilePath, h.handleReconcile)
+	mux.HandleFunc(AdminGCPath, h.handleGC)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		TraceLog.Printf("Couldn't write admin response: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// allowMethod reports whether r uses method, answering with an error if not.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// handleHealthz reports whether the database can be reached.
+func (h *adminHandler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if err := h.d.s.db.Ping(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleNetworks lists the networks.
+func (h *adminHandler) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	infos, err := h.d.NetworkInfos()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleNetwork inspects the network whose ID follows AdminNetworksPath,
+// together with its clients.
+func (h *adminHandler) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, AdminNetworksPath+"/")
+	info, err := h.d.NetworkInfo(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if info == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("NetworkID %s not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleClients lists the clients of every network, or of the one given by
+// the network query parameter.
+func (h *adminHandler) handleClients(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	infos, err := h.d.ClientInfos(r.URL.Query().Get("network"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleDevices reports the live state of the WireGuard interfaces.
+func (h *adminHandler) handleDevices(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	devices, err := h.d.Devices()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// handleRootless lists the rootless namespaces the plugin socket has been
+// symlinked into.
+func (h *adminHandler) handleRootless(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	namespaces := make([]RootlessNamespace, 0)
+	if h.symlinker != nil {
+		namespaces = h.symlinker.Namespaces()
+	}
+	writeJSON(w, http.StatusOK, namespaces)
+}
+
+func (h *adminHandler) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	DiagnosticsLog.Println("Reconciling on admin request")
+	if err := h.d.Reconcile(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *adminHandler) handleGC(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	DiagnosticsLog.Println("Collecting garbage on admin request")
+	result, err := h.d.GC()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// AdminServer serves the admin API on a unix socket next to the plugin
+// socket, reachable only by root.
+type AdminServer struct {
+	c        commander
+	srv      *http.Server
+	sock     net.Listener
+	sockPath string
+}
+
+func NewAdminServer(c commander, cfg *Config, d *Driver, symlinker *RootlessSymlinker) (*AdminServer, error) {
+	if c == nil {
+		c = &execCommander{}
+	}
+
+	if err := c.MkdirAll(cfg.RunDir, 0755); err != nil {
+		return nil, err
+	}
+	sockPath := cfg.AdminSockPath()
+	sock, err := sockets.NewUnixSocket(sockPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Chmod(sockPath, 0600); err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	return &AdminServer{
+		c:        c,
+		srv:      &http.Server{Handler: newAdminHandler(d, symlinker), ReadHeaderTimeout: 10 * time.Second},
+		sock:     sock,
+		sockPath: sockPath,
+	}, nil
+}
+
+func (a *AdminServer) Addr() net.Addr {
+	return a.sock.Addr()
+}
+
+func (a *AdminServer) Start() error {
+	err := a.srv.Serve(a.sock)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (a *AdminServer) Stop() error {
+	err := a.srv.Close()
+	a.c.Remove(a.sockPath)
+	return err
+}
@@ -0,0 +1,212 @@
+package dwgd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustGetJSON(t *testing.T, srv *httptest.Server, method string, path string, status int, v interface{}) string {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, res.StatusCode, body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return string(body)
+}
+
+func TestAdminHandler(t *testing.T) {
+	tc := CommanderFixture()
+	gone := make(map[string]bool)
+	tc.StatFunc = func(name string) (fs.FileInfo, error) {
+		if gone[name] {
+			return nil, fs.ErrNotExist
+		}
+		return nil, nil
+	}
+
+	wgc := WgControllerFixture()
+	var devices []*wgtypes.Device
+	wgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+		return devices, nil
+	}
+
+	d, err := NewDriver(ConfigFixture(), tc, wgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := MustCreateNetwork(t, d, true)
+	c := MustCreateEndpoint(t, d)
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+	server := []wgtypes.Peer{{PublicKey: n.pubkey}}
+	foreign := []wgtypes.Peer{{PublicKey: GeneratePrivateKey([]byte("foreign"), nil).PublicKey()}}
+	devices = []*wgtypes.Device{
+		DeviceFixture(),
+		{Name: c.ifname, Peers: server},
+		{Name: "wg-stale", Peers: server},
+		{Name: "wg-foreign", Peers: foreign},
+		{Name: "wg-joining", Peers: server},
+	}
+	d.netnsWgc = func(path string) wgController {
+		sandboxWgc := WgControllerFixture()
+		sandboxWgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+			return []*wgtypes.Device{{Name: "wg0", PublicKey: c.PrivateKey().PublicKey()}}, nil
+		}
+		return sandboxWgc
+	}
+
+	srv := httptest.NewServer(newAdminHandler(d, nil))
+	defer srv.Close()
+
+	t.Run("healthz", func(t *testing.T) {
+		mustGetJSON(t, srv, http.MethodGet, AdminHealthzPath, http.StatusOK, nil)
+	})
+
+	t.Run("networks", func(t *testing.T) {
+		var networks []NetworkInfo
+		mustGetJSON(t, srv, http.MethodGet, AdminNetworksPath, http.StatusOK, &networks)
+		expected := []NetworkInfo{newNetworkInfo(n)}
+		if !cmp.Equal(networks, expected) {
+			t.Fatalf("mismatch: %#v != %#v", networks, expected)
+		}
+	})
+
+	t.Run("inspect network", func(t *testing.T) {
+		var info NetworkInfo
+		body := mustGetJSON(t, srv, http.MethodGet, AdminNetworksPath+"/"+n.id, http.StatusOK, &info)
+		if len(info.Clients) != 1 || info.Clients[0].ID != c.id || !info.Clients[0].Joined {
+			t.Fatalf("unexpected clients: %#v", info.Clients)
+		}
+		if strings.Contains(body, string(n.seed)) || strings.Contains(body, c.PrivateKey().String()) {
+			t.Fatalf("secrets leaked: %s", body)
+		}
+
+		mustGetJSON(t, srv, http.MethodGet, AdminNetworksPath+"/unknown", http.StatusNotFound, nil)
+	})
+
+	t.Run("clients", func(t *testing.T) {
+		var clients []ClientInfo
+		mustGetJSON(t, srv, http.MethodGet, AdminClientsPath+"?network="+n.id, http.StatusOK, &clients)
+		if len(clients) != 1 || clients[0].PublicKey != c.PrivateKey().PublicKey().String() {
+			t.Fatalf("unexpected clients: %#v", clients)
+		}
+
+		mustGetJSON(t, srv, http.MethodGet, AdminClientsPath+"?network=unknown", http.StatusOK, &clients)
+		if len(clients) != 0 {
+			t.Fatalf("unexpected clients: %#v", clients)
+		}
+	})
+
+	t.Run("devices", func(t *testing.T) {
+		var devices []DeviceInfo
+		mustGetJSON(t, srv, http.MethodGet, AdminDevicesPath, http.StatusOK, &devices)
+		if len(devices) != 2 {
+			t.Fatalf("expected 2 devices, got %#v", devices)
+		}
+		if devices[0].Name != n.ifname || devices[0].EndpointID != "" {
+			t.Fatalf("unexpected network device: %#v", devices[0])
+		}
+		if devices[1].Name != "wg0" || devices[1].EndpointID != c.id || devices[1].Netns != "/foo/bar" {
+			t.Fatalf("unexpected client device: %#v", devices[1])
+		}
+	})
+
+	t.Run("rootless", func(t *testing.T) {
+		var namespaces []RootlessNamespace
+		mustGetJSON(t, srv, http.MethodGet, AdminRootlessPath, http.StatusOK, &namespaces)
+		if len(namespaces) != 0 {
+			t.Fatalf("unexpected namespaces: %#v", namespaces)
+		}
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		mustGetJSON(t, srv, http.MethodPost, AdminNetworksPath, http.StatusMethodNotAllowed, nil)
+		mustGetJSON(t, srv, http.MethodGet, AdminGCPath, http.StatusMethodNotAllowed, nil)
+	})
+
+	t.Run("reconcile", func(t *testing.T) {
+		mustGetJSON(t, srv, http.MethodPost, AdminReconcilePath, http.StatusOK, nil)
+	})
+
+	t.Run("gc", func(t *testing.T) {
+		tc.RunHistory = nil
+		gone["/foo/bar"] = true
+
+		// an endpoint joining while the interfaces are listed isn't
+		// mistaken for a leftover one
+		wgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+			if err := d.s.AddClient(&Client{id: "joining", ifname: "wg-joining", ip: net.ParseIP("10.0.0.42"), network: n}); err != nil {
+				t.Fatal(err)
+			}
+			return devices, nil
+		}
+
+		var result GCResult
+		mustGetJSON(t, srv, http.MethodPost, AdminGCPath, http.StatusOK, &result)
+		expected := GCResult{Left: []string{c.id}, Interfaces: []string{"wg-stale"}}
+		if !cmp.Equal(result, expected) {
+			t.Fatalf("mismatch: %#v != %#v", result, expected)
+		}
+
+		expectedHistory := [][]string{{"ip", "link", "delete", "wg-stale"}}
+		if !cmp.Equal(tc.RunHistory, expectedHistory) {
+			t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+		}
+
+		other, err := d.s.GetClient(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.netns != "" {
+			t.Fatalf("expected %s to have left, netns is %s", c.id, other.netns)
+		}
+	})
+}
+
+func TestRootlessSymlinker_Namespaces(t *testing.T) {
+	r := &RootlessSymlinker{socketSymlinkPerNs: map[int]string{
+		42: "/run/docker/plugins/dwgd.sock",
+		7:  "/run/docker/plugins/dwgd.sock",
+	}}
+
+	expected := []RootlessNamespace{
+		{PID: 7, Symlink: "/run/docker/plugins/dwgd.sock"},
+		{PID: 42, Symlink: "/run/docker/plugins/dwgd.sock"},
+	}
+	if got := r.Namespaces(); !cmp.Equal(got, expected) {
+		t.Fatalf("mismatch: %s != %s", fmt.Sprint(got), fmt.Sprint(expected))
+	}
+}
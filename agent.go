@@ -0,0 +1,457 @@
+package dwgd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const agentPeersPath = "/v1/peers"
+
+// An AgentConfig represents the configuration of a dwgd agent, which runs
+// on the remote WireGuard peer of pubkey mode networks and lets the drivers
+// add and remove their containers as peers of its interface.
+// Drivers are authenticated through mutual TLS.
+type AgentConfig struct {
+	Addr      string   // address to listen on
+	Ifname    string   // WireGuard interface the drivers can add peers to
+	Subnets   []string // subnets the addresses of the peers must belong to
+	StateFile string   // file recording the peers added by the drivers
+	CAFile    string   // CA used to verify the certificates of the drivers
+	CertFile  string   // certificate presented to the drivers
+	KeyFile   string   // key of CertFile
+}
+
+// DefaultAgentStatePath is the default value of AgentConfig.StateFile.
+const DefaultAgentStatePath = defaultDbDir + "/dwgd-agent.json"
+
+// A ClientTLSConfig represents the credentials the driver uses to connect
+// to a TLS server, such as the agents of its networks or the shared store.
+type ClientTLSConfig struct {
+	CAFile   string // CA used to verify the certificate of the server
+	CertFile string // certificate presented to the server, if any
+	KeyFile  string // key of CertFile
+}
+
+// agentPeer is a peer as exchanged between the driver and the agent.
+type agentPeer struct {
+	PublicKey           string   `json:"public_key"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"` // in seconds
+}
+
+func newAgentPeer(peer wgtypes.PeerConfig) *agentPeer {
+	p := &agentPeer{PublicKey: peer.PublicKey.String()}
+	for _, ipnet := range peer.AllowedIPs {
+		p.AllowedIPs = append(p.AllowedIPs, ipnet.String())
+	}
+	if peer.PersistentKeepaliveInterval != nil {
+		p.PersistentKeepalive = int(peer.PersistentKeepaliveInterval.Seconds())
+	}
+	return p
+}
+
+// peerConfig returns the configuration of p. Containers only ever get a
+// single address, so any other allowed IP is rejected. The checks against
+// the other peers of the interface are up to the agent.
+func (p *agentPeer) peerConfig() (wgtypes.PeerConfig, error) {
+	pubkey, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
+
+	allowedIPs := make([]net.IPNet, 0, len(p.AllowedIPs))
+	for _, s := range p.AllowedIPs {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return wgtypes.PeerConfig{}, err
+		}
+		if ones, bits := ipnet.Mask.Size(); ones != bits {
+			return wgtypes.PeerConfig{}, fmt.Errorf("allowed IP %s is not a single address", s)
+		}
+		allowedIPs = append(allowedIPs, *ipnet)
+	}
+
+	peer := wgtypes.PeerConfig{
+		PublicKey:         pubkey,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        allowedIPs,
+	}
+	if p.PersistentKeepalive > 0 {
+		keepalive := time.Duration(p.PersistentKeepalive) * time.Second
+		peer.PersistentKeepaliveInterval = &keepalive
+	}
+	return peer, nil
+}
+
+// Agent serves the API drivers use to manage the peers of a WireGuard
+// interface. Drivers can only add addresses of the configured subnets that
+// no other peer holds, and only update or remove the peers they added, so
+// they can't claim the traffic of the static peers of the interface or of
+// the containers of other drivers.
+type Agent struct {
+	wgc       wgController
+	ifname    string
+	subnets   []*net.IPNet
+	stateFile string
+	srv       *http.Server
+	sock      net.Listener
+
+	mu     sync.Mutex
+	owners map[string]string // common name of the driver that added each peer, by public key
+}
+
+func NewAgent(c commander, cfg *AgentConfig, wgc wgController) (*Agent, error) {
+	if c == nil {
+		c = &execCommander{}
+	}
+	if cfg.Ifname == "" {
+		return nil, fmt.Errorf("agent requires an interface")
+	}
+	if len(cfg.Subnets) == 0 {
+		return nil, fmt.Errorf("agent requires at least a subnet")
+	}
+	subnets := make([]*net.IPNet, 0, len(cfg.Subnets))
+	for _, s := range cfg.Subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", s, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = DefaultAgentStatePath
+	}
+	owners, err := loadAgentState(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newServerTLSConfig(c, &TCPConfig{
+		CAFile:   cfg.CAFile,
+		CertFile: cfg.CertFile,
+		KeyFile:  cfg.KeyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if wgc == nil {
+		wgc, err = wgctrl.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := wgc.Device(cfg.Ifname); err != nil {
+		return nil, err
+	}
+
+	sock, err := tls.Listen("tcp", cfg.Addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Agent{
+		wgc:       wgc,
+		ifname:    cfg.Ifname,
+		subnets:   subnets,
+		stateFile: cfg.StateFile,
+		sock:      sock,
+		owners:    owners,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(agentPeersPath, a.handlePeers)
+	a.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return a, nil
+}
+
+// loadAgentState returns the owners of the peers recorded in path, which
+// may not exist yet.
+func loadAgentState(path string) (map[string]string, error) {
+	owners := make(map[string]string)
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return owners, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &owners); err != nil {
+		return nil, fmt.Errorf("corrupted agent state %s: %w", path, err)
+	}
+	return owners, nil
+}
+
+func (a *Agent) saveState() error {
+	buf, err := json.Marshal(a.owners)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.stateFile, buf, 0600)
+}
+
+// checkPeer returns an error if client can't add or update peer on dev:
+// its addresses must belong to the subnets of the agent and not be held by
+// other peers, and its public key must not belong to a peer added by
+// another client or by the administrator.
+func (a *Agent) checkPeer(client string, dev *wgtypes.Device, peer wgtypes.PeerConfig) error {
+	for _, ipnet := range peer.AllowedIPs {
+		if !a.inSubnets(ipnet.IP) {
+			return fmt.Errorf("allowed IP %s is outside of the subnets of the agent", ipnet.String())
+		}
+	}
+
+	key := peer.PublicKey.String()
+	for _, p := range dev.Peers {
+		if p.PublicKey == peer.PublicKey {
+			if owner, ok := a.owners[key]; !ok || owner != client {
+				return errAgentForbidden
+			}
+			continue
+		}
+		for _, held := range p.AllowedIPs {
+			for _, ipnet := range peer.AllowedIPs {
+				if held.Contains(ipnet.IP) || ipnet.Contains(held.IP) {
+					return fmt.Errorf("allowed IP %s is held by another peer", ipnet.String())
+				}
+			}
+		}
+	}
+	if owner, ok := a.owners[key]; ok && owner != client {
+		return errAgentForbidden
+	}
+	return nil
+}
+
+// errAgentForbidden is returned for peers the client didn't add.
+var errAgentForbidden = errors.New("peer not added by this client")
+
+func (a *Agent) inSubnets(ip net.IP) bool {
+	for _, subnet := range a.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Agent) Addr() net.Addr {
+	return a.sock.Addr()
+}
+
+func (a *Agent) Start() error {
+	err := a.srv.Serve(a.sock)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (a *Agent) Stop() error {
+	return a.srv.Close()
+}
+
+// handlePeers adds the peer in the body of POST requests and removes the
+// one whose public key is in the query of DELETE requests.
+func (a *Agent) handlePeers(w http.ResponseWriter, r *http.Request) {
+	var peer wgtypes.PeerConfig
+	var err error
+
+	switch r.Method {
+	case http.MethodPost:
+		p := &agentPeer{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		peer, err = p.peerConfig()
+	case http.MethodDelete:
+		peer.PublicKey, err = wgtypes.ParseKey(r.URL.Query().Get("public_key"))
+		peer.Remove = true
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := "unknown"
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		client = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := peer.PublicKey.String()
+	l := Logger.With("client", client, "ifname", a.ifname, "public_key", key)
+	if peer.Remove {
+		owner, ok := a.owners[key]
+		if !ok {
+			// already removed, or never added through the agent: either
+			// way there's nothing this client may remove
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if owner != client {
+			err = errAgentForbidden
+		}
+	} else {
+		var dev *wgtypes.Device
+		dev, err = a.wgc.Device(a.ifname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = a.checkPeer(client, dev, peer)
+	}
+	if err == errAgentForbidden {
+		l.Info("Rejected update of peer", "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	l.Info("Updating peer", "remove", peer.Remove)
+
+	if err := updateServerPeer(l, a.wgc, a.ifname, peer); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if peer.Remove {
+		delete(a.owners, key)
+	} else {
+		a.owners[key] = client
+	}
+	if err := a.saveState(); err != nil {
+		l.Info("Couldn't save agent state", "path", a.stateFile, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newClientTLSConfig returns a TLS configuration presenting the certificate
+// in cfg, if any, and verifying servers against its CA, or the system ones
+// if empty.
+func newClientTLSConfig(c commander, cfg *ClientTLSConfig) (*tls.Config, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate requires both a certificate and a key")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		ca, err := c.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("couldn't parse CA certificates in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// agentClient calls the API of the agent at url.
+type agentClient struct {
+	url    string
+	client *http.Client
+}
+
+func newAgentClient(agentURL string, tlsConfig *tls.Config) *agentClient {
+	return &agentClient{
+		url: strings.TrimSuffix(agentURL, "/"),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+}
+
+// agentClient returns the client of the agent at agentURL. Clients are
+// shared by the networks using the same agent, so that their connections
+// are reused.
+func (d *Driver) agentClient(agentURL string) *agentClient {
+	d.agentMu.Lock()
+	defer d.agentMu.Unlock()
+
+	if client, ok := d.agentClients[agentURL]; ok {
+		return client
+	}
+	if d.agentClients == nil {
+		d.agentClients = make(map[string]*agentClient)
+	}
+	client := newAgentClient(agentURL, d.agentTLS)
+	d.agentClients[agentURL] = client
+	return client
+}
+
+func (a *agentClient) do(req *http.Request) error {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("agent %s: %s: %s", a.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// UpdatePeer adds peer to the interface of the agent, or removes it if
+// peer.Remove is set.
+func (a *agentClient) UpdatePeer(peer wgtypes.PeerConfig) error {
+	if peer.Remove {
+		q := url.Values{"public_key": {peer.PublicKey.String()}}
+		req, err := http.NewRequest(http.MethodDelete, a.url+agentPeersPath+"?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		return a.do(req)
+	}
+
+	body, err := json.Marshal(newAgentPeer(peer))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.url+agentPeersPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return a.do(req)
+}
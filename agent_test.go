@@ -0,0 +1,233 @@
+package dwgd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// certFixture writes a certificate called name, signed by ca (or self
+// signed if nil), and its key in dir. It returns the paths of both files,
+// together with the certificate and the key themselves.
+func certFixture(t *testing.T, dir string, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		ca, caKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert, key
+}
+
+func TestAgent(t *testing.T) {
+	dir := t.TempDir()
+	caPath, _, ca, caKey := certFixture(t, dir, "ca", nil, nil)
+	agentCert, agentKey, _, _ := certFixture(t, dir, "agent", ca, caKey)
+	driverCert, driverKey, _, _ := certFixture(t, dir, "driver", ca, caKey)
+
+	// the interface of the agent has a static peer, holding 10.0.0.100
+	staticKey := GeneratePrivateKey([]byte("static"), net.ParseIP("10.0.0.100")).PublicKey()
+	_, staticIP, _ := net.ParseCIDR("10.0.0.100/32")
+	dev := DeviceFixture()
+	dev.Peers = []wgtypes.Peer{{PublicKey: staticKey, AllowedIPs: []net.IPNet{*staticIP}}}
+
+	configured := make([]wgtypes.PeerConfig, 0)
+	agentWgc := WgControllerFixture()
+	agentWgc.DeviceFunc = func(name string) (*wgtypes.Device, error) {
+		return dev, nil
+	}
+	agentWgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+		configured = append(configured, cfg.Peers...)
+		for _, peer := range cfg.Peers {
+			peers := dev.Peers[:0]
+			for _, p := range dev.Peers {
+				if p.PublicKey != peer.PublicKey {
+					peers = append(peers, p)
+				}
+			}
+			if !peer.Remove {
+				peers = append(peers, wgtypes.Peer{PublicKey: peer.PublicKey, AllowedIPs: peer.AllowedIPs})
+			}
+			dev.Peers = peers
+		}
+		return nil
+	}
+
+	tc := CommanderFixture()
+	tc.ReadFileFunc = os.ReadFile
+	agentCfg := &AgentConfig{
+		Addr:      "127.0.0.1:0",
+		Ifname:    "dwgd0",
+		Subnets:   []string{"10.0.0.0/24"},
+		StateFile: filepath.Join(dir, "agent.json"),
+		CAFile:    caPath,
+		CertFile:  agentCert,
+		KeyFile:   agentKey,
+	}
+	a, err := NewAgent(tc, agentCfg, agentWgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Start()
+	defer a.Stop()
+
+	cfg := ConfigFixture()
+	cfg.AgentTLS = ClientTLSConfig{CAFile: caPath, CertFile: driverCert, KeyFile: driverKey}
+	d, err := NewDriver(cfg, tc, WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := NetworkFixture()
+	c := ClientFixture(n)
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.seed":     string(n.seed),
+				"dwgd.endpoint": n.endpoint.String(),
+				"dwgd.pubkey":   n.pubkey.String(),
+				"dwgd.agent":    "https://" + a.Addr().String(),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  n.id,
+		EndpointID: c.id,
+		Interface:  &network.EndpointInterface{Address: c.ip.String() + "/32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: c.id}); err != nil {
+		t.Fatal(err)
+	}
+
+	joined, err := d.s.GetClient(c.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := joined.PeerConfig()
+	removed := wgtypes.PeerConfig{PublicKey: added.PublicKey, Remove: true}
+	expected := []wgtypes.PeerConfig{added, removed}
+	if !cmp.Equal(configured, expected) {
+		t.Fatalf("mismatch: %#v != %#v", configured, expected)
+	}
+
+	// networks using the same agent share its client
+	client := d.agentClient("https://" + a.Addr().String())
+	if other := d.agentClient("https://" + a.Addr().String()); other != client {
+		t.Fatal("expected the client of the agent to be reused")
+	}
+
+	// peers can't claim anything but a single, free, address of the subnets
+	// of the agent
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.1.2/32", "10.0.0.100/32"} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		peer := added
+		peer.AllowedIPs = []net.IPNet{*ipnet}
+		if err := client.UpdatePeer(peer); err == nil {
+			t.Fatalf("%s: expected error", cidr)
+		}
+	}
+
+	// nor update or remove the peers they didn't add
+	static := wgtypes.PeerConfig{PublicKey: staticKey, AllowedIPs: added.AllowedIPs}
+	if err := client.UpdatePeer(static); err == nil {
+		t.Fatal("expected error")
+	}
+	configured = configured[:0]
+	static.Remove = true
+	if err := client.UpdatePeer(static); err != nil {
+		t.Fatal(err)
+	}
+	if len(configured) != 0 || len(dev.Peers) != 1 {
+		t.Fatalf("expected the static peer to be kept, got %#v", dev.Peers)
+	}
+
+	// the peers added by a driver belong to it, even after a restart of the
+	// agent
+	if err := client.UpdatePeer(added); err != nil {
+		t.Fatal(err)
+	}
+	a.Stop()
+	a, err = NewAgent(tc, agentCfg, agentWgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Start()
+	defer a.Stop()
+
+	otherCert, otherKey, _, _ := certFixture(t, dir, "other", ca, caKey)
+	otherTLS, err := newClientTLSConfig(tc, &ClientTLSConfig{CAFile: caPath, CertFile: otherCert, KeyFile: otherKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newAgentClient("https://"+a.Addr().String(), otherTLS)
+	if err := other.UpdatePeer(removed); err == nil {
+		t.Fatal("expected error")
+	}
+	client = newAgentClient("https://"+a.Addr().String(), d.agentTLS)
+	if err := client.UpdatePeer(removed); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.Peers) != 1 {
+		t.Fatalf("expected the peer to be removed, got %#v", dev.Peers)
+	}
+}
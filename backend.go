@@ -0,0 +1,205 @@
+package dwgd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	BackendAuto      = "auto"
+	BackendKernel    = "kernel"
+	BackendUserspace = "userspace"
+)
+
+// backendProbeIfname is the name of the interface created to probe the
+// kernel module, unique to the process so that instances starting together
+// don't collide.
+var backendProbeIfname = fmt.Sprintf("dwgd-p%d", os.Getpid())
+
+// A linkBackend creates and deletes WireGuard interfaces.
+// Once created, interfaces are configured through wgController, regardless
+// of the backend.
+type linkBackend interface {
+	// Add creates a WireGuard interface called name in dwgd's namespace.
+	Add(name string) error
+	// Delete deletes the WireGuard interface called name, living in the
+	// network namespace at netns, or in dwgd's one if empty.
+	Delete(netns string, name string) error
+}
+
+// runInNetns runs a command in the network namespace at netns, or in dwgd's
+// namespace if netns is empty.
+func runInNetns(c commander, netns string, name string, arg ...string) error {
+	if netns == "" {
+		return c.Run(name, arg...)
+	}
+	return c.Run("nsenter", append([]string{"--net=" + netns, name}, arg...)...)
+}
+
+// kernelBackend manages interfaces backed by the WireGuard kernel module.
+type kernelBackend struct {
+	c commander
+}
+
+func (k *kernelBackend) Add(name string) error {
+	return k.c.Run("ip", "link", "add", "name", name, "type", "wireguard")
+}
+
+func (k *kernelBackend) Delete(netns string, name string) error {
+	return runInNetns(k.c, netns, "ip", "link", "delete", name)
+}
+
+// userspaceDevice is a WireGuard interface implemented by wireguard-go.
+type userspaceDevice struct {
+	dev  *device.Device
+	uapi net.Listener
+}
+
+// userspaceBackend manages interfaces implemented by wireguard-go, for
+// systems where the kernel module is not available.
+// Each interface is backed by a TUN device and exposes the same UAPI socket
+// as the wireguard-go binary, which is what wgController uses to configure it.
+type userspaceBackend struct {
+	mu      sync.Mutex
+	devices map[string]*userspaceDevice
+}
+
+func newUserspaceBackend() *userspaceBackend {
+	return &userspaceBackend{
+		devices: make(map[string]*userspaceDevice),
+	}
+}
+
+func (u *userspaceBackend) Add(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.devices[name]; ok {
+		return fmt.Errorf("interface %s already exists", name)
+	}
+
+	tunDev, err := tun.CreateTUN(name, device.DefaultMTU)
+	if err != nil {
+		return err
+	}
+
+	logger := &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			TraceLog.Printf("("+name+") "+format+"\n", args...)
+		},
+		Errorf: func(format string, args ...any) {
+			DiagnosticsLog.Printf("("+name+") "+format+"\n", args...)
+		},
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), logger)
+
+	uapiFile, err := ipc.UAPIOpen(name)
+	if err != nil {
+		dev.Close()
+		return err
+	}
+	uapi, err := ipc.UAPIListen(name, uapiFile)
+	if err != nil {
+		uapiFile.Close()
+		dev.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}()
+
+	if err := dev.Up(); err != nil {
+		uapi.Close()
+		dev.Close()
+		return err
+	}
+
+	u.devices[name] = &userspaceDevice{dev: dev, uapi: uapi}
+	TraceLog.Printf("Created userspace WireGuard interface %s\n", name)
+	return nil
+}
+
+// has reports whether the device called name has been created since dwgd
+// started.
+func (u *userspaceBackend) has(name string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	_, ok := u.devices[name]
+	return ok
+}
+
+// Delete closes the device called name: this removes its TUN device too,
+// wherever it has been moved, so netns is not needed. Devices only live as
+// long as dwgd, so the ones created before a restart are already gone.
+func (u *userspaceBackend) Delete(netns string, name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	d, ok := u.devices[name]
+	if !ok {
+		TraceLog.Printf("Userspace WireGuard interface %s not found, already deleted\n", name)
+		return nil
+	}
+	delete(u.devices, name)
+
+	d.uapi.Close()
+	d.dev.Close()
+	return nil
+}
+
+// isUnsupportedLinkType reports whether err, returned by ip link add, means
+// that the kernel doesn't know the wireguard link type.
+func isUnsupportedLinkType(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"operation not supported", "unknown device type", "unknown link type"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// newLinkBackend returns the backend called name. In auto mode the kernel
+// backend is used if the WireGuard kernel module works, which we find out
+// by creating and deleting a probe interface. Only a missing wireguard link
+// type makes us fall back to the userspace backend, other errors are
+// returned.
+func newLinkBackend(c commander, name string) (linkBackend, error) {
+	switch name {
+	case BackendKernel:
+		return &kernelBackend{c: c}, nil
+	case BackendUserspace:
+		return newUserspaceBackend(), nil
+	case BackendAuto, "":
+		k := &kernelBackend{c: c}
+		if err := k.Add(backendProbeIfname); err != nil {
+			if !isUnsupportedLinkType(err) {
+				return nil, fmt.Errorf("couldn't probe the WireGuard kernel module: %w", err)
+			}
+			DiagnosticsLog.Printf("WireGuard kernel module not available, using userspace backend: %s\n", err)
+			return newUserspaceBackend(), nil
+		}
+		if err := k.Delete("", backendProbeIfname); err != nil {
+			return nil, err
+		}
+		TraceLog.Println("Using kernel backend")
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
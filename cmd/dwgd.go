@@ -2,25 +2,159 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/leomos/dwgd"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var Version string
 
-var cfg = dwgd.NewConfig()
+// stringsFlag is a flag that can be repeated multiple times.
+// The first time it is set the default values are discarded.
+type stringsFlag struct {
+	values *[]string
+	set    bool
+}
 
-func init() {
-	flag.StringVar(&cfg.Db, "d", cfg.Db, "dwgd db path")
-	flag.BoolVar(&cfg.Verbose, "v", cfg.Verbose, "verbose mode")
-	flag.BoolVar(&cfg.Rootless, "r", cfg.Rootless, "run in rootless compatibility mode")
+func (s *stringsFlag) String() string {
+	if s.values == nil {
+		return ""
+	}
+	return strings.Join(*s.values, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	if !s.set {
+		*s.values = nil
+		s.set = true
+	}
+	*s.values = append(*s.values, value)
+	return nil
+}
+
+// uint32sFlag is a flag that can be repeated multiple times.
+// The first time it is set the default values are discarded.
+type uint32sFlag struct {
+	values *[]uint32
+	set    bool
+}
+
+func (u *uint32sFlag) String() string {
+	if u.values == nil {
+		return ""
+	}
+	return strings.Trim(fmt.Sprint(*u.values), "[]")
+}
+
+func (u *uint32sFlag) Set(value string) error {
+	v, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	if !u.set {
+		*u.values = nil
+		u.set = true
+	}
+	*u.values = append(*u.values, uint32(v))
+	return nil
+}
+
+// registerFlags defines the flags of the daemon in fs, setting the fields
+// of cfg.
+func registerFlags(fs *flag.FlagSet, cfg *dwgd.Config) {
+	fs.StringVar(&cfg.Instance, "instance", cfg.Instance, "name of the instance, the plugin will be called dwgd-<instance>")
+	fs.StringVar(&cfg.Db, "d", cfg.Db, "dwgd db path")
+	fs.BoolFunc("v", "verbose mode, same as -log-level debug", func(string) error {
+		cfg.LogLevel = dwgd.LogLevelDebug
+		return nil
+	})
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "minimum level of the logs: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "format of the logs: text or json")
+	fs.BoolVar(&cfg.Rootless, "r", cfg.Rootless, "run in rootless compatibility mode")
+	fs.Var(&stringsFlag{values: &cfg.RootlessRuntimeRoots}, "rootless-runtime-root", "directory containing the XDG_RUNTIME_DIRs of rootless docker daemons (can be repeated)")
+	fs.Var(&uint32sFlag{values: &cfg.PeerAllowlist.Uids}, "allow-uid", "UID allowed to connect to the plugin socket (can be repeated)")
+	fs.Var(&uint32sFlag{values: &cfg.PeerAllowlist.Gids}, "allow-gid", "GID allowed to connect to the plugin socket (can be repeated)")
+	fs.Var(&stringsFlag{values: &cfg.PeerAllowlist.Cgroups}, "allow-cgroup", "cgroup allowed to connect to the plugin socket (can be repeated)")
+	fs.StringVar(&cfg.Backend, "backend", cfg.Backend, "WireGuard backend: auto, kernel or userspace")
+	fs.StringVar(&cfg.Scope, "scope", cfg.Scope, "scope of the networks: local or global")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "URL of the store shared with the other hosts: memory:, file:///path or etcd://host:port")
+	fs.StringVar(&cfg.AdvertiseAddr, "advertise-addr", cfg.AdvertiseAddr, "address the other hosts reach the containers of this one on")
+	fs.DurationVar(&cfg.MeshSyncInterval, "mesh-sync-interval", cfg.MeshSyncInterval, "how often global mesh networks are synced with the store")
+	fs.StringVar(&cfg.StoreTLS.CAFile, "store-tls-ca", cfg.StoreTLS.CAFile, "CA used to verify an etcd+https store, the system ones if empty")
+	fs.StringVar(&cfg.StoreTLS.CertFile, "store-tls-cert", cfg.StoreTLS.CertFile, "certificate presented to an etcd+https store, if it requires one")
+	fs.StringVar(&cfg.StoreTLS.KeyFile, "store-tls-key", cfg.StoreTLS.KeyFile, "key of the certificate presented to an etcd+https store")
+	fs.StringVar(&cfg.AgentTLS.CAFile, "agent-tls-ca", cfg.AgentTLS.CAFile, "CA used to verify the agents, the system ones if empty")
+	fs.StringVar(&cfg.AgentTLS.CertFile, "agent-tls-cert", cfg.AgentTLS.CertFile, "certificate presented to the agents")
+	fs.StringVar(&cfg.AgentTLS.KeyFile, "agent-tls-key", cfg.AgentTLS.KeyFile, "key of the certificate presented to the agents")
+	fs.StringVar(&cfg.ProfilesDir, "profiles-dir", cfg.ProfilesDir, "directory holding the network profiles")
+	fs.BoolVar(&cfg.PluginMode, "plugin", cfg.PluginMode, "run as a docker managed plugin")
+	fs.StringVar(&cfg.RunDir, "run-dir", cfg.RunDir, "directory where the plugin socket is created")
+	fs.StringVar(&cfg.PluginSockDir, "plugin-sock-dir", cfg.PluginSockDir, "directory where docker looks for plugin sockets")
+	fs.BoolVar(&cfg.Admin, "admin", cfg.Admin, "serve the admin API on a socket next to the plugin one")
+	fs.DurationVar(&cfg.HealthInterval, "health-interval", cfg.HealthInterval, "how often the tunnels of the containers are checked, 0 disables it")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "address the Prometheus metrics are served on, disabled if empty")
+	fs.StringVar(&cfg.TCP.Addr, "tcp-addr", cfg.TCP.Addr, "address of the TCP listener, disabled if empty")
+	fs.StringVar(&cfg.TCP.CAFile, "tls-ca", cfg.TCP.CAFile, "CA used to verify the docker daemons connecting through TCP")
+	fs.StringVar(&cfg.TCP.CertFile, "tls-cert", cfg.TCP.CertFile, "certificate of the TCP listener")
+	fs.StringVar(&cfg.TCP.KeyFile, "tls-key", cfg.TCP.KeyFile, "key of the TCP listener")
+	fs.StringVar(&cfg.TCP.SpecDir, "spec-dir", cfg.TCP.SpecDir, "directory where the plugin spec file for the TCP listener is written, skipped if empty")
+	fs.StringVar(&cfg.TCP.SpecAddr, "spec-addr", cfg.TCP.SpecAddr, "address the docker daemons connect to, defaults to -tcp-addr")
+	fs.StringVar(&cfg.TCP.SpecCAFile, "spec-tls-ca", cfg.TCP.SpecCAFile, "CA used by the docker daemons to verify the TCP listener")
+	fs.StringVar(&cfg.TCP.SpecCertFile, "spec-tls-cert", cfg.TCP.SpecCertFile, "certificate presented by the docker daemons")
+	fs.StringVar(&cfg.TCP.SpecKeyFile, "spec-tls-key", cfg.TCP.SpecKeyFile, "key of the certificate presented by the docker daemons")
 }
 
 var versionFlag = flag.Bool("version", false, "print the version")
+var configFlag = flag.String("config", "", "TOML configuration file, the flags take precedence over it")
+
+// loadConfig returns the configuration given by the configuration file at
+// path, if any, and by the command line arguments args, which take
+// precedence over it.
+func loadConfig(path string, args []string) (*dwgd.Config, error) {
+	cfg := dwgd.NewConfig()
+	defaultDb := cfg.Db
+	if path != "" {
+		if err := dwgd.LoadConfigFile(cfg, path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.Bool("version", false, "")
+	fs.String("config", "", "")
+	registerFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Unless explicitly set, each instance uses its own database.
+	dbSet := cfg.Db != defaultDb
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "d" {
+			dbSet = true
+		}
+	})
+	if !dbSet {
+		cfg.Db = dwgd.DefaultDbPath(cfg.Instance)
+	}
+
+	if cfg.Db == "" {
+		cfg.Db = ":memory:"
+	}
+
+	if cfg.PluginMode {
+		cfg.SetPluginMode()
+	}
+
+	return cfg, nil
+}
 
 var pubkeyCmd = flag.NewFlagSet("pubkey", flag.ExitOnError)
 var ipFlag = pubkeyCmd.String("i", "", "IP to generate public key")
@@ -48,27 +182,280 @@ func pubkey(args []string) {
 	os.Exit(0)
 }
 
+var peersGenerateCmd = flag.NewFlagSet("peers generate", flag.ExitOnError)
+var subnetFlag = peersGenerateCmd.String("subnet", "", "subnet to generate the peers of")
+var peersSeedFlag = peersGenerateCmd.String("seed", "", "seed to generate the public keys")
+var formatFlag = peersGenerateCmd.String("format", dwgd.PeerFormatWg, "output format: wg, wg-quick, networkd or json")
+var pskFlag = peersGenerateCmd.String("psk", "", "preshared key to add to every peer")
+var fromDbFlag = peersGenerateCmd.String("from-db", "", "ID of the network to read the seed of from the database")
+var peersDbFlag = peersGenerateCmd.String("d", dwgd.DefaultDbPath(""), "dwgd db path, used with -from-db")
+
+func peers(args []string) {
+	if len(args) == 0 || args[0] != "generate" {
+		dwgd.EventsLog.Println("usage: dwgd peers generate [options]")
+		os.Exit(1)
+	}
+	peersGenerateCmd.Parse(args[1:])
+
+	if *subnetFlag == "" {
+		dwgd.EventsLog.Println("subnet is required")
+		peersGenerateCmd.Usage()
+		os.Exit(1)
+	}
+
+	seed := []byte(*peersSeedFlag)
+	if *fromDbFlag != "" {
+		var err error
+		seed, err = dwgd.NetworkSeed(*peersDbFlag, *fromDbFlag)
+		if err != nil {
+			dwgd.DiagnosticsLog.Fatalf("Couldn't read seed: %s\n", err)
+		}
+	}
+	if len(seed) == 0 {
+		dwgd.EventsLog.Println("seed is required")
+		peersGenerateCmd.Usage()
+		os.Exit(1)
+	}
+
+	var psk *wgtypes.Key
+	if *pskFlag != "" {
+		key, err := wgtypes.ParseKey(*pskFlag)
+		if err != nil {
+			dwgd.DiagnosticsLog.Fatalf("Invalid preshared key: %s\n", err)
+		}
+		psk = &key
+	}
+
+	generated, err := dwgd.GeneratePeers(*subnetFlag, seed, psk)
+	if err != nil {
+		dwgd.DiagnosticsLog.Fatalf("Couldn't generate peers: %s\n", err)
+	}
+	if err := dwgd.WritePeers(os.Stdout, generated, *formatFlag); err != nil {
+		dwgd.DiagnosticsLog.Fatalf("Couldn't write peers: %s\n", err)
+	}
+	os.Exit(0)
+}
+
+// stateFlags are the flags of the subcommands reading the state of dwgd.
+type stateFlags struct {
+	config   *string
+	instance *string
+	runDir   *string
+	db       *string
+	format   *string
+}
+
+func newStateFlags(fs *flag.FlagSet) *stateFlags {
+	return &stateFlags{
+		config:   fs.String("config", "", "TOML configuration file of the daemon"),
+		instance: fs.String("instance", "", "name of the instance"),
+		runDir:   fs.String("run-dir", "", "directory where the admin socket is created"),
+		db:       fs.String("d", "", "dwgd db path, read when the daemon is not running"),
+		format:   fs.String("format", dwgd.OutputFormatTable, "output format: table or json"),
+	}
+}
+
+// open returns a reader of the state of the instance given by the flags,
+// asking the daemon through its admin socket or, if it's not running,
+// reading its database.
+func (s *stateFlags) open() dwgd.StateReader {
+	cfg := dwgd.NewConfig()
+	cfg.Db = ""
+	if *s.config != "" {
+		if err := dwgd.LoadConfigFile(cfg, *s.config); err != nil {
+			dwgd.DiagnosticsLog.Fatalf("Couldn't load configuration: %s\n", err)
+		}
+	}
+	if *s.instance != "" {
+		cfg.Instance = *s.instance
+	}
+	if *s.runDir != "" {
+		cfg.RunDir = *s.runDir
+	}
+	if *s.db != "" {
+		cfg.Db = *s.db
+	}
+	if cfg.Db == "" {
+		cfg.Db = dwgd.DefaultDbPath(cfg.Instance)
+	}
+
+	sockPath := cfg.AdminSockPath()
+	if _, err := os.Stat(sockPath); err != nil {
+		// sqlite would create a missing database, tell the user instead
+		if _, err := os.Stat(cfg.Db); err != nil {
+			dwgd.DiagnosticsLog.Fatalf("Couldn't reach the daemon nor read its database: %s\n", err)
+		}
+	}
+	r, err := dwgd.OpenStateReader(sockPath, cfg.Db)
+	if err != nil {
+		dwgd.DiagnosticsLog.Fatalf("Couldn't read the state of dwgd: %s\n", err)
+	}
+	return r
+}
+
+// devices returns the live state of the WireGuard interfaces, or none if
+// they can't be read, e.g. because the daemon is not running and the
+// command has not been run as root.
+func devices(r dwgd.StateReader) []dwgd.DeviceInfo {
+	devices, err := r.Devices()
+	if err != nil {
+		dwgd.DiagnosticsLog.Printf("Couldn't read the WireGuard interfaces: %s\n", err)
+		return nil
+	}
+	return devices
+}
+
+var networkLsCmd = flag.NewFlagSet("network ls", flag.ExitOnError)
+var networkLsFlags = newStateFlags(networkLsCmd)
+var networkInspectCmd = flag.NewFlagSet("network inspect", flag.ExitOnError)
+var networkInspectFlags = newStateFlags(networkInspectCmd)
+
+func networkCommand(args []string) {
+	if len(args) == 0 || (args[0] != "ls" && args[0] != "inspect") {
+		dwgd.EventsLog.Println("usage: dwgd network ls|inspect [options]")
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "ls":
+		networkLsCmd.Parse(args[1:])
+		r := networkLsFlags.open()
+		var networks []dwgd.NetworkInfo
+		networks, err = r.Networks()
+		if err == nil {
+			err = dwgd.WriteNetworks(os.Stdout, networks, devices(r), *networkLsFlags.format)
+		}
+		r.Close()
+	case "inspect":
+		networkInspectCmd.Parse(args[1:])
+		if networkInspectCmd.NArg() != 1 {
+			dwgd.EventsLog.Println("usage: dwgd network inspect [options] <id>")
+			os.Exit(1)
+		}
+		r := networkInspectFlags.open()
+		var n *dwgd.NetworkInfo
+		n, err = r.Network(networkInspectCmd.Arg(0))
+		if err == nil && n == nil {
+			err = fmt.Errorf("NetworkID %s not found", networkInspectCmd.Arg(0))
+		}
+		if err == nil {
+			err = dwgd.WriteNetwork(os.Stdout, n, devices(r), *networkInspectFlags.format)
+		}
+		r.Close()
+	}
+	if err != nil {
+		dwgd.DiagnosticsLog.Printf("Couldn't %s networks: %s\n", args[0], err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+var endpointLsCmd = flag.NewFlagSet("endpoint ls", flag.ExitOnError)
+var endpointLsFlags = newStateFlags(endpointLsCmd)
+var endpointNetworkFlag = endpointLsCmd.String("network", "", "ID of the network to list the endpoints of")
+
+func endpointCommand(args []string) {
+	if len(args) == 0 || args[0] != "ls" {
+		dwgd.EventsLog.Println("usage: dwgd endpoint ls [options]")
+		os.Exit(1)
+	}
+	endpointLsCmd.Parse(args[1:])
+	r := endpointLsFlags.open()
+	clients, err := r.Clients(*endpointNetworkFlag)
+	if err == nil {
+		err = dwgd.WriteClients(os.Stdout, clients, devices(r), *endpointLsFlags.format)
+	}
+	r.Close()
+	if err != nil {
+		dwgd.DiagnosticsLog.Printf("Couldn't list endpoints: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+var statusCmd = flag.NewFlagSet("status", flag.ExitOnError)
+var statusFlags = newStateFlags(statusCmd)
+
+func status(args []string) {
+	statusCmd.Parse(args)
+	r := statusFlags.open()
+	s, err := dwgd.ReadStatus(r)
+	if err == nil {
+		err = dwgd.WriteStatus(os.Stdout, s, *statusFlags.format)
+	}
+	r.Close()
+	if err != nil {
+		dwgd.DiagnosticsLog.Printf("Couldn't read status: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+var agentCfg = &dwgd.AgentConfig{}
+var agentCmd = flag.NewFlagSet("agent", flag.ExitOnError)
+
+func init() {
+	agentCmd.StringVar(&agentCfg.Addr, "listen", ":7777", "address to listen on")
+	agentCmd.StringVar(&agentCfg.Ifname, "i", "", "WireGuard interface the drivers can add peers to")
+	agentCmd.Var(&stringsFlag{values: &agentCfg.Subnets}, "subnet", "subnet the addresses of the peers must belong to (can be repeated)")
+	agentCmd.StringVar(&agentCfg.StateFile, "state", dwgd.DefaultAgentStatePath, "file recording the peers added by the drivers")
+	agentCmd.StringVar(&agentCfg.CAFile, "tls-ca", "", "CA used to verify the drivers")
+	agentCmd.StringVar(&agentCfg.CertFile, "tls-cert", "", "certificate of the agent")
+	agentCmd.StringVar(&agentCfg.KeyFile, "tls-key", "", "key of the agent")
+}
+
+func agent(args []string) {
+	agentCmd.Parse(args)
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+
+	a, err := dwgd.NewAgent(nil, agentCfg, nil)
+	if err != nil {
+		dwgd.DiagnosticsLog.Fatalf("Couldn't initialize agent: %s\n", err)
+	}
+	go func() {
+		if err := a.Start(); err != nil {
+			dwgd.DiagnosticsLog.Fatalf("Couldn't start agent: %s\n", err)
+		}
+	}()
+	dwgd.DiagnosticsLog.Printf("Agent for %s listening on %s\n", agentCfg.Ifname, a.Addr())
+
+	sig := <-signalCh
+	dwgd.DiagnosticsLog.Printf("Received signal: %s", sig.String())
+	if err := a.Stop(); err != nil {
+		dwgd.DiagnosticsLog.Printf("Couldn't stop agent: %s\n", err)
+	}
+	os.Exit(0)
+}
+
 func main() {
 	if len(os.Args) >= 2 {
 		switch os.Args[1] {
 		case "pubkey":
 			pubkey(os.Args[2:])
+		case "agent":
+			agent(os.Args[2:])
+		case "peers":
+			peers(os.Args[2:])
+		case "network":
+			networkCommand(os.Args[2:])
+		case "endpoint":
+			endpointCommand(os.Args[2:])
+		case "status":
+			status(os.Args[2:])
 		}
 	}
 
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
+	// The flags are parsed once here for -config, -version and -help, the
+	// configuration itself is built by loadConfig.
+	registerFlags(flag.CommandLine, dwgd.NewConfig())
 	flag.Parse()
 
-	if cfg.Db == "" {
-		cfg.Db = ":memory:"
-	}
-
-	if cfg.Verbose {
-		dwgd.TraceLog.SetOutput(os.Stderr)
-	}
-
 	version := *versionFlag
 	if version {
 		if Version != "" {
@@ -79,7 +466,15 @@ func main() {
 		os.Exit(0)
 	}
 
-	dwgd.TraceLog.Printf("Running with the following configuration: %+v\n", cfg)
+	cfg, err := loadConfig(*configFlag, os.Args[1:])
+	if err != nil {
+		dwgd.DiagnosticsLog.Fatalf("Couldn't load configuration: %s\n", err)
+	}
+	if err := dwgd.ConfigureLogging(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		dwgd.DiagnosticsLog.Fatalf("Couldn't configure logging: %s\n", err)
+	}
+
+	dwgd.TraceLog.Printf("Running with the following configuration: %s\n", dwgd.Jsonify(cfg))
 	plugin, err := dwgd.NewDwgd(cfg)
 	if err != nil {
 		dwgd.DiagnosticsLog.Fatalf("Couldn't initialize plugin: %s\n", err)
@@ -89,8 +484,22 @@ func main() {
 		dwgd.DiagnosticsLog.Fatalf("Couldn't start plugin: %s\n", err)
 	}
 
-	sig := <-signalCh
-	dwgd.DiagnosticsLog.Printf("Received signal: %s", sig.String())
+	for sig := range signalCh {
+		dwgd.DiagnosticsLog.Printf("Received signal: %s", sig.String())
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		cfg, err := loadConfig(*configFlag, os.Args[1:])
+		if err == nil {
+			err = plugin.Reload(cfg)
+		}
+		if err != nil {
+			dwgd.DiagnosticsLog.Printf("Couldn't reload configuration: %s\n", err)
+			continue
+		}
+		dwgd.DiagnosticsLog.Println("Configuration reloaded")
+	}
 	signal.Stop(signalCh)
 
 	err = plugin.Stop()
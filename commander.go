@@ -1,9 +1,12 @@
 package dwgd
 
 import (
+	"bytes"
+	"fmt"
 	"io/fs"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 // commander abstracts the os and os/exec stdlib packages.
@@ -15,9 +18,14 @@ type commander interface {
 	ReadFile(name string) ([]byte, error)
 	ReadDir(name string) ([]fs.DirEntry, error)
 	Remove(name string) error
+	Stat(name string) (fs.FileInfo, error)
 	Symlink(oldname string, newname string) error
+	// WriteFile replaces name atomically, so that readers never see a
+	// partially written file.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
 	// os/exec
 	LookPath(file string) (string, error)
+	// Run runs a command, its standard error is part of the returned error.
 	Run(name string, arg ...string) error
 }
 
@@ -43,15 +51,31 @@ func (e *execCommander) Remove(name string) error {
 	return os.Remove(name)
 }
 
+func (e *execCommander) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
 func (e *execCommander) Symlink(oldname string, newname string) error {
 	return os.Symlink(oldname, newname)
 }
 
+func (e *execCommander) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return writeFileAtomic(name, data, perm)
+}
+
 func (e *execCommander) LookPath(file string) (string, error) {
 	return exec.LookPath(file)
 }
 
 func (e *execCommander) Run(name string, arg ...string) error {
+	var stderr bytes.Buffer
 	cmd := exec.Command(name, arg...)
-	return cmd.Run()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return err
+	}
+	return nil
 }
@@ -1,16 +1,139 @@
 package dwgd
 
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+const defaultDbDir = "/var/lib"
+
+var instanceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
 // A Config represents the configuration of an instance of a dwgd driver.
 type Config struct {
-	Db       string // path to the database
-	Verbose  bool   // whether to print debug logs or not
-	Rootless bool   // whether to run in rootless compatibility mode or not
+	Instance             string            // name of the instance, used to run multiple dwgd on the same host
+	Db                   string            // path to the database
+	LogLevel             string            // minimum level of the logged records: debug, info, warn or error
+	LogFormat            string            // format of the logs: text or json
+	Rootless             bool              // whether to run in rootless compatibility mode or not
+	RootlessRuntimeRoots []string          // directories containing the XDG_RUNTIME_DIRs of rootless docker daemons
+	PeerAllowlist        PeerAllowlist     // processes allowed to connect to the plugin socket
+	RunDir               string            // directory where the plugin socket is created
+	PluginSockDir        string            // directory where docker looks for plugin sockets
+	TCP                  TCPConfig         // optional TCP listener
+	PluginMode           bool              // whether dwgd is running as a docker managed plugin
+	Admin                bool              // whether to serve the admin API on its own socket, next to the plugin one
+	MetricsAddr          string            // address the Prometheus metrics are served on, disabled if empty
+	HealthInterval       time.Duration     // how often the tunnels of the containers are checked, disabled if 0
+	Backend              string            // how WireGuard interfaces are implemented: auto, kernel or userspace
+	Scope                string            // scope of the networks: local or global
+	Store                string            // URL of the store shared with the other hosts, disabled if empty
+	AdvertiseAddr        string            // address the other hosts reach the containers of this one on
+	MeshSyncInterval     time.Duration     // how often global mesh networks are synced with the store
+	StoreTLS             ClientTLSConfig   // credentials used to connect to an etcd+https store
+	AgentTLS             ClientTLSConfig   // credentials used to connect to agents
+	ProfilesDir          string            // directory holding the network profiles
+	NetworkDefaults      map[string]string // driver options of the networks created without them
+}
+
+// A TCPConfig represents the configuration of the optional TCP listener,
+// used by docker daemons running on other hosts.
+// Docker daemons are authenticated through mutual TLS.
+type TCPConfig struct {
+	Addr         string // address to listen on, the listener is disabled if empty
+	CAFile       string // CA used to verify the certificates of the docker daemons
+	CertFile     string // certificate presented to the docker daemons
+	KeyFile      string // key of CertFile
+	SpecDir      string // directory where the plugin spec file is written, skipped if empty
+	SpecAddr     string // address the docker daemons connect to, defaults to Addr
+	SpecCAFile   string // CA used by the docker daemons to verify CertFile
+	SpecCertFile string // certificate presented by the docker daemons
+	SpecKeyFile  string // key of SpecCertFile
 }
 
 func NewConfig() *Config {
 	return &Config{
-		Db:       "/var/lib/dwgd.db",
-		Verbose:  false,
-		Rootless: true,
+		Db:                   DefaultDbPath(""),
+		LogLevel:             LogLevelInfo,
+		LogFormat:            LogFormatText,
+		Rootless:             true,
+		RootlessRuntimeRoots: []string{defaultXdgRuntimeRoot},
+		RunDir:               defaultDwgdRunDir,
+		Admin:                true,
+		Backend:              BackendAuto,
+		Scope:                network.LocalScope,
+		MeshSyncInterval:     10 * time.Second,
+		HealthInterval:       30 * time.Second,
+		ProfilesDir:          defaultProfilesDir,
+		PluginSockDir:        defaultDockerPluginSockDir,
+		TCP: TCPConfig{
+			SpecDir: defaultDockerPluginSpecDir,
+		},
+	}
+}
+
+// DefaultDbPath returns the default path of the database of the instance
+// called instance.
+func DefaultDbPath(instance string) string {
+	return fmt.Sprintf("%s/%s.db", defaultDbDir, pluginName(instance))
+}
+
+func pluginName(instance string) string {
+	if instance == "" {
+		return dwgdPluginName
+	}
+	return dwgdPluginName + "-" + instance
+}
+
+// PluginName returns the name docker daemons use to refer to the instance,
+// i.e. the value passed to the --driver option.
+func (c *Config) PluginName() string {
+	return pluginName(c.Instance)
+}
+
+// SockName returns the name of the plugin socket of the instance.
+func (c *Config) SockName() string {
+	return c.PluginName() + ".sock"
+}
+
+// AdminSockPath returns the path of the admin socket of the instance.
+func (c *Config) AdminSockPath() string {
+	return path.Join(c.RunDir, c.PluginName()+"-admin.sock")
+}
+
+// SetPluginMode configures the instance to run as a docker managed plugin.
+// The plugin socket is created directly in the plugin's socket directory
+// and the rootless symlinker is disabled: the plugin belongs to the
+// daemon that installed it.
+func (c *Config) SetPluginMode() {
+	c.PluginMode = true
+	c.Rootless = false
+	c.RunDir = c.PluginSockDir
+	c.TCP = TCPConfig{}
+}
+
+func (c *Config) Validate() error {
+	if c.Instance != "" && !instanceNameRegex.MatchString(c.Instance) {
+		return fmt.Errorf("invalid instance name %q", c.Instance)
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		return fmt.Errorf("invalid log format %q", c.LogFormat)
+	}
+	if c.Scope != network.LocalScope && c.Scope != network.GlobalScope {
+		return fmt.Errorf("invalid scope %q", c.Scope)
+	}
+	if c.Store != "" && c.AdvertiseAddr == "" {
+		return fmt.Errorf("a shared store requires an advertise address")
+	}
+	if c.Store != "" && c.MeshSyncInterval <= 0 {
+		return fmt.Errorf("invalid mesh sync interval %s", c.MeshSyncInterval)
 	}
+	return nil
 }
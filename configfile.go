@@ -0,0 +1,264 @@
+package dwgd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// LoadConfigFile sets the fields of c found in the TOML configuration file
+// at path, leaving the other ones untouched. Unknown keys are reported as
+// errors, so that typos don't go unnoticed.
+func LoadConfigFile(c *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseTOML(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := c.applyConfigValues(values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// configTable reads the typed values of a table of the configuration file,
+// remembering the first error.
+type configTable struct {
+	name   string
+	values map[string]interface{}
+	err    error
+}
+
+func (t *configTable) key(k string) string {
+	if t.name == "" {
+		return k
+	}
+	return t.name + "." + k
+}
+
+func (t *configTable) fail(k string, expected string) {
+	if t.err == nil {
+		t.err = fmt.Errorf("%s: expected %s", t.key(k), expected)
+	}
+}
+
+func (t *configTable) table(k string) *configTable {
+	sub := &configTable{name: t.key(k), values: make(map[string]interface{})}
+	if v, ok := t.values[k]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			t.fail(k, "a table")
+			return sub
+		}
+		sub.values = m
+	}
+	return sub
+}
+
+func (t *configTable) string(k string, dst *string) {
+	if v, ok := t.values[k]; ok {
+		s, ok := v.(string)
+		if !ok {
+			t.fail(k, "a string")
+			return
+		}
+		*dst = s
+	}
+}
+
+func (t *configTable) bool(k string, dst *bool) {
+	if v, ok := t.values[k]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			t.fail(k, "a boolean")
+			return
+		}
+		*dst = b
+	}
+}
+
+func (t *configTable) duration(k string, dst *time.Duration) {
+	var s string
+	t.string(k, &s)
+	if s == "" {
+		return
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		t.fail(k, "a duration")
+		return
+	}
+	*dst = d
+}
+
+func (t *configTable) strings(k string, dst *[]string) {
+	if v, ok := t.values[k]; ok {
+		array, ok := v.([]interface{})
+		if !ok {
+			t.fail(k, "an array of strings")
+			return
+		}
+		values := make([]string, 0, len(array))
+		for _, e := range array {
+			s, ok := e.(string)
+			if !ok {
+				t.fail(k, "an array of strings")
+				return
+			}
+			values = append(values, s)
+		}
+		*dst = values
+	}
+}
+
+func (t *configTable) uint32s(k string, dst *[]uint32) {
+	if v, ok := t.values[k]; ok {
+		array, ok := v.([]interface{})
+		if !ok {
+			t.fail(k, "an array of integers")
+			return
+		}
+		values := make([]uint32, 0, len(array))
+		for _, e := range array {
+			n, ok := e.(int64)
+			if !ok || n < 0 || n > 1<<32-1 {
+				t.fail(k, "an array of integers")
+				return
+			}
+			values = append(values, uint32(n))
+		}
+		*dst = values
+	}
+}
+
+// options reads the whole table as driver options, with the dwgd. prefix
+// added to the keys.
+func (t *configTable) options(dst *map[string]string) {
+	options := make(map[string]string, len(t.values))
+	for k, v := range t.values {
+		switch v := v.(type) {
+		case string:
+			options["dwgd."+k] = v
+		case int64:
+			options["dwgd."+k] = strconv.FormatInt(v, 10)
+		case bool:
+			options["dwgd."+k] = strconv.FormatBool(v)
+		default:
+			t.fail(k, "a string, an integer or a boolean")
+			return
+		}
+	}
+	*dst = options
+}
+
+// only reports the keys of the table that are not in known.
+func (t *configTable) only(known ...string) {
+	unknown := make([]string, 0)
+	for k := range t.values {
+		found := false
+		for _, kk := range known {
+			if k == kk {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, t.key(k))
+		}
+	}
+	if len(unknown) > 0 && t.err == nil {
+		sort.Strings(unknown)
+		t.err = fmt.Errorf("unknown keys: %v", unknown)
+	}
+}
+
+// applyConfigValues sets the fields of c found in the parsed configuration
+// file values.
+func (c *Config) applyConfigValues(values map[string]interface{}) error {
+	root := &configTable{values: values}
+	root.only("instance", "db", "log_level", "log_format", "backend", "profiles_dir",
+		"rootless", "socket", "admin", "metrics", "health", "allow", "tcp", "mesh", "store_tls", "agent_tls", "network")
+
+	root.string("instance", &c.Instance)
+	root.string("db", &c.Db)
+	root.string("backend", &c.Backend)
+	root.string("profiles_dir", &c.ProfilesDir)
+
+	root.string("log_level", &c.LogLevel)
+	root.string("log_format", &c.LogFormat)
+
+	rootless := root.table("rootless")
+	rootless.only("enabled", "runtime_roots")
+	rootless.bool("enabled", &c.Rootless)
+	rootless.strings("runtime_roots", &c.RootlessRuntimeRoots)
+
+	socket := root.table("socket")
+	socket.only("run_dir", "plugin_sock_dir", "plugin")
+	socket.string("run_dir", &c.RunDir)
+	socket.string("plugin_sock_dir", &c.PluginSockDir)
+	socket.bool("plugin", &c.PluginMode)
+
+	admin := root.table("admin")
+	admin.only("enabled")
+	admin.bool("enabled", &c.Admin)
+
+	metrics := root.table("metrics")
+	metrics.only("addr")
+	metrics.string("addr", &c.MetricsAddr)
+
+	health := root.table("health")
+	health.only("interval")
+	health.duration("interval", &c.HealthInterval)
+
+	allow := root.table("allow")
+	allow.only("uids", "gids", "cgroups")
+	allow.uint32s("uids", &c.PeerAllowlist.Uids)
+	allow.uint32s("gids", &c.PeerAllowlist.Gids)
+	allow.strings("cgroups", &c.PeerAllowlist.Cgroups)
+
+	tcp := root.table("tcp")
+	tcp.only("addr", "tls_ca", "tls_cert", "tls_key", "spec_dir", "spec_addr", "spec_tls_ca", "spec_tls_cert", "spec_tls_key")
+	tcp.string("addr", &c.TCP.Addr)
+	tcp.string("tls_ca", &c.TCP.CAFile)
+	tcp.string("tls_cert", &c.TCP.CertFile)
+	tcp.string("tls_key", &c.TCP.KeyFile)
+	tcp.string("spec_dir", &c.TCP.SpecDir)
+	tcp.string("spec_addr", &c.TCP.SpecAddr)
+	tcp.string("spec_tls_ca", &c.TCP.SpecCAFile)
+	tcp.string("spec_tls_cert", &c.TCP.SpecCertFile)
+	tcp.string("spec_tls_key", &c.TCP.SpecKeyFile)
+
+	mesh := root.table("mesh")
+	mesh.only("scope", "store", "advertise_addr", "sync_interval")
+	mesh.string("scope", &c.Scope)
+	mesh.string("store", &c.Store)
+	mesh.string("advertise_addr", &c.AdvertiseAddr)
+	mesh.duration("sync_interval", &c.MeshSyncInterval)
+
+	storeTLS := root.table("store_tls")
+	storeTLS.only("ca", "cert", "key")
+	storeTLS.string("ca", &c.StoreTLS.CAFile)
+	storeTLS.string("cert", &c.StoreTLS.CertFile)
+	storeTLS.string("key", &c.StoreTLS.KeyFile)
+
+	agentTLS := root.table("agent_tls")
+	agentTLS.only("ca", "cert", "key")
+	agentTLS.string("ca", &c.AgentTLS.CAFile)
+	agentTLS.string("cert", &c.AgentTLS.CertFile)
+	agentTLS.string("key", &c.AgentTLS.KeyFile)
+
+	network := root.table("network")
+	network.options(&c.NetworkDefaults)
+
+	for _, t := range []*configTable{root, rootless, socket, admin, metrics, health, allow, tcp, mesh, storeTLS, agentTLS, network} {
+		if t.err != nil {
+			return t.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package dwgd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "dwgd.toml")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := write(t, `
+db = "/srv/dwgd.db"
+log_level = "debug"
+log_format = "json"
+profiles_dir = "/srv/profiles"
+
+[rootless]
+enabled = false
+runtime_roots = ["/srv/runtime"]
+
+[admin]
+enabled = false
+
+[metrics]
+addr = "127.0.0.1:9586"
+
+[health]
+interval = "1m"
+
+[allow]
+uids = [1000]
+cgroups = ["/system.slice/docker.service"]
+
+[mesh]
+scope = "global"
+store = "memory:"
+advertise_addr = "192.0.2.1"
+sync_interval = "30s"
+
+[store_tls]
+ca = "/srv/etcd-ca.pem"
+
+[network]
+mtu = 1380
+route = "10.0.0.0/8"
+`)
+	cfg := NewConfig()
+	if err := LoadConfigFile(cfg, path); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := NewConfig()
+	expected.Db = "/srv/dwgd.db"
+	expected.LogLevel = LogLevelDebug
+	expected.LogFormat = LogFormatJSON
+	expected.ProfilesDir = "/srv/profiles"
+	expected.Rootless = false
+	expected.RootlessRuntimeRoots = []string{"/srv/runtime"}
+	expected.Admin = false
+	expected.MetricsAddr = "127.0.0.1:9586"
+	expected.HealthInterval = time.Minute
+	expected.PeerAllowlist = PeerAllowlist{Uids: []uint32{1000}, Cgroups: []string{"/system.slice/docker.service"}}
+	expected.Scope = network.GlobalScope
+	expected.Store = "memory:"
+	expected.AdvertiseAddr = "192.0.2.1"
+	expected.MeshSyncInterval = 30 * time.Second
+	expected.StoreTLS = ClientTLSConfig{CAFile: "/srv/etcd-ca.pem"}
+	expected.NetworkDefaults = map[string]string{"dwgd.mtu": "1380", "dwgd.route": "10.0.0.0/8"}
+	if !cmp.Equal(cfg, expected) {
+		t.Fatalf("mismatch: %s", cmp.Diff(cfg, expected))
+	}
+
+	invalid := map[string]string{
+		"unknown key":        "foo = 1\n",
+		"unknown nested key": "[tcp]\nfoo = 1\n",
+		"wrong type":         "db = 1\n",
+		"wrong duration":     "[mesh]\nsync_interval = \"soon\"\n",
+		"negative uid":       "[allow]\nuids = [-1]\n",
+		"not a table":        "rootless = true\n",
+	}
+	for name, content := range invalid {
+		if err := LoadConfigFile(NewConfig(), write(t, content)); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDriver_Reload(t *testing.T) {
+	n := NetworkFixture()
+	tc := CommanderFixture()
+	tc.ReadFileFunc = func(name string) ([]byte, error) {
+		if name == "/srv/profiles/corp.toml" {
+			return []byte("pubkey = \"" + n.pubkey.String() + "\"\n"), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	cfg := ConfigFixture()
+	d, err := NewDriver(cfg, tc, WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	create := func(id string) (*Network, error) {
+		err := d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: id,
+			Options: map[string]interface{}{
+				"com.docker.network.generic": map[string]interface{}{
+					"dwgd.endpoint": n.endpoint.String(),
+					"dwgd.profile":  "corp",
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return d.s.GetNetwork(id)
+	}
+
+	if _, err := create("before"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	cfg.ProfilesDir = "/srv/profiles"
+	cfg.NetworkDefaults = map[string]string{"dwgd.seed": string(n.seed), "dwgd.mtu": "1380"}
+	d.Reload(cfg)
+
+	after, err := create("after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.pubkey != n.pubkey || string(after.seed) != string(n.seed) || after.mtu != 1380 {
+		t.Fatalf("reload not applied: %#v", after)
+	}
+}
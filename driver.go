@@ -1,10 +1,13 @@
 package dwgd
 
 import (
-	"errors"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
 	"net"
-	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/network"
 	_ "github.com/mattn/go-sqlite3"
@@ -14,6 +17,7 @@ import (
 
 type wgController interface {
 	Device(name string) (*wgtypes.Device, error)
+	Devices() ([]*wgtypes.Device, error)
 	ConfigureDevice(name string, cfg wgtypes.Config) error
 }
 
@@ -21,12 +25,36 @@ type wgController interface {
 type Driver struct {
 	network.Driver
 
-	c   commander
-	wgc wgController
-	s   *Storage
+	c             commander
+	wgc           wgController
+	netnsWgc      func(path string) wgController // returns the wgController of another network namespace
+	s             *Storage
+	links         linkBackend
+	rootlessRoots []string
+
+	scope         string      // scope advertised to docker, local or global
+	store         SharedStore // state shared with the other hosts, nil if not configured
+	storePrefix   string      // prefix of the keys of this instance in the store
+	advertiseAddr string      // address the other hosts reach this one on
+	meshSyncCh    chan struct{}
+	meshTTL       time.Duration // how long the records published by this host outlive their last refresh
+	agentTLS      *tls.Config   // used to connect to the agents of pubkey mode networks, nil if not configured
+
+	agentMu      sync.Mutex
+	agentClients map[string]*agentClient // by URL of the agent
+
+	// The following fields can be changed by Reload.
+	settingsMu      sync.RWMutex
+	profilesDir     string            // directory the dwgd.profile option is resolved in
+	networkDefaults map[string]string // options of the networks created without them
+
+	// State of the tunnels of the joined clients, kept by the health monitor.
+	healthMu    sync.Mutex
+	tunnels     map[string]*tunnelHealth // by endpoint ID
+	staleEvents uint64                   // number of tunnels that went stale
 }
 
-func NewDriver(dbPath string, c commander, wgc wgController) (*Driver, error) {
+func NewDriver(cfg *Config, c commander, wgc wgController) (*Driver, error) {
 	if c == nil {
 		c = &execCommander{}
 	}
@@ -45,82 +73,261 @@ func NewDriver(dbPath string, c commander, wgc wgController) (*Driver, error) {
 		}
 	}
 
+	links, err := newLinkBackend(c, cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	var store SharedStore
+	if cfg.Store != "" {
+		var storeTLS *tls.Config
+		if cfg.StoreTLS != (ClientTLSConfig{}) {
+			storeTLS, err = newClientTLSConfig(c, &cfg.StoreTLS)
+			if err != nil {
+				return nil, err
+			}
+		}
+		store, err = newSharedStore(cfg.Store, storeTLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var agentTLS *tls.Config
+	if cfg.AgentTLS.CertFile != "" {
+		agentTLS, err = newClientTLSConfig(c, &cfg.AgentTLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	s := &Storage{}
-	err = s.Open(dbPath)
+	err = s.Open(cfg.Db)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Driver{
-		c:   c,
-		wgc: wgc,
-		s:   s,
-	}, nil
+	d := &Driver{
+		c:             c,
+		wgc:           wgc,
+		netnsWgc:      newNetnsWgController,
+		s:             s,
+		links:         links,
+		rootlessRoots: cfg.RootlessRuntimeRoots,
+		scope:         cfg.Scope,
+		store:         store,
+		storePrefix:   cfg.PluginName() + "/",
+		advertiseAddr: cfg.AdvertiseAddr,
+		meshSyncCh:    make(chan struct{}, 1),
+		meshTTL:       meshTTLIntervals * cfg.MeshSyncInterval,
+		agentTLS:      agentTLS,
+		tunnels:       make(map[string]*tunnelHealth),
+	}
+	d.Reload(cfg)
+
+	if err := d.restoreServers(); err != nil {
+		DiagnosticsLog.Printf("Couldn't restore server interfaces: %s\n", err)
+	}
+
+	return d, nil
+}
+
+// Reload applies the settings of cfg that can change while the driver is
+// running: the profiles directory and the default network options.
+func (d *Driver) Reload(cfg *Config) {
+	d.settingsMu.Lock()
+	defer d.settingsMu.Unlock()
+
+	d.profilesDir = cfg.ProfilesDir
+	d.networkDefaults = cfg.NetworkDefaults
 }
 
 func (d *Driver) Close() error {
+	d.agentMu.Lock()
+	for _, client := range d.agentClients {
+		client.client.CloseIdleConnections()
+	}
+	d.agentMu.Unlock()
+
+	if d.store != nil {
+		if err := d.store.Close(); err != nil {
+			TraceLog.Printf("Error during store close: %s\n", err)
+		}
+	}
 	return d.s.Close()
 }
 
 func (d *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
-	TraceLog.Printf("GetCapabilities\n")
+	defer logResult(requestLogger("GetCapabilities", "", "", nil), nil)
+	if d.scope == network.GlobalScope {
+		return &network.CapabilitiesResponse{Scope: network.GlobalScope, ConnectivityScope: network.GlobalScope}, nil
+	}
 	return &network.CapabilitiesResponse{Scope: network.LocalScope, ConnectivityScope: network.LocalScope}, nil
 }
 
+// AllocateNetwork is called on swarm managers for global scope networks.
+// dwgd keeps no manager side state: every node gets the network options in
+// CreateNetwork.
+func (d *Driver) AllocateNetwork(r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
+	defer logResult(requestLogger("AllocateNetwork", r.NetworkID, "", r), nil)
+	return &network.AllocateNetworkResponse{Options: make(map[string]string)}, nil
+}
+
+func (d *Driver) FreeNetwork(r *network.FreeNetworkRequest) error {
+	defer logResult(requestLogger("FreeNetwork", r.NetworkID, "", r), nil)
+	return nil
+}
+
+// DiscoverNew is called when a node joins the cluster. The peers of the new
+// node are learnt through the shared store, so we just sync earlier.
+func (d *Driver) DiscoverNew(r *network.DiscoveryNotification) error {
+	defer logResult(requestLogger("DiscoverNew", "", "", r), nil)
+	d.triggerMeshSync()
+	return nil
+}
+
+func (d *Driver) DiscoverDelete(r *network.DiscoveryNotification) error {
+	defer logResult(requestLogger("DiscoverDelete", "", "", r), nil)
+	d.triggerMeshSync()
+	return nil
+}
+
 func (d *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
-	TraceLog.Printf("CreateNetwork: %+v\n", Jsonify(r))
-	var err error
+	return d.createNetwork(r, rootTenant)
+}
+
+func (d *Driver) createNetwork(r *network.CreateNetworkRequest, t tenant) (err error) {
+	l := requestLogger("CreateNetwork", r.NetworkID, "", r)
+	defer logResult(l, &err)
 
-	n := &Network{}
+	n := &Network{id: r.NetworkID, owner: t.uid}
 	m := r.Options["com.docker.network.generic"].(map[string]interface{})
+	if err := t.checkOptions(m); err != nil {
+		return err
+	}
+	m, err = d.resolveOptions(l.Logger, n, m)
+	if err != nil {
+		return err
+	}
 
-	// The following two ifs are used to discern whether we are working in
-	// ifname mode or pubkey mode.
-	// By default we expect to work in pubkey mode, which is why if the ifname
-	// parameter is not present we do not return an error.
-	var iface *wgtypes.Device
-	ifname, ok := m["dwgd.ifname"].(string)
-	if !ok {
-		n.ifname = ""
-	} else {
-		iface, err = d.wgc.Device(ifname)
-		if errors.Is(err, os.ErrNotExist) {
-			TraceLog.Printf("Interface %s not recognized\n", ifname)
-			return err
+	if payload, ok := m["dwgd.create_server"].(string); ok {
+		n.createServer, err = strconv.ParseBool(payload)
+		if err != nil {
+			return fmt.Errorf("invalid dwgd.create_server option: %w", err)
 		}
-		TraceLog.Printf("Using %s as the WireGuard server interface\n", iface.Name)
-		n.ifname = iface.Name
 	}
 
-	if iface != nil {
-		n.pubkey = iface.PublicKey
-	} else {
-		payload, ok := m["dwgd.pubkey"].(string)
-		if !ok {
-			return fmt.Errorf("dwgd.pubkey option missing")
+	// If the ifname parameter is present we are working in ifname mode,
+	// otherwise in pubkey mode: which one is relevant depends on the
+	// provisioner of the network.
+	if ifname, ok := m["dwgd.ifname"].(string); ok {
+		n.ifname = ifname
+		if netns, ok := m["dwgd.ifname_netns"].(string); ok {
+			n.ifnameNetns, err = namedNetnsPath(netns)
+			if err != nil {
+				return err
+			}
 		}
+	} else if n.createServer {
+		return fmt.Errorf("dwgd.create_server requires the dwgd.ifname option")
+	}
+
+	// The peer can be imported from a wg-quick configuration, the other
+	// options take precedence over it.
+	confEndpoint, err := d.parseConfOption(l.Logger, n, m)
+	if err != nil {
+		return err
+	}
+	if payload, ok := m["dwgd.pubkey"].(string); ok {
 		n.pubkey, err = wgtypes.ParseKey(payload)
 		if err != nil {
 			return err
 		}
 	}
+	if payload, ok := m["dwgd.mtu"].(string); ok {
+		n.mtu, err = strconv.Atoi(payload)
+		if err != nil || n.mtu < 0 {
+			return fmt.Errorf("invalid dwgd.mtu option: %q", payload)
+		}
+	}
+	if payload, ok := m["dwgd.keepalive"].(string); ok {
+		n.keepalive, err = strconv.Atoi(payload)
+		if err != nil || n.keepalive < 0 {
+			return fmt.Errorf("invalid dwgd.keepalive option: %q", payload)
+		}
+		if n.keepalive == 0 {
+			n.keepalive = -1
+		}
+	}
+	if agent, ok := m["dwgd.agent"].(string); ok {
+		n.agent = agent
+	}
+	// The options are only kept for explicitly chosen provisioners, the
+	// default ones only need the fields above.
+	if provisioner, ok := m["dwgd.provisioner"].(string); ok {
+		n.provisioner = provisioner
+		setProvisionerOptions(n, m)
+	}
+
+	if n.createServer {
+		if err := parseServerOptions(n, m, r.IPv4Data); err != nil {
+			return err
+		}
+		if err := d.setupServer(l.Logger, n); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				d.teardownServer(l.Logger, n)
+			}
+		}()
+	}
+
+	if err := parsePersistOptions(n, m); err != nil {
+		return err
+	}
+	if err := parseHealthOptions(n, m); err != nil {
+		return err
+	}
+	if err := parseWaitHandshakeOptions(n, m); err != nil {
+		return err
+	}
+
+	p, err := d.provisionerFor(l.Logger, n)
+	if err != nil {
+		return err
+	}
+	info, err := p.Describe()
+	if err != nil {
+		return err
+	}
+	n.pubkey = info.PublicKey
 
 	// From this point on we get all the other parameters needed for both modes.
 	endpoint, ok := m["dwgd.endpoint"].(string)
-	if !ok {
-		if iface != nil {
-			endpoint = fmt.Sprintf("localhost:%d", iface.ListenPort)
-		} else {
-			return fmt.Errorf("dwgd.endpoint option missing")
+	if ok {
+		n.endpoint, err = net.ResolveUDPAddr("udp", endpoint)
+		if err != nil {
+			return err
 		}
+	} else if confEndpoint != "" {
+		n.endpoint, err = net.ResolveUDPAddr("udp", confEndpoint)
+		if err != nil {
+			return err
+		}
+	} else if info.Endpoint != nil {
+		n.endpoint = info.Endpoint
+	} else {
+		return fmt.Errorf("dwgd.endpoint option missing")
 	}
-	n.endpoint, err = net.ResolveUDPAddr("udp", endpoint)
-	if err != nil {
+
+	if err := parseKeyOptions(n, m); err != nil {
 		return err
 	}
 
+	// The seed is only needed to derive the keys of the clients.
 	seed, ok := m["dwgd.seed"].(string)
-	if !ok {
+	if !ok && n.keymode != KeyModeKeydir {
 		return fmt.Errorf("dwgd.seed option missing")
 	}
 	n.seed = []byte(seed)
@@ -131,17 +338,46 @@ func (d *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
 	}
 	n.route = route
 
-	n.id = r.NetworkID
+	if mesh, ok := m["dwgd.mesh"].(string); ok {
+		switch mesh {
+		case MeshLocal:
+		case MeshGlobal:
+			if d.store == nil || d.advertiseAddr == "" {
+				return fmt.Errorf("dwgd.mesh=global requires a shared store and an advertise address")
+			}
+		default:
+			return fmt.Errorf("invalid dwgd.mesh option: %q", mesh)
+		}
+		n.mesh = mesh
+	}
+
 	return d.s.AddNetwork(n)
 }
 
-func (d *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
-	TraceLog.Printf("DeleteNetwork: %+v\n", Jsonify(r))
+func (d *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) (err error) {
+	l := requestLogger("DeleteNetwork", r.NetworkID, "", r)
+	defer logResult(l, &err)
+
+	n, err := d.s.GetNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	if n != nil && n.createServer {
+		if err := d.teardownServer(l.Logger, n); err != nil {
+			return err
+		}
+	}
+
 	return d.s.RemoveNetwork(r.NetworkID)
 }
 
 func (d *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
-	TraceLog.Printf("CreateEndpoint: %+v\n", Jsonify(r))
+	return d.createEndpoint(r, rootTenant)
+}
+
+func (d *Driver) createEndpoint(r *network.CreateEndpointRequest, t tenant) (_ *network.CreateEndpointResponse, err error) {
+	l := requestLogger("CreateEndpoint", r.NetworkID, r.EndpointID, r)
+	defer logResult(l, &err)
 
 	n, err := d.s.GetNetwork(r.NetworkID)
 	if err != nil {
@@ -159,9 +395,16 @@ func (d *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.Crea
 		return nil, fmt.Errorf("EndpointID %s already exists", r.EndpointID)
 	}
 
-	ip, _, err := net.ParseCIDR(r.Interface.Address)
-	if err != nil {
-		return nil, err
+	// Keydir networks can pick the address of the endpoint themselves,
+	// when docker doesn't assign one, e.g. with the null IPAM driver.
+	var ip net.IP
+	if r.Interface != nil && r.Interface.Address != "" {
+		ip, _, err = net.ParseCIDR(r.Interface.Address)
+		if err != nil {
+			return nil, err
+		}
+	} else if n.keymode != KeyModeKeydir {
+		return nil, fmt.Errorf("EndpointID %s has no address", r.EndpointID)
 	}
 
 	endpointIdMaxLen := 12
@@ -173,18 +416,32 @@ func (d *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.Crea
 		ip:      ip,
 		ifname:  "wg-" + r.EndpointID[:endpointIdMaxLen],
 		network: n,
+		owner:   t.uid,
 	}
 
-	err = d.s.AddClient(c)
+	if n.keymode != KeyModeKeydir {
+		err = d.s.AddClient(c)
+	} else {
+		err = d.addKeydirClient(l.Logger, c)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if ip == nil {
+		bits := 8 * len(c.ip)
+		if ip4 := c.ip.To4(); ip4 != nil {
+			bits = 32
+		}
+		address := &net.IPNet{IP: c.ip, Mask: net.CIDRMask(bits, bits)}
+		return &network.CreateEndpointResponse{Interface: &network.EndpointInterface{Address: address.String()}}, nil
+	}
 	return &network.CreateEndpointResponse{}, nil
 }
 
-func (d *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
-	TraceLog.Printf("DeleteEndpoint: %+v\n", Jsonify(r))
+func (d *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) (err error) {
+	l := requestLogger("DeleteEndpoint", r.NetworkID, r.EndpointID, r)
+	defer logResult(l, &err)
 	c, err := d.s.GetClient(r.EndpointID)
 	if err != nil {
 		return err
@@ -193,7 +450,7 @@ func (d *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
 		return fmt.Errorf("EndpointID %s not found", r.EndpointID)
 	}
 
-	if err := d.c.Run("ip", "link", "delete", c.ifname); err != nil {
+	if err := d.links.Delete("", c.ifname); err != nil {
 		return err
 	}
 
@@ -201,12 +458,18 @@ func (d *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
 }
 
 func (d *Driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, error) {
-	TraceLog.Printf("EndpointInfo: %+v\n", Jsonify(r))
+	defer logResult(requestLogger("EndpointInfo", r.NetworkID, r.EndpointID, r), nil)
 	return &network.InfoResponse{Value: make(map[string]string)}, nil
 }
 
 func (d *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
-	TraceLog.Printf("Join: %+v\n", Jsonify(r))
+	return d.join(r, rootTenant)
+}
+
+// join joins the client to the sandbox on behalf of t, which must own it.
+func (d *Driver) join(r *network.JoinRequest, t tenant) (_ *network.JoinResponse, err error) {
+	l := requestLogger("Join", r.NetworkID, r.EndpointID, r)
+	defer logResult(l, &err)
 
 	c, err := d.s.GetClient(r.EndpointID)
 	if err != nil {
@@ -216,44 +479,87 @@ func (d *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 		return nil, fmt.Errorf("EndpointID %s not found", r.EndpointID)
 	}
 
-	if err := d.c.Run("ip", "link", "add", "name", c.ifname, "type", "wireguard"); err != nil {
+	// The sandbox is resolved before anything is set up, so that the
+	// sandboxes of other tenants are rejected early.
+	rootlessPid, err := rootlessSandboxPid(l.Logger, d.c, d.rootlessRoots, r.SandboxKey, t)
+	if err != nil {
 		return nil, err
 	}
 
-	cfg := c.Config()
-
-	err = d.wgc.ConfigureDevice(c.ifname, cfg)
-	if err != nil {
+	if err := d.links.Add(c.ifname); err != nil {
 		return nil, err
 	}
+	if c.network.mtu > 0 {
+		if err := d.c.Run("ip", "link", "set", "dev", c.ifname, "mtu", strconv.Itoa(c.network.mtu)); err != nil {
+			return nil, err
+		}
+	}
 
-	if c.network.ifname != "" {
-		TraceLog.Printf("Adding peer to: %s\n", c.network.ifname)
-		iface, err := d.wgc.Device(c.network.ifname)
+	cfg := c.Config()
+
+	var meshPeers []*Client
+	if c.network.mesh != "" {
+		meshPeers, err = d.meshPeers(c)
 		if err != nil {
 			return nil, err
 		}
+		c.listenPort, err = d.pickListenPort(c.ifname)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range meshPeers {
+			cfg.Peers = append(cfg.Peers, other.MeshPeerConfig())
+		}
+	}
+	if c.network.mesh == MeshGlobal {
+		remote, err := d.remoteMeshPeers(l.Logger, c.network)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Peers = append(cfg.Peers, remote...)
+	}
 
-		peers := make([]wgtypes.PeerConfig, 1)
-		peers[0] = c.PeerConfig()
+	err = d.wgc.ConfigureDevice(c.ifname, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-		newNetworkIfaceCfg := wgtypes.Config{
-			PrivateKey:   &iface.PrivateKey,
-			ListenPort:   &iface.ListenPort,
-			FirewallMark: &iface.FirewallMark,
-			ReplacePeers: false,
-			Peers:        peers,
+	if err := d.updateNetworkPeer(l.Logger, c.network, c.PeerConfig()); err != nil {
+		return nil, err
+	}
+
+	if c.network.WaitHandshake() > 0 {
+		if err := d.waitHandshake(c); err != nil {
+			if c.network.WaitHandshakePolicy() == WaitHandshakeFail {
+				clientPeer := c.PeerConfig()
+				clientPeer.Remove = true
+				if err := d.updateNetworkPeer(l.Logger, c.network, clientPeer); err != nil {
+					l.Warn("Couldn't remove the peer of the endpoint", "error", err)
+				}
+				return nil, err
+			}
+			l.Warn("Joining without a handshake", "error", err)
 		}
-		TraceLog.Printf("Updating configuration for %s:\n%+v\n", iface.Name, newNetworkIfaceCfg)
+	}
 
-		err = d.wgc.ConfigureDevice(iface.Name, newNetworkIfaceCfg)
-		if err != nil {
+	c.netns, err = moveToRootlessNamespaceIfNecessary(l.Logger, d.c, rootlessPid, r.SandboxKey, c.ifname)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.network.mesh != "" {
+		d.updateMeshPeers(l.Logger, meshPeers, c.MeshPeerConfig(), false)
+	}
+	if c.network.mesh == MeshGlobal {
+		if err := d.publishMeshPeer(c); err != nil {
 			return nil, err
 		}
 	}
 
-	err = moveToRootlessNamespaceIfNecessary(d.c, r.SandboxKey, c.ifname)
-	if err != nil {
+	if err := d.s.UpdateClientJoin(c); err != nil {
+		return nil, err
+	}
+	if err := d.persistPeers(l.Logger, c.network); err != nil {
 		return nil, err
 	}
 
@@ -275,8 +581,9 @@ func (d *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 	}, nil
 }
 
-func (d *Driver) Leave(r *network.LeaveRequest) error {
-	TraceLog.Printf("Leave: %+v\n", Jsonify(r))
+func (d *Driver) Leave(r *network.LeaveRequest) (err error) {
+	l := requestLogger("Leave", r.NetworkID, r.EndpointID, r)
+	defer logResult(l, &err)
 
 	c, err := d.s.GetClient(r.EndpointID)
 	if err != nil {
@@ -286,32 +593,42 @@ func (d *Driver) Leave(r *network.LeaveRequest) error {
 		return fmt.Errorf("EndpointID %s not found", r.EndpointID)
 	}
 
-	if c.network.ifname != "" {
-		TraceLog.Printf("Removing peer from: %s\n", c.network.ifname)
-		iface, err := d.wgc.Device(c.network.ifname)
+	clientPeer := c.PeerConfig()
+	clientPeer.Remove = true
+	if err := d.updateNetworkPeer(l.Logger, c.network, clientPeer); err != nil {
+		return err
+	}
+
+	if c.network.mesh != "" && c.netns != "" {
+		meshPeers, err := d.meshPeers(c)
 		if err != nil {
 			return err
 		}
-
-		peers := make([]wgtypes.PeerConfig, 1)
-		clientPeer := c.PeerConfig()
-		clientPeer.Remove = true
-		peers[0] = clientPeer
-
-		newNetworkIfaceCfg := wgtypes.Config{
-			PrivateKey:   &iface.PrivateKey,
-			ListenPort:   &iface.ListenPort,
-			FirewallMark: &iface.FirewallMark,
-			ReplacePeers: false,
-			Peers:        peers,
-		}
-		TraceLog.Printf("Updating configuration for %s:\n%+v\n", iface.Name, Jsonify(newNetworkIfaceCfg))
-
-		err = d.wgc.ConfigureDevice(iface.Name, newNetworkIfaceCfg)
-		if err != nil {
+		d.updateMeshPeers(l.Logger, meshPeers, c.MeshPeerConfig(), true)
+	}
+	if c.network.mesh == MeshGlobal && c.netns != "" {
+		if err := d.unpublishMeshPeer(c); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	c.netns = ""
+	c.listenPort = 0
+	if err := d.s.UpdateClientJoin(c); err != nil {
+		return err
+	}
+	return d.persistPeers(l.Logger, c.network)
+}
+
+// updateNetworkPeer adds peer to the WireGuard peer of n through its
+// provisioner, or removes it if peer.Remove is set.
+func (d *Driver) updateNetworkPeer(l *slog.Logger, n *Network, peer wgtypes.PeerConfig) error {
+	p, err := d.provisionerFor(l, n)
+	if err != nil {
+		return err
+	}
+	if peer.Remove {
+		return p.Unregister(peer)
+	}
+	return p.Register(peer)
 }
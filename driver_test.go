@@ -1,15 +1,30 @@
 package dwgd
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/google/go-cmp/cmp"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+func ConfigFixture() *Config {
+	cfg := NewConfig()
+	cfg.Db = DbPathFixture()
+	cfg.Backend = BackendKernel
+	return cfg
+}
+
 func DeviceFixture() *wgtypes.Device {
 	network := NetworkFixture()
 	return &wgtypes.Device{
@@ -20,15 +35,17 @@ func DeviceFixture() *wgtypes.Device {
 }
 
 type testCommander struct {
-	ChmodFunc    func(name string, mode fs.FileMode) error
-	MkdirAllFunc func(path string, perm fs.FileMode) error
-	ReadDirFunc  func(name string) ([]fs.DirEntry, error)
-	ReadFileFunc func(name string) ([]byte, error)
-	RemoveFunc   func(name string) error
-	SymlinkFunc  func(oldname string, newname string) error
-	LookPathFunc func(file string) (string, error)
-	RunFunc      func(name string, arg ...string) error
-	RunHistory   [][]string
+	ChmodFunc     func(name string, mode fs.FileMode) error
+	MkdirAllFunc  func(path string, perm fs.FileMode) error
+	ReadDirFunc   func(name string) ([]fs.DirEntry, error)
+	ReadFileFunc  func(name string) ([]byte, error)
+	RemoveFunc    func(name string) error
+	StatFunc      func(name string) (fs.FileInfo, error)
+	SymlinkFunc   func(oldname string, newname string) error
+	WriteFileFunc func(name string, data []byte, perm fs.FileMode) error
+	LookPathFunc  func(file string) (string, error)
+	RunFunc       func(name string, arg ...string) error
+	RunHistory    [][]string
 }
 
 func (t *testCommander) Chmod(name string, mode fs.FileMode) error {
@@ -51,10 +68,18 @@ func (t *testCommander) Remove(name string) error {
 	return t.RemoveFunc(name)
 }
 
+func (t *testCommander) Stat(name string) (fs.FileInfo, error) {
+	return t.StatFunc(name)
+}
+
 func (t *testCommander) Symlink(oldname string, newname string) error {
 	return t.SymlinkFunc(oldname, newname)
 }
 
+func (t *testCommander) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return t.WriteFileFunc(name, data, perm)
+}
+
 func (t *testCommander) LookPath(file string) (string, error) {
 	return t.LookPathFunc(file)
 }
@@ -80,9 +105,15 @@ func CommanderFixture() *testCommander {
 	t.RemoveFunc = func(name string) error {
 		return nil
 	}
+	t.StatFunc = func(name string) (fs.FileInfo, error) {
+		return nil, nil
+	}
 	t.SymlinkFunc = func(oldname, newname string) error {
 		return nil
 	}
+	t.WriteFileFunc = func(name string, data []byte, perm fs.FileMode) error {
+		return nil
+	}
 	t.LookPathFunc = func(file string) (string, error) {
 		return file, nil
 	}
@@ -100,7 +131,7 @@ func CommanderFixture() *testCommander {
 type testWgController struct {
 	ConfigureDeviceFunc func(name string, cfg wgtypes.Config) error
 	DeviceFunc          func(name string) (*wgtypes.Device, error)
-	Devices             map[string]*wgtypes.Device
+	DevicesFunc         func() ([]*wgtypes.Device, error)
 }
 
 // ConfigureDevice implements wgController.
@@ -113,10 +144,13 @@ func (t *testWgController) Device(name string) (*wgtypes.Device, error) {
 	return t.DeviceFunc(name)
 }
 
+// Devices implements wgController.
+func (t *testWgController) Devices() ([]*wgtypes.Device, error) {
+	return t.DevicesFunc()
+}
+
 func WgControllerFixture() *testWgController {
-	wgc := &testWgController{
-		Devices: make(map[string]*wgtypes.Device),
-	}
+	wgc := &testWgController{}
 
 	wgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
 		return nil
@@ -124,15 +158,18 @@ func WgControllerFixture() *testWgController {
 	wgc.DeviceFunc = func(name string) (*wgtypes.Device, error) {
 		df := DeviceFixture()
 		if name != df.Name {
-			return nil, fmt.Errorf("device %s does not exist", name)
+			return nil, fmt.Errorf("device %s: %w", name, os.ErrNotExist)
 		}
 		return df, nil
 	}
+	wgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+		return []*wgtypes.Device{DeviceFixture()}, nil
+	}
 	return wgc
 }
 
 func TestDriver(t *testing.T) {
-	d, err := NewDriver(DbPathFixture(), CommanderFixture(), WgControllerFixture())
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -204,7 +241,7 @@ func MustCreateEndpoint(t *testing.T, d *Driver) *Client {
 
 func TestDriver_CreateNetwork(t *testing.T) {
 	t.Run("ifname mode", func(t *testing.T) {
-		d, err := NewDriver(DbPathFixture(), CommanderFixture(), WgControllerFixture())
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -213,7 +250,7 @@ func TestDriver_CreateNetwork(t *testing.T) {
 	})
 
 	t.Run("pubkey mode", func(t *testing.T) {
-		d, err := NewDriver(DbPathFixture(), CommanderFixture(), WgControllerFixture())
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -224,7 +261,7 @@ func TestDriver_CreateNetwork(t *testing.T) {
 
 func TestDriver_DeleteNetwork(t *testing.T) {
 	t.Run("ifname mode", func(t *testing.T) {
-		d, err := NewDriver(DbPathFixture(), CommanderFixture(), WgControllerFixture())
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -249,7 +286,7 @@ func TestDriver_DeleteNetwork(t *testing.T) {
 	})
 
 	t.Run("pubkey mode", func(t *testing.T) {
-		d, err := NewDriver(DbPathFixture(), CommanderFixture(), WgControllerFixture())
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -275,7 +312,7 @@ func TestDriver_DeleteNetwork(t *testing.T) {
 }
 
 func TestDriver_CreateEndpoint(t *testing.T) {
-	d, err := NewDriver(DbPathFixture(), CommanderFixture(), WgControllerFixture())
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -285,7 +322,7 @@ func TestDriver_CreateEndpoint(t *testing.T) {
 }
 
 func TestDriver_DeleteEndpoint(t *testing.T) {
-	d, err := NewDriver(DbPathFixture(), CommanderFixture(), WgControllerFixture())
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -310,10 +347,47 @@ func TestDriver_DeleteEndpoint(t *testing.T) {
 	}
 }
 
+// mockRootlessNamespaces gives every process its own user namespace and
+// makes the network namespaces at the keys of owners owned by the user
+// namespace of the PIDs they map to.
+func mockRootlessNamespaces(t *testing.T, owners map[string]int) {
+	origUserNamespaceOf, origNetnsOwnerOf := userNamespaceOf, netnsOwnerOf
+	t.Cleanup(func() {
+		userNamespaceOf, netnsOwnerOf = origUserNamespaceOf, origNetnsOwnerOf
+	})
+
+	userNamespaceOf = func(pid int) (nsID, error) {
+		return nsID{ino: uint64(pid)}, nil
+	}
+	netnsOwnerOf = func(name string) (nsID, error) {
+		pid, ok := owners[name]
+		if !ok {
+			return nsID{}, fs.ErrNotExist
+		}
+		return nsID{ino: uint64(pid)}, nil
+	}
+}
+
+// mockListenPorts makes wgc report a distinct listen port for each client
+// interface, as if WireGuard had bound one when it went up.
+func mockListenPorts(wgc *testWgController) {
+	ports := make(map[string]int)
+	deviceFunc := wgc.DeviceFunc
+	wgc.DeviceFunc = func(name string) (*wgtypes.Device, error) {
+		if !strings.HasPrefix(name, "wg-") {
+			return deviceFunc(name)
+		}
+		if _, ok := ports[name]; !ok {
+			ports[name] = 52000 + len(ports)
+		}
+		return &wgtypes.Device{Name: name, ListenPort: ports[name]}, nil
+	}
+}
+
 func TestDriver_Join(t *testing.T) {
 	t.Run("non rootless", func(t *testing.T) {
 		tc := CommanderFixture()
-		d, err := NewDriver(DbPathFixture(), tc, WgControllerFixture())
+		d, err := NewDriver(ConfigFixture(), tc, WgControllerFixture())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -341,8 +415,9 @@ func TestDriver_Join(t *testing.T) {
 	t.Run("rootless", func(t *testing.T) {
 		tc := CommanderFixture()
 		tc.ReadFileFunc = func(name string) ([]byte, error) { return []byte("1000"), nil }
+		mockRootlessNamespaces(t, map[string]int{"/proc/1000/root/run/user/1000": 1000})
 
-		d, err := NewDriver(DbPathFixture(), tc, WgControllerFixture())
+		d, err := NewDriver(ConfigFixture(), tc, WgControllerFixture())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -367,13 +442,149 @@ func TestDriver_Join(t *testing.T) {
 			t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
 		}
 	})
+
+	t.Run("rootless custom runtime root", func(t *testing.T) {
+		tc := CommanderFixture()
+		tc.ReadFileFunc = func(name string) ([]byte, error) {
+			switch name {
+			case "/srv/runtime/alice/dockerd-rootless/child_pid":
+				return []byte("4242\n"), nil
+			case "/srv/runtime/alice/docker.pid":
+				return []byte("4343\n"), nil
+			}
+			return nil, fs.ErrNotExist
+		}
+		sandboxKey := "/srv/runtime/alice/docker/netns/0123456789ab"
+		mockRootlessNamespaces(t, map[string]int{"/proc/4242/root" + sandboxKey: 4242})
+
+		cfg := ConfigFixture()
+		cfg.RootlessRuntimeRoots = []string{"/run/user", "/srv/runtime"}
+		d, err := NewDriver(cfg, tc, WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		net := MustCreateNetwork(t, d, true)
+		client := MustCreateEndpoint(t, d)
+
+		_, err = d.Join(&network.JoinRequest{
+			NetworkID:  net.id,
+			EndpointID: client.id,
+			SandboxKey: sandboxKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedHistory := [][]string{
+			{"ip", "link", "add", "name", client.ifname, "type", "wireguard"},
+			{"ip", "link", "set", client.ifname, "netns", "4242"},
+		}
+		if !cmp.Equal(tc.RunHistory, expectedHistory) {
+			t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+		}
+	})
+
+	t.Run("rootless sandbox outside runtime roots", func(t *testing.T) {
+		// The sandbox key of the daemon of alice doesn't live in her
+		// runtime dir, the daemon is found through the owner of the
+		// network namespace.
+		root := t.TempDir()
+		if err := os.Mkdir(filepath.Join(root, "alice"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		tc := CommanderFixture()
+		tc.ReadDirFunc = os.ReadDir
+		tc.ReadFileFunc = func(name string) ([]byte, error) {
+			if name == filepath.Join(root, "alice", "dockerd-rootless", "child_pid") {
+				return []byte("4242\n"), nil
+			}
+			return nil, fs.ErrNotExist
+		}
+		sandboxKey := "/var/lib/alice/netns/0123456789ab"
+		mockRootlessNamespaces(t, map[string]int{"/proc/4242/root" + sandboxKey: 4242})
+
+		cfg := ConfigFixture()
+		cfg.RootlessRuntimeRoots = []string{root}
+		d, err := NewDriver(cfg, tc, WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		net := MustCreateNetwork(t, d, true)
+		client := MustCreateEndpoint(t, d)
+
+		_, err = d.Join(&network.JoinRequest{
+			NetworkID:  net.id,
+			EndpointID: client.id,
+			SandboxKey: sandboxKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedHistory := [][]string{
+			{"ip", "link", "add", "name", client.ifname, "type", "wireguard"},
+			{"ip", "link", "set", client.ifname, "netns", "4242"},
+		}
+		if !cmp.Equal(tc.RunHistory, expectedHistory) {
+			t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+		}
+	})
+
+	t.Run("rootless sandbox not in namespace", func(t *testing.T) {
+		tc := CommanderFixture()
+		tc.ReadFileFunc = func(name string) ([]byte, error) { return []byte("1000"), nil }
+		mockRootlessNamespaces(t, map[string]int{})
+
+		d, err := NewDriver(ConfigFixture(), tc, WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		net := MustCreateNetwork(t, d, true)
+		client := MustCreateEndpoint(t, d)
+
+		_, err = d.Join(&network.JoinRequest{
+			NetworkID:  net.id,
+			EndpointID: client.id,
+			SandboxKey: "/run/user/1000/docker/netns/0123456789ab",
+		})
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("expected %s, got %s", fs.ErrNotExist, err)
+		}
+	})
+
+	t.Run("rootless sandbox of another daemon", func(t *testing.T) {
+		tc := CommanderFixture()
+		tc.ReadFileFunc = func(name string) ([]byte, error) { return []byte("1000"), nil }
+		sandboxKey := "/run/user/1000/docker/netns/0123456789ab"
+		mockRootlessNamespaces(t, map[string]int{"/proc/1000/root" + sandboxKey: 2000})
+
+		d, err := NewDriver(ConfigFixture(), tc, WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		net := MustCreateNetwork(t, d, true)
+		client := MustCreateEndpoint(t, d)
+
+		_, err = d.Join(&network.JoinRequest{
+			NetworkID:  net.id,
+			EndpointID: client.id,
+			SandboxKey: sandboxKey,
+		})
+		if err == nil || !strings.Contains(err.Error(), "not owned by the rootless daemon with PID 1000") {
+			t.Fatalf("expected an ownership error, got %v", err)
+		}
+	})
 }
 
 func TestDriver_Leave(t *testing.T) {
 	tc := CommanderFixture()
 	wgc := WgControllerFixture()
 
-	d, err := NewDriver(DbPathFixture(), tc, wgc)
+	d, err := NewDriver(ConfigFixture(), tc, wgc)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -405,3 +616,838 @@ func TestDriver_Leave(t *testing.T) {
 		t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
 	}
 }
+
+func TestDriver_Tenant(t *testing.T) {
+	tc := CommanderFixture()
+	tc.ReadFileFunc = func(name string) ([]byte, error) { return []byte("4242"), nil }
+	d, err := NewDriver(ConfigFixture(), tc, WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	alice := d.ForTenant(tenant{uid: 1000})
+	bob := d.ForTenant(tenant{uid: 1001})
+
+	n := NetworkFixture()
+	c := ClientFixture(n)
+	err = alice.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.seed":     string(n.seed),
+				"dwgd.pubkey":   n.pubkey.String(),
+				"dwgd.endpoint": n.endpoint.String(),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createEndpointReq := &network.CreateEndpointRequest{
+		NetworkID:  n.id,
+		EndpointID: c.id,
+		Interface: &network.EndpointInterface{
+			Address: fmt.Sprintf("%s/32", c.ip.String()),
+		},
+	}
+	if _, err := bob.CreateEndpoint(createEndpointReq); err == nil {
+		t.Fatal("expected bob to be rejected on alice's network")
+	}
+	if _, err := alice.CreateEndpoint(createEndpointReq); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := d.s.GetClient(c.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.owner != 1000 || other.network.owner != 1000 {
+		t.Fatalf("mismatch: owners %d, %d != 1000", other.owner, other.network.owner)
+	}
+
+	joinReq := &network.JoinRequest{
+		NetworkID:  n.id,
+		EndpointID: c.id,
+		SandboxKey: "/foo/bar",
+	}
+	if _, err := bob.Join(joinReq); err == nil {
+		t.Fatal("expected bob to be rejected on alice's endpoint")
+	}
+	if err := bob.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: n.id}); err == nil {
+		t.Fatal("expected bob to be rejected on alice's network")
+	}
+
+	// tenants can only join the sandboxes of their own rootless daemon
+	sandboxKey := "/run/user/1000/docker/netns/0123456789ab"
+	mockRootlessNamespaces(t, map[string]int{"/proc/4242/root" + sandboxKey: 4242})
+	defer func(orig func(int) (uint32, error)) { userNamespaceOwnerOf = orig }(userNamespaceOwnerOf)
+	daemonUid := uint32(1001)
+	userNamespaceOwnerOf = func(pid int) (uint32, error) {
+		if pid != 4242 {
+			t.Fatalf("unexpected PID %d", pid)
+		}
+		return daemonUid, nil
+	}
+	if _, err := alice.Join(joinReq); err == nil || !strings.Contains(err.Error(), "doesn't belong to a rootless daemon") {
+		t.Fatalf("expected alice to be rejected on the sandbox of the rootful daemon, got %v", err)
+	}
+	rootlessJoinReq := &network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: sandboxKey}
+	if _, err := alice.Join(rootlessJoinReq); err == nil || !strings.Contains(err.Error(), "UID 1001") {
+		t.Fatalf("expected alice to be rejected on the sandbox of bob, got %v", err)
+	}
+	daemonUid = 1000
+	if _, err := alice.Join(rootlessJoinReq); err != nil {
+		t.Fatal(err)
+	}
+
+	// root can operate on every tenant's networks
+	if _, err := d.ForTenant(rootTenant).Join(joinReq); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDriver_TenantHostOptions(t *testing.T) {
+	n := NetworkFixture()
+	profile := "seed = \"" + string(n.seed) + "\"\nifname = \"" + n.ifname + "\"\n"
+	tc := CommanderFixture()
+	tc.ReadFileFunc = func(name string) ([]byte, error) {
+		if name == "/etc/dwgd/profiles/wg0.toml" {
+			return []byte(profile), nil
+		}
+		return nil, fs.ErrNotExist
+	}
+	cfg := ConfigFixture()
+	cfg.ProfilesDir = "/etc/dwgd/profiles"
+	d, err := NewDriver(cfg, tc, WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	alice := d.ForTenant(tenant{uid: 1000})
+	create := func(drv network.Driver, id string, options map[string]interface{}) error {
+		m := map[string]interface{}{
+			"dwgd.seed":     string(n.seed),
+			"dwgd.pubkey":   n.pubkey.String(),
+			"dwgd.endpoint": n.endpoint.String(),
+		}
+		for k, v := range options {
+			m[k] = v
+		}
+		return drv.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{"com.docker.network.generic": m},
+		})
+	}
+
+	for _, option := range []map[string]interface{}{
+		{"dwgd.ifname": "wg0"},
+		{"dwgd.ifname": "wg0", "dwgd.ifname_netns": "/proc/1/ns/net"},
+		{"dwgd.persist": PersistWgQuick},
+		{"dwgd.persist_path": "/etc/shadow"},
+		{"dwgd.provisioner": ProvisionerFile, "dwgd.provisioner_path": "/etc/shadow"},
+		{"dwgd.provisioner": ProvisionerWebhook, "dwgd.webhook_url": "http://169.254.169.254/"},
+		{"dwgd.agent": "https://agent.example.com:7777"},
+		{"dwgd.keymode": KeyModeKeydir, "dwgd.keydir": "/root/keys"},
+		{"dwgd.conf": "/etc/wireguard/wg0.conf"},
+	} {
+		err := create(alice, "n1", option)
+		if err == nil || !strings.Contains(err.Error(), "can't be passed by UID 1000") {
+			t.Fatalf("%v: expected the option to be rejected, got %v", option, err)
+		}
+	}
+
+	// root can pass them, and tenants can get them from profiles
+	if err := create(d.ForTenant(rootTenant), "n1", map[string]interface{}{"dwgd.ifname": n.ifname}); err != nil {
+		t.Fatal(err)
+	}
+	if err := create(alice, "n2", map[string]interface{}{"dwgd.profile": "wg0"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTenantOf(t *testing.T) {
+	sockPath := t.TempDir() + "/dwgd.sock"
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("unix", sockPath)
+		if err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tn, err := tenantOf(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tn.uid != uint32(os.Getuid()) {
+		t.Fatalf("mismatch: %d != %d", tn.uid, os.Getuid())
+	}
+}
+
+func TestTenantOf_HandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { tlsHandshakeTimeout = timeout }(tlsHandshakeTimeout)
+	tlsHandshakeTimeout = 50 * time.Millisecond
+
+	// the client connects and never sends its hello
+	server, client := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tenantOf(tls.Server(server, &tls.Config{}))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected a handshake error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake didn't time out")
+	}
+}
+
+func TestDriver_CreateServer(t *testing.T) {
+	// devices keeps track of the interfaces created through the commander
+	// and configured through the WireGuard controller.
+	devices := make(map[string]*wgtypes.Device)
+	tc := CommanderFixture()
+	tc.RunFunc = func(name string, arg ...string) error {
+		tc.RunHistory = append(tc.RunHistory, append([]string{name}, arg...))
+		if len(arg) == 6 && arg[0] == "link" && arg[1] == "add" {
+			devices[arg[3]] = &wgtypes.Device{Name: arg[3]}
+		}
+		if len(arg) == 3 && arg[0] == "link" && arg[1] == "delete" {
+			delete(devices, arg[2])
+		}
+		return nil
+	}
+	var serverPeers []wgtypes.PeerConfig
+	wgc := WgControllerFixture()
+	wgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+		dev, ok := devices[name]
+		if !ok {
+			return fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+		}
+		if name == "dwgd0" {
+			serverPeers = append(serverPeers, cfg.Peers...)
+		}
+		if cfg.PrivateKey != nil {
+			dev.PrivateKey = *cfg.PrivateKey
+			dev.PublicKey = cfg.PrivateKey.PublicKey()
+		}
+		if cfg.ListenPort != nil {
+			dev.ListenPort = *cfg.ListenPort
+		} else if dev.ListenPort == 0 {
+			dev.ListenPort = 51999
+		}
+		return nil
+	}
+	wgc.DeviceFunc = func(name string) (*wgtypes.Device, error) {
+		dev, ok := devices[name]
+		if !ok {
+			return nil, fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+		}
+		return dev, nil
+	}
+
+	cfg := ConfigFixture()
+	d, err := NewDriver(cfg, tc, wgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "n1",
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.ifname":        "dwgd0",
+				"dwgd.create_server": "true",
+				"dwgd.seed":          "supersecretseed",
+			},
+		},
+		IPv4Data: []*network.IPAMData{{Pool: "10.0.0.0/24", Gateway: "10.0.0.1/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.s.GetNetwork("n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.createServer || n.privkey == nil || n.listenPort != 51999 || n.address != "10.0.0.1/24" {
+		t.Fatalf("unexpected server configuration: %#v", n)
+	}
+	if n.pubkey != n.privkey.PublicKey() || n.endpoint.Port != 51999 {
+		t.Fatalf("unexpected peer configuration: %#v", n)
+	}
+
+	expectedHistory := [][]string{
+		{"ip", "link", "add", "name", "dwgd0", "type", "wireguard"},
+		{"ip", "address", "add", "10.0.0.1/24", "dev", "dwgd0"},
+		{"ip", "link", "set", "up", "dev", "dwgd0"},
+	}
+	if !cmp.Equal(tc.RunHistory, expectedHistory) {
+		t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+	}
+
+	// only the endpoints joined to a sandbox have a peer
+	for _, id := range []string{"c1", "c2"} {
+		_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  "n1",
+			EndpointID: id,
+			Interface:  &network.EndpointInterface{Address: "10.0.0." + id[1:] + "1/24"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Join(&network.JoinRequest{NetworkID: "n1", EndpointID: "c1", SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+	joined, err := d.s.GetClient("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a reboot: the interface is gone and gets recreated with
+	// the same key and port when the driver starts
+	delete(devices, "dwgd0")
+	tc.RunHistory = nil
+	serverPeers = nil
+	restarted, err := NewDriver(cfg, tc, wgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	dev, ok := devices["dwgd0"]
+	if !ok {
+		t.Fatal("server interface not restored")
+	}
+	if dev.PrivateKey != *n.privkey || dev.ListenPort != 51999 {
+		t.Fatalf("unexpected restored interface: %#v", dev)
+	}
+	if expected := []wgtypes.PeerConfig{joined.PeerConfig()}; !cmp.Equal(serverPeers, expected) {
+		t.Fatalf("mismatch: %#v != %#v", serverPeers, expected)
+	}
+
+	tc.RunHistory = nil
+	err = d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHistory = [][]string{
+		{"ip", "link", "delete", "dwgd0"},
+	}
+	if !cmp.Equal(tc.RunHistory, expectedHistory) {
+		t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+	}
+}
+
+// recordingBackend is a linkBackend keeping track of the interfaces it's
+// asked to delete.
+type recordingBackend struct {
+	deleted [][]string
+}
+
+func (b *recordingBackend) Add(name string) error {
+	return nil
+}
+
+func (b *recordingBackend) Delete(netns string, name string) error {
+	b.deleted = append(b.deleted, []string{netns, name})
+	return nil
+}
+
+func TestDriver_CreateServerMoveFailure(t *testing.T) {
+	tc := CommanderFixture()
+	tc.RunFunc = func(name string, arg ...string) error {
+		if len(arg) > 3 && arg[3] == "netns" {
+			return fmt.Errorf("no such namespace")
+		}
+		return nil
+	}
+	d, err := NewDriver(ConfigFixture(), tc, WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	links := &recordingBackend{}
+	d.links = links
+
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "n1",
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.ifname":        "dwgd0",
+				"dwgd.ifname_netns":  "/run/netns/vpn",
+				"dwgd.create_server": "true",
+				"dwgd.seed":          "supersecretseed",
+			},
+		},
+		IPv4Data: []*network.IPAMData{{Pool: "10.0.0.0/24", Gateway: "10.0.0.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// the interface left in dwgd's namespace is deleted through the backend
+	// that created it
+	if expected := [][]string{{"", "dwgd0"}}; !cmp.Equal(links.deleted, expected) {
+		t.Fatalf("mismatch: %#v != %#v", links.deleted, expected)
+	}
+}
+
+func TestDriver_IfnameNetns(t *testing.T) {
+	hostWgc := WgControllerFixture()
+	hostWgc.DeviceFunc = func(name string) (*wgtypes.Device, error) {
+		return nil, fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+	}
+	vpnWgc := WgControllerFixture()
+	configured := make([]string, 0)
+	vpnWgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+		configured = append(configured, name)
+		return nil
+	}
+
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), hostWgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.netnsWgc = func(path string) wgController {
+		if path != "/run/netns/vpn" {
+			t.Fatalf("unexpected namespace %s", path)
+		}
+		return vpnWgc
+	}
+
+	n := NetworkFixture()
+	n.ifnameNetns = "/run/netns/vpn"
+	c := ClientFixture(n)
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.seed":         string(n.seed),
+				"dwgd.route":        n.route,
+				"dwgd.ifname":       n.ifname,
+				"dwgd.ifname_netns": n.ifnameNetns,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := d.s.GetNetwork(n.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(n, other, cmp.AllowUnexported(Network{})) {
+		t.Fatalf("mismatch: %#v != %#v", n, other)
+	}
+
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  n.id,
+		EndpointID: c.id,
+		Interface: &network.EndpointInterface{
+			Address: fmt.Sprintf("%s/32", c.ip.String()),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinReq := &network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}
+	if _, err := d.Join(joinReq); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: c.id}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{n.ifname, n.ifname}
+	if !cmp.Equal(configured, expected) {
+		t.Fatalf("mismatch: %#v != %#v", configured, expected)
+	}
+}
+
+func TestNamedNetnsPath(t *testing.T) {
+	for _, name := range []string{"vpn", "/run/netns/vpn"} {
+		path, err := namedNetnsPath(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if path != "/run/netns/vpn" {
+			t.Fatalf("%s: expected /run/netns/vpn, got %s", name, path)
+		}
+	}
+
+	for _, name := range []string{"", "/proc/1/ns/net", "/run/netns/../../proc/1/ns/net", "../vpn", "/run/netns/", "vpn/ns"} {
+		if _, err := namedNetnsPath(name); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+}
+
+func TestDriver_Mesh(t *testing.T) {
+	// sandboxes keeps track of the client interfaces moved to each sandbox,
+	// while configs records the configurations applied to them.
+	sandboxes := make(map[string]*wgtypes.Device)
+	configs := make(map[string][]wgtypes.Config)
+	wgc := WgControllerFixture()
+	wgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+		configs[name] = append(configs[name], cfg)
+		return nil
+	}
+	mockListenPorts(wgc)
+
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), wgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.netnsWgc = func(path string) wgController {
+		sandboxWgc := WgControllerFixture()
+		sandboxWgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+			dev, ok := sandboxes[path]
+			if !ok {
+				return nil, nil
+			}
+			return []*wgtypes.Device{dev}, nil
+		}
+		sandboxWgc.ConfigureDeviceFunc = wgc.ConfigureDeviceFunc
+		return sandboxWgc
+	}
+
+	n := NetworkFixture()
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.seed":     string(n.seed),
+				"dwgd.endpoint": n.endpoint.String(),
+				"dwgd.pubkey":   n.pubkey.String(),
+				"dwgd.mesh":     "local",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := map[string]net.IP{"c1": {10, 0, 0, 2}, "c2": {10, 0, 0, 3}}
+	ports := map[string]int{"c1": 52000, "c2": 52001}
+	join := func(id string) *Client {
+		_, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  n.id,
+			EndpointID: id,
+			Interface:  &network.EndpointInterface{Address: ips[id].String() + "/32"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sandboxKey := "/var/run/docker/netns/" + id
+		if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: id, SandboxKey: sandboxKey}); err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.s.GetClient(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.netns != sandboxKey || c.listenPort != ports[id] {
+			t.Fatalf("unexpected joined client: %#v", c)
+		}
+		sandboxes[sandboxKey] = &wgtypes.Device{
+			Name:      "wg0",
+			PublicKey: GeneratePrivateKey(n.seed, c.ip).PublicKey(),
+		}
+		return c
+	}
+
+	c1 := join("c1")
+	c2 := join("c2")
+
+	// c2 gets c1 as a direct peer, besides the network peer
+	cfg := configs[c2.ifname][0]
+	// the port bound by the interface is kept, instead of one being set
+	if len(cfg.Peers) != 2 || cfg.ListenPort != nil {
+		t.Fatalf("unexpected configuration of %s: %#v", c2.ifname, cfg)
+	}
+	if !cmp.Equal(cfg.Peers[1], c1.MeshPeerConfig()) {
+		t.Fatalf("mismatch: %#v != %#v", cfg.Peers[1], c1.MeshPeerConfig())
+	}
+	if cfg.Peers[1].Endpoint.String() != fmt.Sprintf("127.0.0.1:%d", c1.listenPort) {
+		t.Fatalf("unexpected mesh endpoint: %s", cfg.Peers[1].Endpoint)
+	}
+
+	// c1, already in its sandbox as wg0, gets c2
+	expected := []wgtypes.Config{{Peers: []wgtypes.PeerConfig{c2.MeshPeerConfig()}}}
+	if !cmp.Equal(configs["wg0"], expected) {
+		t.Fatalf("mismatch: %#v != %#v", configs["wg0"], expected)
+	}
+
+	configs["wg0"] = nil
+	if err := d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: c2.id}); err != nil {
+		t.Fatal(err)
+	}
+	removed := c2.MeshPeerConfig()
+	removed.Remove = true
+	expected = []wgtypes.Config{{Peers: []wgtypes.PeerConfig{removed}}}
+	if !cmp.Equal(configs["wg0"], expected) {
+		t.Fatalf("mismatch: %#v != %#v", configs["wg0"], expected)
+	}
+
+	left, err := d.s.GetClient(c2.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left.netns != "" || left.listenPort != 0 {
+		t.Fatalf("unexpected client after leave: %#v", left)
+	}
+}
+
+func TestDriver_GlobalMesh(t *testing.T) {
+	store := newMemoryStore()
+	n := NetworkFixture()
+
+	// host sets up a driver with a single sandbox, whose interface records
+	// the configurations applied to it.
+	type host struct {
+		d       *Driver
+		sandbox *wgtypes.Device
+		configs []wgtypes.Config
+	}
+	newHost := func(addr string) *host {
+		h := &host{}
+		wgc := WgControllerFixture()
+		wgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+			h.configs = append(h.configs, cfg)
+			return nil
+		}
+		wgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+			return []*wgtypes.Device{h.sandbox}, nil
+		}
+		mockListenPorts(wgc)
+
+		cfg := ConfigFixture()
+		cfg.Scope = network.GlobalScope
+		cfg.AdvertiseAddr = addr
+		d, err := NewDriver(cfg, CommanderFixture(), wgc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.store = store
+		d.netnsWgc = func(path string) wgController { return wgc }
+
+		err = d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options: map[string]interface{}{
+				"com.docker.network.generic": map[string]interface{}{
+					"dwgd.seed":     string(n.seed),
+					"dwgd.endpoint": n.endpoint.String(),
+					"dwgd.pubkey":   n.pubkey.String(),
+					"dwgd.mesh":     "global",
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.d = d
+		return h
+	}
+	join := func(h *host, id string, ip string) *Client {
+		_, err := h.d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  n.id,
+			EndpointID: id,
+			Interface:  &network.EndpointInterface{Address: ip + "/32"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = h.d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: id, SandboxKey: "/var/run/docker/netns/" + id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := h.d.s.GetClient(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.sandbox = &wgtypes.Device{Name: "wg0", PublicKey: GeneratePrivateKey(n.seed, c.ip).PublicKey()}
+		return c
+	}
+
+	a := newHost("192.0.2.1")
+	defer a.d.Close()
+	b := newHost("192.0.2.2")
+	defer b.d.Close()
+
+	caps, err := a.d.GetCapabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Scope != network.GlobalScope || caps.ConnectivityScope != network.GlobalScope {
+		t.Fatalf("unexpected capabilities: %#v", caps)
+	}
+
+	c1 := join(a, "c1", "10.0.0.2")
+	c2 := join(b, "c2", "10.0.0.3")
+
+	// c2 learns c1 from the store when joining
+	c1Peer := c1.MeshPeerConfig()
+	c1Peer.Endpoint = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: c1.listenPort}
+	peers := b.configs[0].Peers
+	if len(peers) != 2 || !cmp.Equal(peers[1], c1Peer) {
+		t.Fatalf("unexpected peers of c2: %#v", peers)
+	}
+
+	// c1 learns c2 on the next sync
+	c2Peer := c2.MeshPeerConfig()
+	c2Peer.Endpoint = &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: c2.listenPort}
+	a.configs = nil
+	if err := a.d.SyncGlobalMesh(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []wgtypes.Config{{Peers: []wgtypes.PeerConfig{c2Peer}}}
+	if !cmp.Equal(a.configs, expected) {
+		t.Fatalf("mismatch: %#v != %#v", a.configs, expected)
+	}
+
+	// once c2 leaves, c1 drops it
+	if err := b.d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: c2.id}); err != nil {
+		t.Fatal(err)
+	}
+	a.sandbox.Peers = []wgtypes.Peer{{PublicKey: n.pubkey}, {PublicKey: c2Peer.PublicKey}}
+	a.configs = nil
+	if err := a.d.SyncGlobalMesh(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []wgtypes.Config{{Peers: []wgtypes.PeerConfig{{PublicKey: c2Peer.PublicKey, Remove: true}}}}
+	if !cmp.Equal(a.configs, expected) {
+		t.Fatalf("mismatch: %#v != %#v", a.configs, expected)
+	}
+
+	// the records of local clients are refreshed on every sync
+	var record meshRecord
+	if err := json.Unmarshal(store.data[a.d.meshPrefix(n.id)+c1.id], &record); err != nil {
+		t.Fatal(err)
+	}
+	if expires := time.Unix(record.Expires, 0); expires.Before(time.Now().Add(a.d.meshTTL - time.Minute)) {
+		t.Fatalf("record of c1 not refreshed, expires at %s", expires)
+	}
+
+	// the records of a host that stopped refreshing them are ignored, and
+	// eventually deleted
+	crashed := func(id string, expires time.Time) {
+		value, err := json.Marshal(&meshRecord{
+			Host:      "192.0.2.3",
+			IP:        "10.0.0.4",
+			PublicKey: GeneratePrivateKey(n.seed, net.ParseIP("10.0.0.4")).PublicKey().String(),
+			Endpoint:  "192.0.2.3:51820",
+			Expires:   expires.Unix(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Put(a.d.meshPrefix(n.id)+id, value)
+	}
+	crashed("c3", time.Now().Add(-time.Second))
+	crashed("c4", time.Now().Add(-2*a.d.meshTTL))
+	a.sandbox.Peers = []wgtypes.Peer{{PublicKey: n.pubkey}}
+	a.configs = nil
+	if err := a.d.SyncGlobalMesh(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []wgtypes.Config{{}}
+	if !cmp.Equal(a.configs, expected) {
+		t.Fatalf("mismatch: %#v != %#v", a.configs, expected)
+	}
+	if _, ok := store.data[a.d.meshPrefix(n.id)+"c3"]; !ok {
+		t.Fatal("expected the recently expired record to be kept")
+	}
+	if _, ok := store.data[a.d.meshPrefix(n.id)+"c4"]; ok {
+		t.Fatal("expected the long expired record to be deleted")
+	}
+}
+
+func TestUserspaceBackend_DeleteMissing(t *testing.T) {
+	// the devices created before a restart of dwgd are gone
+	u := newUserspaceBackend()
+	if u.has("wg-0123456789a") {
+		t.Fatal("unexpected device")
+	}
+	if err := u.Delete("", "wg-0123456789a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewLinkBackend(t *testing.T) {
+	t.Run("kernel module available", func(t *testing.T) {
+		tc := CommanderFixture()
+		links, err := newLinkBackend(tc, BackendAuto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := links.(*kernelBackend); !ok {
+			t.Fatalf("expected kernel backend, got %T", links)
+		}
+
+		expectedHistory := [][]string{
+			{"ip", "link", "add", "name", backendProbeIfname, "type", "wireguard"},
+			{"ip", "link", "delete", backendProbeIfname},
+		}
+		if !cmp.Equal(tc.RunHistory, expectedHistory) {
+			t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+		}
+	})
+
+	t.Run("kernel module not available", func(t *testing.T) {
+		tc := CommanderFixture()
+		tc.RunFunc = func(name string, arg ...string) error {
+			return fmt.Errorf("Error: Unknown device type.")
+		}
+		links, err := newLinkBackend(tc, BackendAuto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := links.(*userspaceBackend); !ok {
+			t.Fatalf("expected userspace backend, got %T", links)
+		}
+	})
+
+	t.Run("probe failed", func(t *testing.T) {
+		// e.g. a leftover interface with the same name
+		tc := CommanderFixture()
+		tc.RunFunc = func(name string, arg ...string) error {
+			return fmt.Errorf("ip: exit status 2: RTNETLINK answers: File exists")
+		}
+		if _, err := newLinkBackend(tc, BackendAuto); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := newLinkBackend(CommanderFixture(), "foo"); err == nil {
+			t.Fatal("expected error for unknown backend")
+		}
+	})
+}
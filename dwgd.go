@@ -2,53 +2,103 @@ package dwgd
 
 import (
 	"net"
-
-	"github.com/docker/go-plugins-helpers/network"
+	"os"
+	"reflect"
+	"sync"
+	"time"
 )
 
 type Dwgd struct {
+	cfg       *Config // configuration dwgd has been started with
 	driver    *Driver
-	handler   *network.Handler
-	listener  net.Listener
+	listeners []net.Listener
 	symlinker *RootlessSymlinker
+	admin     *AdminServer   // nil if the admin API is disabled
+	metrics   *MetricsServer // nil if the metrics are disabled
+
+	meshSyncInterval time.Duration
+	healthInterval   time.Duration
+	stopCh           chan struct{}
+	stopOnce         sync.Once
 }
 
 func NewDwgd(cfg *Config) (*Dwgd, error) {
-	driver, err := NewDriver(cfg.Db, nil, nil)
-	if err != nil {
+	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
 
-	handler := network.NewHandler(driver)
+	if cfg.Instance != "" {
+		SetLogPrefix(cfg.PluginName())
+	}
+
+	driver, err := NewDriver(cfg, nil, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	listener, err := NewUnixListener(nil)
+	listeners := make([]net.Listener, 0)
+	listener, err := NewUnixListener(nil, cfg)
 	if err != nil {
 		return nil, err
 	}
+	listeners = append(listeners, listener)
+
+	if cfg.TCP.Addr != "" {
+		listener, err := NewTCPListener(nil, cfg)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
 
 	var symlinker *RootlessSymlinker
-	if cfg.Rootless {
-		symlinker, err = NewRootlessSymlinker(nil)
+	if cfg.Rootless && !cfg.PluginMode {
+		symlinker, err = NewRootlessSymlinker(nil, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var admin *AdminServer
+	if cfg.Admin {
+		admin, err = NewAdminServer(nil, cfg, driver, symlinker)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var metrics *MetricsServer
+	if cfg.MetricsAddr != "" {
+		metrics, err = NewMetricsServer(cfg, driver)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	return &Dwgd{
+		cfg:       cfg,
 		driver:    driver,
-		handler:   handler,
-		listener:  listener,
+		listeners: listeners,
 		symlinker: symlinker,
+		admin:     admin,
+		metrics:   metrics,
+
+		meshSyncInterval: cfg.MeshSyncInterval,
+		healthInterval:   cfg.HealthInterval,
+		stopCh:           make(chan struct{}),
 	}, nil
 }
 
 func (d *Dwgd) Start() error {
-	go func() {
-		err := d.handler.Serve(d.listener)
-		if err != nil {
-			TraceLog.Printf("Couldn't serve on unix socket: %s\n", err)
-		}
-	}()
+	for _, listener := range d.listeners {
+		listener := listener
+		go func() {
+			err := serveTenants(listener, d.driver)
+			if err != nil {
+				TraceLog.Printf("Couldn't serve on %s: %s\n", listener.Addr(), err)
+			}
+		}()
+	}
 
 	if d.symlinker != nil {
 		go func() {
@@ -59,20 +109,71 @@ func (d *Dwgd) Start() error {
 		}()
 	}
 
+	if d.admin != nil {
+		go func() {
+			err := d.admin.Start()
+			if err != nil {
+				TraceLog.Printf("Couldn't serve admin API on %s: %s\n", d.admin.Addr(), err)
+			}
+		}()
+	}
+
+	if d.metrics != nil {
+		go func() {
+			err := d.metrics.Start()
+			if err != nil {
+				TraceLog.Printf("Couldn't serve metrics on %s: %s\n", d.metrics.Addr(), err)
+			}
+		}()
+	}
+
+	if d.driver.store != nil {
+		go d.driver.runMeshSync(d.meshSyncInterval, d.stopCh)
+	}
+
+	if d.healthInterval > 0 {
+		go d.driver.runHealthMonitor(d.healthInterval, d.stopCh)
+	}
+
 	return nil
 }
 
+// Stop closes the servers and the driver. It can be called more than once,
+// e.g. by a signal handler racing with a failed start.
 func (d *Dwgd) Stop() error {
+	d.stopOnce.Do(d.stop)
+	return nil
+}
+
+func (d *Dwgd) stop() {
+	close(d.stopCh)
+
+	if d.admin != nil {
+		TraceLog.Printf("Closing admin API on %s\n", d.admin.Addr())
+		if err := d.admin.Stop(); err != nil {
+			TraceLog.Printf("Error during admin API close: %s\n", err)
+		}
+	}
+
+	if d.metrics != nil {
+		TraceLog.Printf("Closing metrics on %s\n", d.metrics.Addr())
+		if err := d.metrics.Stop(); err != nil {
+			TraceLog.Printf("Error during metrics close: %s\n", err)
+		}
+	}
+
 	TraceLog.Println("Closing driver")
 	err := d.driver.Close()
 	if err != nil {
 		TraceLog.Printf("Error during driver close: %s\n", err)
 	}
 
-	TraceLog.Println("Closing listener")
-	err = d.listener.Close()
-	if err != nil {
-		TraceLog.Printf("Error during listener close: %s\n", err)
+	for _, listener := range d.listeners {
+		TraceLog.Printf("Closing listener on %s\n", listener.Addr())
+		err = listener.Close()
+		if err != nil {
+			TraceLog.Printf("Error during listener close: %s\n", err)
+		}
 	}
 
 	if d.symlinker != nil {
@@ -84,6 +185,61 @@ func (d *Dwgd) Stop() error {
 	} else {
 		TraceLog.Println("Symlinker not set, skipping closing")
 	}
+}
+
+// Reload applies the settings of cfg that can change while dwgd is running:
+// the logging settings, the profiles directory, the default network options
+// and the allowlist of the plugin socket. Changes to the other settings are
+// reported and ignored until dwgd is restarted.
+func (d *Dwgd) Reload(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := ConfigureLogging(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	d.driver.Reload(cfg)
+	for _, listener := range d.listeners {
+		if u, ok := listener.(*UnixListener); ok {
+			u.SetAllowlist(cfg.PeerAllowlist)
+		}
+	}
 
+	for _, name := range restartRequired(d.cfg, cfg) {
+		DiagnosticsLog.Printf("Setting %s changed, restart dwgd to apply it\n", name)
+	}
 	return nil
 }
+
+// restartRequired returns the names of the settings that differ between
+// old and new and can't be reloaded.
+func restartRequired(old *Config, new *Config) []string {
+	settings := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"instance", old.Instance, new.Instance},
+		{"db", old.Db, new.Db},
+		{"backend", old.Backend, new.Backend},
+		{"rootless", old.Rootless, new.Rootless},
+		{"rootless runtime roots", old.RootlessRuntimeRoots, new.RootlessRuntimeRoots},
+		{"socket", []string{old.RunDir, old.PluginSockDir}, []string{new.RunDir, new.PluginSockDir}},
+		{"plugin mode", old.PluginMode, new.PluginMode},
+		{"admin", old.Admin, new.Admin},
+		{"metrics", old.MetricsAddr, new.MetricsAddr},
+		{"health interval", old.HealthInterval, new.HealthInterval},
+		{"tcp", old.TCP, new.TCP},
+		{"mesh", []interface{}{old.Scope, old.Store, old.AdvertiseAddr, old.MeshSyncInterval}, []interface{}{new.Scope, new.Store, new.AdvertiseAddr, new.MeshSyncInterval}},
+		{"store tls", old.StoreTLS, new.StoreTLS},
+		{"agent tls", old.AgentTLS, new.AgentTLS},
+	}
+
+	changed := make([]string, 0)
+	for _, s := range settings {
+		if !reflect.DeepEqual(s.old, s.new) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
@@ -4,11 +4,14 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -21,17 +24,87 @@ type Network struct {
 	pubkey   wgtypes.Key
 	route    string
 	ifname   string
+	owner    uint32 // UID of the tenant that created the network
+
+	// Network namespace the ifname interface lives in, dwgd's one if empty.
+	ifnameNetns string
+
+	// The following fields are set only if the server interface is managed
+	// by dwgd, i.e. the network has been created with dwgd.create_server.
+	createServer bool
+	privkey      *wgtypes.Key // private key of the server interface
+	listenPort   int          // listen port of the server interface
+	address      string       // address of the server interface, in CIDR notation
+
+	// Mesh mode of the network: with MeshLocal, clients on this host peer
+	// with each other directly.
+	mesh string
+
+	// URL of the agent managing the peer of a pubkey mode network, if any.
+	agent string
+
+	// How the peers of the ifname interface are persisted, if at all, and
+	// the wg-quick configuration file or networkd drop-in directory used.
+	persist     string
+	persistPath string
+
+	// Provisioner managing the peer, chosen from ifname and agent if empty,
+	// and the options it reads the network was created with, the secret
+	// ones apart from the others.
+	provisioner        string
+	provisionerOptions map[string]string
+	provisionerSecrets map[string]string
+
+	// How the private keys of the clients are obtained: derived from seed
+	// if empty, or taken from the files in keydir with KeyModeKeydir.
+	keymode string
+	keydir  string
+
+	// The following fields describe the peer further, they are set only if
+	// the network has been imported from a wg-quick configuration.
+	allowedIPs   []net.IPNet  // routed through the peer, 0.0.0.0/0 if empty
+	presharedKey *wgtypes.Key // preshared key of the peer, if any
+	keepalive    int          // keepalive interval in seconds, 25 if 0 and disabled if negative
+	mtu          int          // MTU of the client interfaces, the default one if 0
+
+	// Profile the network has been created with, if any, and its version.
+	profile        string
+	profileVersion string
+
+	// Seconds without handshakes after which the tunnel of a client is
+	// considered stale, defaultStaleAfter if 0 and not monitored if negative.
+	staleAfter int
+
+	// Seconds Join waits for the first handshake of a client, not at all if
+	// 0, and what it does if it doesn't happen, see WaitHandshakePolicy.
+	waitHandshake       int
+	waitHandshakePolicy string
+}
+
+// ID returns the ID docker assigned to the network.
+func (n *Network) ID() string {
+	return n.id
 }
 
 func (n *Network) PeerConfig() wgtypes.PeerConfig {
 	keepalive := 25 * time.Second
+	if n.keepalive != 0 {
+		keepalive = time.Duration(n.keepalive) * time.Second
+	}
+	if keepalive < 0 {
+		keepalive = 0
+	}
 
-	_, ipnet, _ := net.ParseCIDR("0.0.0.0/0")
-	allowedIPs := []net.IPNet{*ipnet}
+	allowedIPs := n.allowedIPs
+	if len(allowedIPs) == 0 {
+		_, ipnet, _ := net.ParseCIDR("0.0.0.0/0")
+		allowedIPs = []net.IPNet{*ipnet}
+	}
 
 	return wgtypes.PeerConfig{
 		Endpoint:                    n.endpoint,
 		PublicKey:                   n.pubkey,
+		PresharedKey:                n.presharedKey,
 		PersistentKeepaliveInterval: &keepalive,
 		AllowedIPs:                  allowedIPs,
 		ReplaceAllowedIPs:           true,
@@ -43,10 +116,27 @@ type Client struct {
 	ip      net.IP
 	ifname  string
 	network *Network
+	owner   uint32 // UID of the tenant that created the client
+
+	// The following fields are set while the client is joined to a sandbox.
+	netns      string // path of the sandbox network namespace, as seen by dwgd
+	listenPort int    // listen port of the client interface, set only in mesh mode
+
+	// The following fields are set only if the network uses KeyModeKeydir.
+	keyfile string       // name of the file in the network's keydir holding the key
+	privkey *wgtypes.Key // private key of the client, derived from the seed if nil
+}
+
+// PrivateKey returns the private key of the client interface.
+func (c *Client) PrivateKey() *wgtypes.Key {
+	if c.privkey != nil {
+		return c.privkey
+	}
+	return GeneratePrivateKey(c.network.seed, c.ip)
 }
 
 func (c *Client) Config() wgtypes.Config {
-	privkey := GeneratePrivateKey(c.network.seed, c.ip)
+	privkey := c.PrivateKey()
 
 	peers := make([]wgtypes.PeerConfig, 1)
 	peers[0] = c.network.PeerConfig()
@@ -66,7 +156,7 @@ func (c *Client) PeerConfig() wgtypes.PeerConfig {
 	}
 	allowedIPs := []net.IPNet{ipnet}
 
-	privkey := GeneratePrivateKey(c.network.seed, c.ip)
+	privkey := c.PrivateKey()
 
 	return wgtypes.PeerConfig{
 		PublicKey:                   privkey.PublicKey(),
@@ -100,6 +190,8 @@ func GeneratePrivateKey(seed []byte, ip net.IP) *wgtypes.Key {
 
 type Storage struct {
 	db *sql.DB
+
+	keysMu sync.Mutex // serializes AddClientWithKey
 }
 
 func (s *Storage) Open(path string) error {
@@ -121,6 +213,73 @@ func (s *Storage) Open(path string) error {
 	return err
 }
 
+// OpenReadOnly opens the database at path without migrating it, for the
+// commands inspecting the state of dwgd while the daemon may be using it.
+// It fails if the database doesn't exist or its schema is older than the
+// one of this dwgd, as only the daemon migrates it.
+func (s *Storage) OpenReadOnly(path string) error {
+	db, err := sql.Open("sqlite3", readOnlyDSN(path))
+	if err != nil {
+		return err
+	}
+	s.db = db
+
+	if err := s.checkSchema(); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+// readOnlyDSN returns the URI opening path read-only, keeping its mode
+// if it already has one, e.g. for in-memory databases.
+func readOnlyDSN(path string) string {
+	if !strings.HasPrefix(path, "file:") {
+		path = "file:" + path
+	}
+	params := "_query_only=1"
+	if !strings.Contains(path, "mode=") {
+		params = "mode=ro&" + params
+	}
+	if strings.Contains(path, "?") {
+		return path + "&" + params
+	}
+	return path + "?" + params
+}
+
+// checkSchema returns an error if any migration hasn't been run on the
+// database.
+func (s *Storage) checkSchema() error {
+	rows, err := s.db.Query(`SELECT name FROM migrations`)
+	if err != nil {
+		return fmt.Errorf("cannot read migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		applied[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrationFS, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !applied[name] {
+			return fmt.Errorf("database schema is older than this dwgd, missing migration %q: start the daemon to migrate it", name)
+		}
+	}
+	return nil
+}
+
 func (s *Storage) Close() error {
 	return s.db.Close()
 }
@@ -191,6 +350,153 @@ func (s *Storage) migrateFile(name string) error {
 	return tx.Commit()
 }
 
+// networkColumns are the columns of the network table that are needed
+// to build a Network. They are prefixed with the table name so that they
+// can also be used when joining other tables.
+const networkColumns = `
+	network.id,
+	network.endpoint,
+	network.seed,
+	network.pubkey,
+	network.route,
+	network.ifname,
+	network.owner,
+	network.create_server,
+	network.privkey,
+	network.listen_port,
+	network.address,
+	network.ifname_netns,
+	network.mesh,
+	network.agent,
+	network.persist,
+	network.persist_path,
+	network.provisioner,
+	network.provisioner_options,
+	network.provisioner_secrets,
+	network.keymode,
+	network.keydir,
+	network.allowed_ips,
+	network.preshared_key,
+	network.keepalive,
+	network.mtu,
+	network.profile,
+	network.profile_version,
+	network.stale_after,
+	network.wait_handshake,
+	network.wait_handshake_policy`
+
+// networkRow holds the raw values of a network row while it is scanned.
+type networkRow struct {
+	n                  *Network
+	endpoint           string
+	pubkey             []byte
+	privkey            []byte
+	provisionerOptions string
+	provisionerSecrets string
+	allowedIPs         string
+	presharedKey       []byte
+}
+
+func newNetworkRow() *networkRow {
+	return &networkRow{n: &Network{}}
+}
+
+// dest returns the scan destinations matching networkColumns.
+func (r *networkRow) dest() []interface{} {
+	return []interface{}{
+		&r.n.id,
+		&r.endpoint,
+		&r.n.seed,
+		&r.pubkey,
+		&r.n.route,
+		&r.n.ifname,
+		&r.n.owner,
+		&r.n.createServer,
+		&r.privkey,
+		&r.n.listenPort,
+		&r.n.address,
+		&r.n.ifnameNetns,
+		&r.n.mesh,
+		&r.n.agent,
+		&r.n.persist,
+		&r.n.persistPath,
+		&r.n.provisioner,
+		&r.provisionerOptions,
+		&r.provisionerSecrets,
+		&r.n.keymode,
+		&r.n.keydir,
+		&r.allowedIPs,
+		&r.presharedKey,
+		&r.n.keepalive,
+		&r.n.mtu,
+		&r.n.profile,
+		&r.n.profileVersion,
+		&r.n.staleAfter,
+		&r.n.waitHandshake,
+		&r.n.waitHandshakePolicy,
+	}
+}
+
+// network decodes the scanned values into a Network.
+func (r *networkRow) network() (*Network, error) {
+	var err error
+	r.n.endpoint, err = net.ResolveUDPAddr("udp", r.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	r.n.pubkey, err = wgtypes.NewKey(r.pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.privkey) > 0 {
+		privkey, err := wgtypes.NewKey(r.privkey)
+		if err != nil {
+			return nil, err
+		}
+		r.n.privkey = &privkey
+	}
+	if r.provisionerOptions != "" {
+		if err := json.Unmarshal([]byte(r.provisionerOptions), &r.n.provisionerOptions); err != nil {
+			return nil, err
+		}
+	}
+	if r.provisionerSecrets != "" {
+		if err := json.Unmarshal([]byte(r.provisionerSecrets), &r.n.provisionerSecrets); err != nil {
+			return nil, err
+		}
+	}
+	if r.allowedIPs != "" {
+		for _, cidr := range strings.Split(r.allowedIPs, ",") {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			r.n.allowedIPs = append(r.n.allowedIPs, *ipnet)
+		}
+	}
+	if len(r.presharedKey) > 0 {
+		psk, err := wgtypes.NewKey(r.presharedKey)
+		if err != nil {
+			return nil, err
+		}
+		r.n.presharedKey = &psk
+	}
+	return r.n, nil
+}
+
+// encodeOptions returns options as stored in the database, empty if there
+// are none.
+func encodeOptions(options map[string]string) (string, error) {
+	if len(options) == 0 {
+		return "", nil
+	}
+	buf, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
 func (s *Storage) AddNetwork(n *Network) error {
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -198,13 +504,99 @@ func (s *Storage) AddNetwork(n *Network) error {
 	}
 	defer tx.Rollback()
 
-	stm, err := s.db.Prepare("INSERT INTO network(id, endpoint, seed, pubkey, route, ifname) VALUES(?, ?, ?, ?, ?, ?)")
+	stm, err := tx.Prepare(`INSERT INTO network(
+	id,
+	endpoint,
+	seed,
+	pubkey,
+	route,
+	ifname,
+	owner,
+	create_server,
+	privkey,
+	listen_port,
+	address,
+	ifname_netns,
+	mesh,
+	agent,
+	persist,
+	persist_path,
+	provisioner,
+	provisioner_options,
+	provisioner_secrets,
+	keymode,
+	keydir,
+	allowed_ips,
+	preshared_key,
+	keepalive,
+	mtu,
+	profile,
+	profile_version,
+	stale_after,
+	wait_handshake,
+	wait_handshake_policy
+) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return err
 	}
 	defer stm.Close()
 
-	r, err := stm.Exec(n.id, n.endpoint.String(), n.seed, n.pubkey[:], n.route, n.ifname)
+	var privkey []byte
+	if n.privkey != nil {
+		privkey = n.privkey[:]
+	}
+
+	provisionerOptions, err := encodeOptions(n.provisionerOptions)
+	if err != nil {
+		return err
+	}
+	provisionerSecrets, err := encodeOptions(n.provisionerSecrets)
+	if err != nil {
+		return err
+	}
+
+	allowedIPs := make([]string, 0, len(n.allowedIPs))
+	for _, ipnet := range n.allowedIPs {
+		allowedIPs = append(allowedIPs, ipnet.String())
+	}
+
+	var presharedKey []byte
+	if n.presharedKey != nil {
+		presharedKey = n.presharedKey[:]
+	}
+
+	r, err := stm.Exec(
+		n.id,
+		n.endpoint.String(),
+		n.seed,
+		n.pubkey[:],
+		n.route,
+		n.ifname,
+		n.owner,
+		n.createServer,
+		privkey,
+		n.listenPort,
+		n.address,
+		n.ifnameNetns,
+		n.mesh,
+		n.agent,
+		n.persist,
+		n.persistPath,
+		n.provisioner,
+		provisionerOptions,
+		provisionerSecrets,
+		n.keymode,
+		n.keydir,
+		strings.Join(allowedIPs, ","),
+		presharedKey,
+		n.keepalive,
+		n.mtu,
+		n.profile,
+		n.profileVersion,
+		n.staleAfter,
+		n.waitHandshake,
+		n.waitHandshakePolicy,
+	)
 	if err != nil {
 		return err
 	}
@@ -256,33 +648,51 @@ func (s *Storage) GetNetwork(id string) (*Network, error) {
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("SELECT id, endpoint, seed, pubkey, route, ifname FROM network WHERE id = ?")
+	stmt, err := tx.Prepare("SELECT " + networkColumns + " FROM network WHERE id = ?")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	n := &Network{}
-	var endpoint string
-	var pubkey []byte
-
-	err = stmt.QueryRow(id).Scan(&n.id, &endpoint, &n.seed, &pubkey, &n.route, &n.ifname)
+	row := newNetworkRow()
+	err = stmt.QueryRow(id).Scan(row.dest()...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	n.endpoint, err = net.ResolveUDPAddr("udp", endpoint)
+
+	return row.network()
+}
+
+func (s *Storage) ListNetworks() ([]*Network, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	n.pubkey, err = wgtypes.NewKey(pubkey)
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT " + networkColumns + " FROM network ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	networks := make([]*Network, 0)
+	for rows.Next() {
+		row := newNetworkRow()
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, err
+		}
+		n, err := row.network()
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
 
-	return n, nil
+	return networks, rows.Err()
 }
 
 func (s *Storage) AddClient(c *Client) error {
@@ -292,13 +702,69 @@ func (s *Storage) AddClient(c *Client) error {
 	}
 	defer tx.Rollback()
 
-	stm, err := tx.Prepare("INSERT INTO client(id, network_id, ip, ifname) VALUES(?, ?, ?, ?)")
+	if err := addClient(tx, c); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AddClientWithKey adds c once pick has chosen its key, given the key files
+// used by the other clients of its network, mapped to their endpoint IDs.
+// Reading the used keys and adding c happen in the same transaction, and
+// calls are serialized, so concurrent endpoints never pick the same key.
+func (s *Storage) AddClientWithKey(c *Client, pick func(used map[string]string) error) error {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT keyfile, id FROM client WHERE network_id = ? AND keyfile != ''", c.network.id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	used := make(map[string]string)
+	for rows.Next() {
+		var keyfile, id string
+		if err := rows.Scan(&keyfile, &id); err != nil {
+			return err
+		}
+		used[keyfile] = id
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if err := pick(used); err != nil {
+		return err
+	}
+	if err := addClient(tx, c); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func addClient(tx *sql.Tx, c *Client) error {
+	stm, err := tx.Prepare("INSERT INTO client(id, network_id, ip, ifname, owner, keyfile, privkey) VALUES(?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stm.Close()
 
-	r, err := stm.Exec(c.id, c.network.id, c.ip.String(), c.ifname)
+	var privkey []byte
+	if c.privkey != nil {
+		privkey = c.privkey[:]
+	}
+
+	r, err := stm.Exec(c.id, c.network.id, c.ip.String(), c.ifname, c.owner, c.keyfile, privkey)
 	if err != nil {
 		return err
 	}
@@ -310,6 +776,36 @@ func (s *Storage) AddClient(c *Client) error {
 	if num != 1 {
 		return fmt.Errorf("number of inserted rows: %d is not 1", num)
 	}
+	return nil
+}
+
+// UpdateClientJoin records the sandbox c is joined to, or that it has left
+// it if c.netns is empty.
+func (s *Storage) UpdateClientJoin(c *Client) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stm, err := tx.Prepare("UPDATE client SET netns = ?, listen_port = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stm.Close()
+
+	r, err := stm.Exec(c.netns, c.listenPort, c.id)
+	if err != nil {
+		return err
+	}
+
+	num, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if num != 1 {
+		return fmt.Errorf("number of updated rows: %d is not 1", num)
+	}
 
 	return tx.Commit()
 }
@@ -343,18 +839,66 @@ func (s *Storage) RemoveClient(id string) error {
 	return tx.Commit()
 }
 
-func (s *Storage) GetClient(id string) (*Client, error) {
-	q := `
-SELECT 
+// clientColumns are the columns needed to build a Client, they must be
+// selected joining the network table.
+const clientColumns = `
 	client.id,
-	client.network_id,
 	client.ip,
 	client.ifname,
-	network.endpoint,
-	network.seed,
-	network.pubkey,
-	network.route,
-	network.ifname
+	client.owner,
+	client.netns,
+	client.listen_port,
+	client.keyfile,
+	client.privkey,` + networkColumns
+
+// clientRow holds the raw values of a client row while it is scanned.
+type clientRow struct {
+	c       *Client
+	ip      string
+	privkey []byte
+	nr      *networkRow
+}
+
+func newClientRow() *clientRow {
+	return &clientRow{c: &Client{}, nr: newNetworkRow()}
+}
+
+// dest returns the scan destinations matching clientColumns.
+func (r *clientRow) dest() []interface{} {
+	dest := []interface{}{
+		&r.c.id,
+		&r.ip,
+		&r.c.ifname,
+		&r.c.owner,
+		&r.c.netns,
+		&r.c.listenPort,
+		&r.c.keyfile,
+		&r.privkey,
+	}
+	return append(dest, r.nr.dest()...)
+}
+
+// client decodes the scanned values into a Client.
+func (r *clientRow) client() (*Client, error) {
+	var err error
+	r.c.ip = net.ParseIP(r.ip)
+	if len(r.privkey) > 0 {
+		privkey, err := wgtypes.NewKey(r.privkey)
+		if err != nil {
+			return nil, err
+		}
+		r.c.privkey = &privkey
+	}
+	r.c.network, err = r.nr.network()
+	if err != nil {
+		return nil, err
+	}
+	return r.c, nil
+}
+
+func (s *Storage) GetClient(id string) (*Client, error) {
+	q := `
+SELECT ` + clientColumns + `
 FROM 
 	client 
 INNER JOIN network
@@ -373,27 +917,70 @@ WHERE client.id = ?
 	}
 	defer stmt.Close()
 
-	c := &Client{}
-	c.network = &Network{}
-	var endpoint string
-	var ip string
-	var pubkey []byte
-	err = stmt.QueryRow(id).Scan(&c.id, &c.network.id, &ip, &c.ifname, &endpoint, &c.network.seed, &pubkey, &c.network.route, &c.network.ifname)
+	row := newClientRow()
+	err = stmt.QueryRow(id).Scan(row.dest()...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	c.ip = net.ParseIP(ip)
-	c.network.endpoint, err = net.ResolveUDPAddr("udp", endpoint)
+
+	return row.client()
+}
+
+// ListClients returns the clients of the network with the given id, or all
+// the clients if id is empty.
+func (s *Storage) ListClients(networkID string) ([]*Client, error) {
+	q := `
+SELECT ` + clientColumns + `
+FROM 
+	client 
+INNER JOIN network
+ON client.network_id = network.id
+WHERE ? = '' OR client.network_id = ?
+ORDER BY client.id
+`
+	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	c.network.pubkey, err = wgtypes.NewKey(pubkey)
+	defer tx.Rollback()
+
+	rows, err := tx.Query(q, networkID, networkID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	clients := make([]*Client, 0)
+	for rows.Next() {
+		row := newClientRow()
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, err
+		}
+		c, err := row.client()
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+
+	return clients, rows.Err()
+}
 
-	return c, nil
+// Counts returns the number of networks, of clients and of clients joined
+// to a sandbox.
+func (s *Storage) Counts() (int, int, int, error) {
+	q := `
+SELECT
+	(SELECT COUNT(*) FROM network),
+	(SELECT COUNT(*) FROM client),
+	(SELECT COUNT(*) FROM client WHERE netns != '')
+`
+	var networks, clients, joined int
+	if err := s.db.QueryRow(q).Scan(&networks, &clients, &joined); err != nil {
+		return 0, 0, 0, err
+	}
+	return networks, clients, joined, nil
 }
@@ -1,10 +1,14 @@
 package dwgd
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"math"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -76,6 +80,74 @@ func TestStorage(t *testing.T) {
 	MustCloseDB(t, s)
 }
 
+func TestStorage_OpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dwgd.db")
+
+	// a missing database is neither created nor opened
+	ro := &Storage{}
+	if err := ro.OpenReadOnly(path); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected %s not to exist, got %v", path, err)
+	}
+
+	s := &Storage{}
+	if err := s.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer MustCloseDB(t, s)
+	n := NetworkFixture()
+	MustExistNetwork(t, s, n)
+
+	if err := ro.OpenReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := ro.GetNetwork(n.id); err != nil || other == nil {
+		t.Fatalf("expected network %s, got %#v, %v", n.id, other, err)
+	}
+	if err := ro.RemoveNetwork(n.id); err == nil {
+		t.Fatal("expected the database to be read-only")
+	}
+	MustCloseDB(t, ro)
+
+	// databases not migrated yet by the daemon are rejected
+	if _, err := s.db.Exec(`DELETE FROM migrations WHERE name = 'migrations/0013.sql'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.OpenReadOnly(path); err == nil || !strings.Contains(err.Error(), "0013.sql") {
+		t.Fatalf("expected an older schema error, got %v", err)
+	}
+}
+
+func TestStorage_MigrateProvisionerSecrets(t *testing.T) {
+	s := MustOpenDB(t)
+	defer MustCloseDB(t, s)
+	n := NetworkFixture()
+	MustExistNetwork(t, s, n)
+
+	// networks stored before 0014.sql kept all the options, secrets
+	// included
+	_, err := s.db.Exec(`ALTER TABLE network DROP COLUMN provisioner_secrets;
+DELETE FROM migrations WHERE name = 'migrations/0014.sql';
+UPDATE network SET provisioner = 'webhook', provisioner_options = '{"dwgd.seed":"foo","dwgd.webhook_secret":"bar","dwgd.webhook_url":"http://baz"}'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := s.GetNetwork(n.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(other.provisionerOptions, map[string]string{"dwgd.webhook_url": "http://baz"}) ||
+		!cmp.Equal(other.provisionerSecrets, map[string]string{"dwgd.webhook_secret": "bar"}) {
+		t.Fatalf("unexpected options: %v %v", other.provisionerOptions, other.provisionerSecrets)
+	}
+}
+
 func TestStorage_Network(t *testing.T) {
 	network := NetworkFixture()
 
@@ -1,6 +1,6 @@
 module github.com/leomos/dwgd
 
-go 1.19
+go 1.21
 
 require (
 	github.com/docker/go-connections v0.4.0
@@ -8,6 +8,8 @@ require (
 	github.com/google/go-cmp v0.6.0
 	github.com/illarion/gonotify/v2 v2.0.0
 	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/sys v0.7.0
+	golang.zx2c4.com/wireguard v0.0.0-20230325221338-052af4a8072b
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20230429144221-925a1e7659e6
 )
 
@@ -22,9 +24,8 @@ require (
 	golang.org/x/mod v0.7.0 // indirect
 	golang.org/x/net v0.9.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/tools v0.5.0 // indirect
-	golang.zx2c4.com/wireguard v0.0.0-20230325221338-052af4a8072b // indirect
+	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
 )
 
 // replace github.com/leomos/dwgd => ./dwgd
@@ -0,0 +1,120 @@
+package dwgd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Policies applied when no handshake happens within dwgd.wait_handshake.
+const (
+	WaitHandshakeFail = "fail" // Join fails
+	WaitHandshakeWarn = "warn" // Join succeeds and a warning is logged
+)
+
+// maxWaitHandshake keeps Join well within the timeout docker applies to the
+// requests sent to plugins, 30 seconds, leaving time for the rest of Join.
+const maxWaitHandshake = 20 * time.Second
+
+// handshakePollInterval is how often the interface is polled while waiting
+// for a handshake.
+var handshakePollInterval = 100 * time.Millisecond
+
+// parseWaitHandshakeOptions parses dwgd.wait_handshake, how long Join waits
+// for the first handshake with the peer of the network, and
+// dwgd.wait_handshake_policy, what to do if it doesn't happen.
+func parseWaitHandshakeOptions(n *Network, m map[string]interface{}) error {
+	if payload, ok := m["dwgd.wait_handshake"].(string); ok {
+		d, err := time.ParseDuration(payload)
+		if err != nil || d < 0 || d > maxWaitHandshake || (d > 0 && d < time.Second) {
+			return fmt.Errorf("invalid dwgd.wait_handshake option: %q, expected a duration between 1s and %s", payload, maxWaitHandshake)
+		}
+		n.waitHandshake = int(d.Seconds())
+	}
+	if policy, ok := m["dwgd.wait_handshake_policy"].(string); ok {
+		if policy != WaitHandshakeFail && policy != WaitHandshakeWarn {
+			return fmt.Errorf("invalid dwgd.wait_handshake_policy option: %q, expected %s or %s", policy, WaitHandshakeFail, WaitHandshakeWarn)
+		}
+		n.waitHandshakePolicy = policy
+	}
+	return nil
+}
+
+// WaitHandshake returns how long Join waits for the first handshake of a
+// client, 0 if it doesn't.
+func (n *Network) WaitHandshake() time.Duration {
+	return time.Duration(n.waitHandshake) * time.Second
+}
+
+// WaitHandshakePolicy returns what Join does when no handshake happens in
+// time, WaitHandshakeFail unless set otherwise.
+func (n *Network) WaitHandshakePolicy() string {
+	if n.waitHandshakePolicy == "" {
+		return WaitHandshakeFail
+	}
+	return n.waitHandshakePolicy
+}
+
+// waitHandshake brings the interface of c up, triggers a handshake with the
+// peer of its network and waits for it to complete. The wait happens in
+// dwgd's namespace because docker moves the interface into the sandbox only
+// once Join has returned, and Join is the last chance to keep the container
+// from starting. The interface is brought down again before returning since
+// docker expects it down to move it, and WireGuard starts a new session with
+// the peer as soon as it's up in the sandbox. In mesh mode only the peer of
+// the network is waited for: the other clients of the mesh may not be up.
+func (d *Driver) waitHandshake(c *Client) (err error) {
+	timeout := c.network.WaitHandshake()
+
+	if err := d.c.Run("ip", "link", "set", "up", "dev", c.ifname); err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, d.c.Run("ip", "link", "set", "down", "dev", c.ifname))
+	}()
+
+	// Bringing the interface up sends a keepalive to the peers with a
+	// persistent keepalive, and enabling it sends one to the others: either
+	// way the keepalive starts a handshake, which WireGuard retries until it
+	// completes. The keepalive of the network is restored afterwards.
+	keepalive := time.Second
+	err = d.wgc.ConfigureDevice(c.ifname, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:                   c.network.pubkey,
+			UpdateOnly:                  true,
+			PersistentKeepaliveInterval: &keepalive,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		restore := c.network.PeerConfig().PersistentKeepaliveInterval
+		err = errors.Join(err, d.wgc.ConfigureDevice(c.ifname, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{
+				PublicKey:                   c.network.pubkey,
+				UpdateOnly:                  true,
+				PersistentKeepaliveInterval: restore,
+			}},
+		}))
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		dev, err := d.wgc.Device(c.ifname)
+		if err != nil {
+			return err
+		}
+		for _, p := range dev.Peers {
+			if p.PublicKey == c.network.pubkey && !p.LastHandshakeTime.IsZero() {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no handshake with peer %s at %s within %s: check that it's reachable and that it knows the public key %s", c.network.pubkey, c.network.endpoint, timeout, c.PrivateKey().PublicKey())
+		}
+		time.Sleep(handshakePollInterval)
+	}
+}
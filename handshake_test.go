@@ -0,0 +1,167 @@
+package dwgd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestParseWaitHandshakeOptions(t *testing.T) {
+	n := &Network{}
+	err := parseWaitHandshakeOptions(n, map[string]interface{}{"dwgd.wait_handshake": "10s", "dwgd.wait_handshake_policy": "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.WaitHandshake() != 10*time.Second || n.WaitHandshakePolicy() != WaitHandshakeWarn {
+		t.Fatalf("unexpected options: %s %s", n.WaitHandshake(), n.WaitHandshakePolicy())
+	}
+	if got := (&Network{}).WaitHandshakePolicy(); got != WaitHandshakeFail {
+		t.Fatalf("expected %s, got %s", WaitHandshakeFail, got)
+	}
+
+	for _, m := range []map[string]interface{}{
+		{"dwgd.wait_handshake": "soon"},
+		{"dwgd.wait_handshake": "500ms"},
+		{"dwgd.wait_handshake": "-1s"},
+		{"dwgd.wait_handshake": "30s"},
+		{"dwgd.wait_handshake": "5m"},
+		{"dwgd.wait_handshake_policy": "retry"},
+	} {
+		if err := parseWaitHandshakeOptions(&Network{}, m); err == nil {
+			t.Fatalf("%v: expected error", m)
+		}
+	}
+}
+
+func TestDriver_JoinWaitHandshake(t *testing.T) {
+	defer func(interval time.Duration) { handshakePollInterval = interval }(handshakePollInterval)
+	handshakePollInterval = 10 * time.Millisecond
+
+	setup := func(t *testing.T, policy string, handshake bool, mesh string) (*Driver, *testCommander, *Client, *[]wgtypes.PeerConfig) {
+		t.Helper()
+		tc := CommanderFixture()
+		wgc := WgControllerFixture()
+		d, err := NewDriver(ConfigFixture(), tc, wgc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+
+		n := NetworkFixture()
+		options := map[string]interface{}{
+			"dwgd.seed":                  string(n.seed),
+			"dwgd.endpoint":              n.endpoint.String(),
+			"dwgd.ifname":                n.ifname,
+			"dwgd.wait_handshake":        "1s",
+			"dwgd.wait_handshake_policy": policy,
+		}
+		if mesh != "" {
+			options["dwgd.mesh"] = mesh
+		}
+		err = d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options:   map[string]interface{}{"com.docker.network.generic": options},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  n.id,
+			EndpointID: "c1",
+			Interface:  &network.EndpointInterface{Address: "10.0.0.2/32"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.s.GetClient("c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The peers configured on the interface of the network, i.e. the
+		// clients registered with the server.
+		var serverPeers []wgtypes.PeerConfig
+		wgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+			if name == n.ifname {
+				serverPeers = append(serverPeers, cfg.Peers...)
+			}
+			return nil
+		}
+		wgc.DeviceFunc = func(name string) (*wgtypes.Device, error) {
+			if name != c.ifname {
+				return DeviceFixture(), nil
+			}
+			peer := wgtypes.Peer{PublicKey: n.pubkey}
+			if handshake {
+				peer.LastHandshakeTime = time.Now()
+			}
+			return &wgtypes.Device{Name: c.ifname, ListenPort: 52000, Peers: []wgtypes.Peer{peer}}, nil
+		}
+		tc.RunHistory = nil
+		return d, tc, c, &serverPeers
+	}
+	join := func(d *Driver, c *Client) error {
+		_, err := d.Join(&network.JoinRequest{NetworkID: c.network.id, EndpointID: c.id, SandboxKey: "/foo/bar"})
+		return err
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		d, tc, c, _ := setup(t, WaitHandshakeFail, true, "")
+		if err := join(d, c); err != nil {
+			t.Fatal(err)
+		}
+		expectedHistory := [][]string{
+			{"ip", "link", "add", "name", c.ifname, "type", "wireguard"},
+			{"ip", "link", "set", "up", "dev", c.ifname},
+			{"ip", "link", "set", "down", "dev", c.ifname},
+		}
+		if !cmp.Equal(tc.RunHistory, expectedHistory) {
+			t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		d, tc, c, serverPeers := setup(t, WaitHandshakeFail, false, "")
+		err := join(d, c)
+		if err == nil || !strings.Contains(err.Error(), "no handshake with peer") {
+			t.Fatalf("expected a handshake error, got %v", err)
+		}
+		if last := tc.RunHistory[len(tc.RunHistory)-1]; !cmp.Equal(last, []string{"ip", "link", "set", "down", "dev", c.ifname}) {
+			t.Fatalf("expected the interface to be brought down, got %v", last)
+		}
+		peers := *serverPeers
+		if len(peers) != 2 || peers[0].Remove || !peers[1].Remove {
+			t.Fatalf("expected the client to be registered and removed, got %#v", peers)
+		}
+		joined, err := d.s.GetClient(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if joined.netns != "" {
+			t.Fatalf("expected the client not to be joined, got %s", joined.netns)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		d, _, c, serverPeers := setup(t, WaitHandshakeWarn, false, "")
+		if err := join(d, c); err != nil {
+			t.Fatal(err)
+		}
+		if peers := *serverPeers; len(peers) != 1 || peers[0].Remove {
+			t.Fatalf("expected the client to stay registered, got %#v", peers)
+		}
+	})
+
+	t.Run("mesh", func(t *testing.T) {
+		// only the peer of the network is waited for, not the other
+		// clients of the mesh
+		d, _, c, _ := setup(t, WaitHandshakeFail, true, MeshLocal)
+		if err := join(d, c); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
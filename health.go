@@ -0,0 +1,170 @@
+package dwgd
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultStaleAfter is how long a tunnel can go without handshakes before
+// being considered stale. WireGuard renews the session every two minutes
+// while there is traffic, and keepalives keep it going without.
+const defaultStaleAfter = 3 * time.Minute
+
+// parseHealthOptions parses dwgd.stale_after, a duration after which a
+// tunnel without handshakes is reported as stale, 0 to disable monitoring.
+func parseHealthOptions(n *Network, m map[string]interface{}) error {
+	payload, ok := m["dwgd.stale_after"].(string)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(payload)
+	if err != nil || d < 0 || (d > 0 && d < time.Second) {
+		return fmt.Errorf("invalid dwgd.stale_after option: %q", payload)
+	}
+	n.staleAfter = int(d.Seconds())
+	if n.staleAfter == 0 {
+		n.staleAfter = -1
+	}
+	return nil
+}
+
+// StaleAfter returns how long the tunnels of the network can go without
+// handshakes before being considered stale, 0 if they are not monitored.
+// Without keepalives an idle tunnel has no handshakes, so networks with
+// keepalives disabled are monitored only if a threshold has been set.
+func (n *Network) StaleAfter() time.Duration {
+	switch {
+	case n.staleAfter < 0:
+		return 0
+	case n.staleAfter == 0 && n.keepalive < 0:
+		return 0
+	case n.staleAfter == 0:
+		return defaultStaleAfter
+	}
+	return time.Duration(n.staleAfter) * time.Second
+}
+
+// tunnelHealth is the state of the tunnel of a joined client, as seen by
+// the health monitor.
+type tunnelHealth struct {
+	networkID string
+	firstSeen time.Time // when the monitor first saw the client joined
+	stale     bool
+}
+
+// lastHandshake returns the time of the last handshake of the interface of
+// c with the peer of its network, zero if none happened yet.
+func (d *Driver) lastHandshake(c *Client) (time.Time, error) {
+	// The interface is looked up by public key since it's renamed in the
+	// sandbox.
+	dev, err := d.clientDevice(c)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey == c.network.pubkey {
+			return p.LastHandshakeTime, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// CheckTunnels looks at the last handshake of the interface of every joined
+// client, logging an event when its tunnel goes stale, i.e. it has had no
+// handshakes for longer than the threshold of its network, and another one
+// when it recovers. Clients that never had a handshake are stale once the
+// threshold has passed since they were first checked.
+func (d *Driver) CheckTunnels() error {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, n := range networks {
+		staleAfter := n.StaleAfter()
+		if staleAfter == 0 {
+			continue
+		}
+		clients, err := d.s.ListClients(n.id)
+		if err != nil {
+			return err
+		}
+		for _, c := range clients {
+			if c.netns == "" {
+				continue
+			}
+			seen[c.id] = true
+
+			handshake, err := d.lastHandshake(c)
+			if err != nil {
+				Logger.With("network_id", n.id, "endpoint_id", c.id).Info("Couldn't check the tunnel", "error", err)
+				continue
+			}
+			d.updateTunnel(c, handshake, staleAfter, now)
+		}
+	}
+
+	// Clients that left or whose network isn't monitored anymore are
+	// forgotten, without events.
+	d.healthMu.Lock()
+	defer d.healthMu.Unlock()
+	for id := range d.tunnels {
+		if !seen[id] {
+			delete(d.tunnels, id)
+		}
+	}
+	return nil
+}
+
+// updateTunnel records the last handshake of c, logging an event if the
+// state of its tunnel changed.
+func (d *Driver) updateTunnel(c *Client, handshake time.Time, staleAfter time.Duration, now time.Time) {
+	d.healthMu.Lock()
+	defer d.healthMu.Unlock()
+
+	t, ok := d.tunnels[c.id]
+	if !ok {
+		t = &tunnelHealth{networkID: c.network.id, firstSeen: now}
+		d.tunnels[c.id] = t
+	}
+
+	last := handshake
+	if last.IsZero() {
+		last = t.firstSeen
+	}
+	stale := now.Sub(last) > staleAfter
+	if stale == t.stale {
+		return
+	}
+	t.stale = stale
+
+	lastHandshake := "never"
+	if !handshake.IsZero() {
+		lastHandshake = handshake.UTC().Format(time.RFC3339)
+	}
+	if stale {
+		d.staleEvents++
+		logEvent("tunnel_stale", "network_id", c.network.id, "endpoint_id", c.id, "last_handshake", lastHandshake, "threshold", staleAfter.String())
+	} else {
+		logEvent("tunnel_recovered", "network_id", c.network.id, "endpoint_id", c.id, "last_handshake", lastHandshake)
+	}
+}
+
+// runHealthMonitor checks the tunnels every interval until stop is closed.
+func (d *Driver) runHealthMonitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := d.CheckTunnels(); err != nil {
+			Logger.Info("Couldn't check tunnels", "error", err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package dwgd
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestParseHealthOptions(t *testing.T) {
+	valid := map[string]int{"90s": 90, "5m": 300, "0": -1}
+	for payload, expected := range valid {
+		n := &Network{}
+		if err := parseHealthOptions(n, map[string]interface{}{"dwgd.stale_after": payload}); err != nil {
+			t.Fatalf("%s: %s", payload, err)
+		}
+		if n.staleAfter != expected {
+			t.Fatalf("%s: expected %d, got %d", payload, expected, n.staleAfter)
+		}
+	}
+
+	for _, payload := range []string{"soon", "-1m", "500ms"} {
+		if err := parseHealthOptions(&Network{}, map[string]interface{}{"dwgd.stale_after": payload}); err == nil {
+			t.Fatalf("%s: expected error", payload)
+		}
+	}
+
+	if got := (&Network{}).StaleAfter(); got != defaultStaleAfter {
+		t.Fatalf("expected %s, got %s", defaultStaleAfter, got)
+	}
+	if got := (&Network{staleAfter: -1}).StaleAfter(); got != 0 {
+		t.Fatalf("expected 0, got %s", got)
+	}
+
+	// idle tunnels without keepalives have no handshakes, they are
+	// monitored only with an explicit threshold
+	if got := (&Network{keepalive: -1}).StaleAfter(); got != 0 {
+		t.Fatalf("expected 0, got %s", got)
+	}
+	if got := (&Network{keepalive: -1, staleAfter: 300}).StaleAfter(); got != 5*time.Minute {
+		t.Fatalf("expected 5m0s, got %s", got)
+	}
+}
+
+func TestDriver_CheckTunnels(t *testing.T) {
+	var events bytes.Buffer
+	EventsLog.SetOutput(&events)
+	defer EventsLog.SetOutput(os.Stdout)
+
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := NetworkFixture()
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.seed":        string(n.seed),
+				"dwgd.endpoint":    n.endpoint.String(),
+				"dwgd.pubkey":      n.pubkey.String(),
+				"dwgd.stale_after": "1m",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  n.id,
+		EndpointID: "c1",
+		Interface:  &network.EndpointInterface{Address: "10.0.0.2/32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.s.GetClient("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var handshake time.Time
+	d.netnsWgc = func(path string) wgController {
+		dev := func() *wgtypes.Device {
+			return &wgtypes.Device{
+				Name:      "wg0",
+				PublicKey: c.PrivateKey().PublicKey(),
+				Peers:     []wgtypes.Peer{{PublicKey: n.pubkey, LastHandshakeTime: handshake}},
+			}
+		}
+		sandboxWgc := WgControllerFixture()
+		sandboxWgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+			return []*wgtypes.Device{dev()}, nil
+		}
+		sandboxWgc.DeviceFunc = func(name string) (*wgtypes.Device, error) {
+			t.Fatal("the interface found by public key is polled again")
+			return nil, nil
+		}
+		return sandboxWgc
+	}
+
+	check := func(t *testing.T, expected ...string) {
+		t.Helper()
+		events.Reset()
+		if err := d.CheckTunnels(); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+		if len(expected) == 0 && events.Len() != 0 {
+			t.Fatalf("unexpected events: %s", events.String())
+		}
+		for i, prefix := range expected {
+			if i >= len(lines) || !strings.HasPrefix(lines[i], prefix) {
+				t.Fatalf("expected event %q, got: %s", prefix, events.String())
+			}
+		}
+	}
+
+	// the client never had a handshake, it's stale once the threshold has
+	// passed since it was first checked
+	check(t)
+	d.tunnels[c.id].firstSeen = time.Now().Add(-2 * time.Minute)
+	check(t, "event=tunnel_stale network_id=n1 endpoint_id=c1 last_handshake=never threshold=1m0s")
+	check(t)
+
+	handshake = time.Now()
+	check(t, "event=tunnel_recovered network_id=n1 endpoint_id=c1 last_handshake=")
+
+	handshake = time.Now().Add(-90 * time.Second)
+	check(t, "event=tunnel_stale network_id=n1 endpoint_id=c1")
+
+	var metrics bytes.Buffer
+	if err := d.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"dwgd_endpoint_stale{network_id=\"n1\",endpoint_id=\"c1\"} 1\n", "dwgd_endpoint_stale_events_total 2\n"} {
+		if !strings.Contains(metrics.String(), s) {
+			t.Fatalf("%q not found in:\n%s", s, metrics.String())
+		}
+	}
+
+	// clients that left are forgotten
+	if err := d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: c.id}); err != nil {
+		t.Fatal(err)
+	}
+	check(t)
+	if len(d.tunnels) != 0 {
+		t.Fatalf("unexpected tunnels: %v", d.tunnels)
+	}
+}
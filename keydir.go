@@ -0,0 +1,146 @@
+package dwgd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	KeyModeSeed   = "seed"
+	KeyModeKeydir = "keydir"
+
+	keyFileSuffix = ".key"
+)
+
+// parseKeyOptions fills the fields of n describing how the keys of its
+// clients are obtained.
+func parseKeyOptions(n *Network, m map[string]interface{}) error {
+	mode, ok := m["dwgd.keymode"].(string)
+	if !ok {
+		return nil
+	}
+
+	switch mode {
+	case KeyModeSeed:
+	case KeyModeKeydir:
+		keydir, ok := m["dwgd.keydir"].(string)
+		if !ok || keydir == "" {
+			return fmt.Errorf("dwgd.keymode=keydir requires the dwgd.keydir option")
+		}
+		n.keymode = mode
+		n.keydir = keydir
+	default:
+		return fmt.Errorf("invalid dwgd.keymode option: %q", mode)
+	}
+	return nil
+}
+
+// A keydirKey is a private key read from the keydir of a network.
+type keydirKey struct {
+	file string
+	key  wgtypes.Key
+	ip   net.IP // address the key is registered for, nil if it can be used by any
+}
+
+// readKeydir returns the keys in dir. Keys are read from the files ending
+// in .key, which hold a base64 encoded private key as printed by wg genkey.
+// Files named after an address, e.g. 10.0.0.2.key, hold the key of that
+// address. The keys are sorted by file name.
+func (d *Driver) readKeydir(dir string) ([]*keydirKey, error) {
+	entries, err := d.c.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*keydirKey, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, keyFileSuffix) {
+			continue
+		}
+
+		buf, err := d.c.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		key, err := wgtypes.ParseKey(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", filepath.Join(dir, name), err)
+		}
+		keys = append(keys, &keydirKey{
+			file: name,
+			key:  key,
+			ip:   net.ParseIP(strings.TrimSuffix(name, keyFileSuffix)),
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].file < keys[j].file })
+	return keys, nil
+}
+
+// addKeydirClient adds c, which must belong to a network in keydir mode,
+// together with the key assigned to it by assignKey.
+func (d *Driver) addKeydirClient(l *slog.Logger, c *Client) error {
+	keys, err := d.readKeydir(c.network.keydir)
+	if err != nil {
+		return err
+	}
+	return d.s.AddClientWithKey(c, func(used map[string]string) error {
+		return assignKey(l, c, keys, used)
+	})
+}
+
+// assignKey sets the private key of c among keys, except the ones in used.
+// Clients with an address get the key of their address if there is one,
+// otherwise the first key not bound to an address. Clients without an
+// address get the first key bound to one, together with its address.
+func assignKey(l *slog.Logger, c *Client, keys []*keydirKey, used map[string]string) error {
+	n := c.network
+
+	var assigned *keydirKey
+	switch {
+	case c.ip == nil:
+		for _, k := range keys {
+			if _, ok := used[k.file]; k.ip != nil && !ok {
+				assigned = k
+				break
+			}
+		}
+	default:
+		for _, k := range keys {
+			if k.ip != nil && k.ip.Equal(c.ip) {
+				assigned = k
+				break
+			}
+		}
+		if assigned != nil {
+			if id, ok := used[assigned.file]; ok {
+				return fmt.Errorf("key %s of %s is already used by EndpointID %s", assigned.file, c.ip, id)
+			}
+			break
+		}
+		for _, k := range keys {
+			if _, ok := used[k.file]; k.ip == nil && !ok {
+				assigned = k
+				break
+			}
+		}
+	}
+	if assigned == nil {
+		return fmt.Errorf("no key available for %s in %s: the key pool of NetworkID %s is exhausted", c.ip, n.keydir, n.id)
+	}
+
+	l.Debug("Assigning key", "keyfile", assigned.file)
+	c.keyfile = assigned.file
+	c.privkey = &assigned.key
+	if c.ip == nil {
+		c.ip = assigned.ip
+	}
+	return nil
+}
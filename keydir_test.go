@@ -0,0 +1,217 @@
+package dwgd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDriver_Keydir(t *testing.T) {
+	dir := t.TempDir()
+	keys := make(map[string]wgtypes.Key)
+	for _, name := range []string{"10.0.0.2.key", "pool-a.key", "pool-b.key"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(key.String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files not ending in .key are ignored
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := CommanderFixture()
+	tc.ReadDirFunc = os.ReadDir
+	tc.ReadFileFunc = os.ReadFile
+	configured := make(map[string]wgtypes.Config)
+	wgc := WgControllerFixture()
+	wgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+		configured[name] = cfg
+		return nil
+	}
+	d, err := NewDriver(ConfigFixture(), tc, wgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := NetworkFixture()
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.endpoint": n.endpoint.String(),
+				"dwgd.pubkey":   n.pubkey.String(),
+				"dwgd.keymode":  "keydir",
+				"dwgd.keydir":   dir,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createEndpoint := func(id string, ip string) (*Client, error) {
+		_, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  n.id,
+			EndpointID: id,
+			Interface:  &network.EndpointInterface{Address: ip + "/24"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return d.s.GetClient(id)
+	}
+
+	expected := []struct {
+		id      string
+		ip      string
+		keyfile string
+	}{
+		// the pool keys are used by the addresses without a key of their own
+		{"e1", "10.0.0.3", "pool-a.key"},
+		{"e2", "10.0.0.2", "10.0.0.2.key"},
+		{"e3", "10.0.0.4", "pool-b.key"},
+	}
+	for _, e := range expected {
+		c, err := createEndpoint(e.id, e.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.keyfile != e.keyfile || *c.privkey != keys[e.keyfile] {
+			t.Fatalf("EndpointID %s: mismatch: %s != %s", e.id, c.keyfile, e.keyfile)
+		}
+	}
+
+	_, err = createEndpoint("e4", "10.0.0.5")
+	if err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Fatalf("expected pool exhausted error, got %v", err)
+	}
+
+	// the interface of the container uses the key from the keydir
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: "e2", SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+	key := keys["10.0.0.2.key"]
+	if cfg := configured["wg-e2"]; cfg.PrivateKey == nil || *cfg.PrivateKey != key {
+		t.Fatalf("unexpected configuration: %#v", cfg)
+	}
+
+	// keys are released when the endpoints are deleted
+	if err := d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: "e2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: n.id, EndpointID: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := createEndpoint("e4", "10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.keyfile != "pool-a.key" || !c.ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("unexpected client: %#v", c)
+	}
+}
+
+func TestDriver_KeydirAddress(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"10.0.0.2.key", "10.0.0.3.key", "pool-a.key", "pool-b.key", "pool-c.key"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(key.String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc := CommanderFixture()
+	tc.ReadDirFunc = os.ReadDir
+	tc.ReadFileFunc = os.ReadFile
+	d, err := NewDriver(ConfigFixture(), tc, WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := NetworkFixture()
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.endpoint": n.endpoint.String(),
+				"dwgd.pubkey":   n.pubkey.String(),
+				"dwgd.keymode":  "keydir",
+				"dwgd.keydir":   dir,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// endpoints without an address, e.g. with the null IPAM driver, get the
+	// next key bound to an address together with the address
+	res, err := d.CreateEndpoint(&network.CreateEndpointRequest{NetworkID: n.id, EndpointID: "e1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Interface == nil || res.Interface.Address != "10.0.0.2/32" {
+		t.Fatalf("unexpected response: %#v", res.Interface)
+	}
+	c, err := d.s.GetClient("e1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.keyfile != "10.0.0.2.key" || !c.ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("unexpected client: %#v", c)
+	}
+
+	// concurrent endpoints never share a key
+	errs := make(chan error)
+	for _, id := range []string{"e2", "e3", "e4", "e5", "e6"} {
+		go func(id string) {
+			_, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  n.id,
+				EndpointID: id,
+				Interface:  &network.EndpointInterface{Address: "10.0.1." + id[1:] + "/24"},
+			})
+			errs <- err
+		}(id)
+	}
+	failed := 0
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			if !strings.Contains(err.Error(), "exhausted") {
+				t.Fatal(err)
+			}
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Fatalf("expected 2 endpoints to find the pool exhausted, got %d", failed)
+	}
+	clients, err := d.s.ListClients(n.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := make(map[string]bool)
+	for _, c := range clients {
+		if used[c.keyfile] {
+			t.Fatalf("key %s assigned twice", c.keyfile)
+		}
+		used[c.keyfile] = true
+	}
+	if len(used) != 4 {
+		t.Fatalf("unexpected keys: %v", used)
+	}
+}
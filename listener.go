@@ -1,25 +1,156 @@
 package dwgd
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
 	"net"
 	"path"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/docker/go-connections/sockets"
 )
 
 const (
-	dockerPluginSockDir = "/run/docker/plugins"
-	dwgdRunDir          = "/run/dwgd"
-	dwgdSockName        = "dwgd.sock"
+	defaultDockerPluginSockDir = "/run/docker/plugins"
+	defaultDockerPluginSpecDir = "/etc/docker/plugins"
+	defaultDwgdRunDir          = "/run/dwgd"
+	dwgdPluginName             = "dwgd"
 )
 
+// A PeerAllowlist restricts which processes can connect to the plugin
+// socket. A process is allowed if its UID, its GID or one of its cgroups
+// is in the allowlist. An empty allowlist allows every process.
+type PeerAllowlist struct {
+	Uids    []uint32
+	Gids    []uint32
+	Cgroups []string // cgroup paths, a process is allowed if it lives in one of them or in a descendant
+}
+
+func (a *PeerAllowlist) Empty() bool {
+	return len(a.Uids) == 0 && len(a.Gids) == 0 && len(a.Cgroups) == 0
+}
+
+// processCgroups returns the cgroup paths of the process with the given PID,
+// both for cgroup v1 and v2 hierarchies.
+func processCgroups(c commander, pid int32) ([]string, error) {
+	data, err := c.ReadFile(path.Join("/proc", fmt.Sprint(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	cgroups := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// each line has the following format: hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		cgroups = append(cgroups, fields[2])
+	}
+	return cgroups, scanner.Err()
+}
+
+// Allows reports whether the process identified by cred can connect.
+func (a *PeerAllowlist) Allows(c commander, cred *syscall.Ucred) (bool, error) {
+	if a.Empty() {
+		return true, nil
+	}
+
+	for _, uid := range a.Uids {
+		if cred.Uid == uid {
+			return true, nil
+		}
+	}
+
+	for _, gid := range a.Gids {
+		if cred.Gid == gid {
+			return true, nil
+		}
+	}
+
+	if len(a.Cgroups) == 0 {
+		return false, nil
+	}
+
+	cgroups, err := processCgroups(c, cred.Pid)
+	if err != nil {
+		return false, err
+	}
+	for _, allowed := range a.Cgroups {
+		allowed = path.Clean(allowed)
+		for _, cgroup := range cgroups {
+			if cgroup == allowed || strings.HasPrefix(cgroup, strings.TrimSuffix(allowed, "/")+"/") {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
 type UnixListener struct {
-	sock net.Listener
-	c    commander
+	sock           net.Listener
+	c              commander
+	sockPath       string
+	pluginSockPath string
+
+	allowlistMu sync.RWMutex
+	allowlist   PeerAllowlist
 }
 
+// SetAllowlist replaces the allowlist of the listener, it applies to the
+// connections accepted from now on.
+func (u *UnixListener) SetAllowlist(a PeerAllowlist) {
+	u.allowlistMu.Lock()
+	defer u.allowlistMu.Unlock()
+	u.allowlist = a
+}
+
+// Accept waits for and returns the next connection coming from a process
+// allowed by the listener's allowlist. Connections coming from other
+// processes are closed.
 func (u *UnixListener) Accept() (net.Conn, error) {
-	return u.sock.Accept()
+	for {
+		conn, err := u.sock.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		u.allowlistMu.RLock()
+		allowlist := u.allowlist
+		u.allowlistMu.RUnlock()
+		if allowlist.Empty() {
+			return conn, nil
+		}
+
+		cred, err := peerCredentials(conn)
+		if err != nil {
+			DiagnosticsLog.Printf("Rejected connection: couldn't get peer credentials: %s\n", err)
+			conn.Close()
+			continue
+		}
+
+		allowed, err := allowlist.Allows(u.c, cred)
+		if err != nil {
+			DiagnosticsLog.Printf("Rejected connection from PID %d (UID %d, GID %d): %s\n", cred.Pid, cred.Uid, cred.Gid, err)
+			conn.Close()
+			continue
+		}
+		if !allowed {
+			DiagnosticsLog.Printf("Rejected connection from PID %d (UID %d, GID %d): not in allowlist\n", cred.Pid, cred.Uid, cred.Gid)
+			conn.Close()
+			continue
+		}
+
+		return conn, nil
+	}
 }
 
 func (u *UnixListener) Close() error {
@@ -28,8 +159,8 @@ func (u *UnixListener) Close() error {
 		return err
 	}
 
-	u.c.Remove(path.Join(dockerPluginSockDir, dwgdSockName))
-	u.c.Remove(path.Join(dwgdRunDir, dwgdSockName))
+	u.c.Remove(u.pluginSockPath)
+	u.c.Remove(u.sockPath)
 
 	return nil
 }
@@ -38,20 +169,24 @@ func (u *UnixListener) Addr() net.Addr {
 	return u.sock.Addr()
 }
 
-func NewUnixListener(c commander) (net.Listener, error) {
+func NewUnixListener(c commander, cfg *Config) (net.Listener, error) {
 	if c == nil {
 		c = &execCommander{}
 	}
 
-	if err := c.MkdirAll(dwgdRunDir, 0777); err != nil {
+	if cfg.PluginMode {
+		return newManagedPluginListener(c, cfg)
+	}
+
+	if err := c.MkdirAll(cfg.RunDir, 0777); err != nil {
 		return nil, err
 	}
 
-	if err := c.MkdirAll(dockerPluginSockDir, 0755); err != nil {
+	if err := c.MkdirAll(cfg.PluginSockDir, 0755); err != nil {
 		return nil, err
 	}
 
-	fullDwgdSockPath := path.Join(dwgdRunDir, dwgdSockName)
+	fullDwgdSockPath := path.Join(cfg.RunDir, cfg.SockName())
 	listener, err := sockets.NewUnixSocket(fullDwgdSockPath, 0)
 	if err != nil {
 		return nil, err
@@ -60,14 +195,180 @@ func NewUnixListener(c commander) (net.Listener, error) {
 		return nil, err
 	}
 
-	dockerPluginSockPath := path.Join(dockerPluginSockDir, dwgdSockName)
+	dockerPluginSockPath := path.Join(cfg.PluginSockDir, cfg.SockName())
 	err = c.Symlink(fullDwgdSockPath, dockerPluginSockPath)
 	if err != nil {
 		return nil, err
 	}
 
 	return &UnixListener{
-		sock: listener,
-		c:    c,
+		sock:           listener,
+		c:              c,
+		allowlist:      cfg.PeerAllowlist,
+		sockPath:       fullDwgdSockPath,
+		pluginSockPath: dockerPluginSockPath,
+	}, nil
+}
+
+// newManagedPluginListener returns the listener used when running as a
+// docker managed plugin: the socket is created directly where docker
+// expects it and only the daemon that installed the plugin can reach it,
+// so there is no need for symlinks nor for a world writable socket.
+func newManagedPluginListener(c commander, cfg *Config) (net.Listener, error) {
+	if err := c.MkdirAll(cfg.PluginSockDir, 0755); err != nil {
+		return nil, err
+	}
+
+	sockPath := path.Join(cfg.PluginSockDir, cfg.SockName())
+	listener, err := sockets.NewUnixSocket(sockPath, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnixListener{
+		sock:           listener,
+		c:              c,
+		allowlist:      cfg.PeerAllowlist,
+		sockPath:       sockPath,
+		pluginSockPath: sockPath,
+	}, nil
+}
+
+// pluginTLSConfig is the TLS configuration of a docker plugin spec file.
+type pluginTLSConfig struct {
+	InsecureSkipVerify bool
+	CAFile             string `json:",omitempty"`
+	CertFile           string `json:",omitempty"`
+	KeyFile            string `json:",omitempty"`
+}
+
+// pluginSpec is the content of a docker plugin spec file, as described in
+// https://docs.docker.com/engine/extend/plugin_api/#json-specification
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *pluginTLSConfig `json:",omitempty"`
+}
+
+// newPluginSpec returns the spec file docker daemons need to reach
+// the TCP listener described by cfg of the plugin called name.
+func newPluginSpec(name string, cfg *TCPConfig) ([]byte, error) {
+	addr := cfg.SpecAddr
+	if addr == "" {
+		addr = cfg.Addr
+	}
+
+	spec := &pluginSpec{
+		Name: name,
+		Addr: "https://" + addr,
+		TLSConfig: &pluginTLSConfig{
+			InsecureSkipVerify: false,
+			CAFile:             cfg.SpecCAFile,
+			CertFile:           cfg.SpecCertFile,
+			KeyFile:            cfg.SpecKeyFile,
+		},
+	}
+	return json.MarshalIndent(spec, "", "  ")
+}
+
+// newServerTLSConfig returns a TLS configuration that requires clients
+// to present a certificate signed by the CA in cfg.
+func newServerTLSConfig(c commander, cfg *TCPConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.CAFile == "" {
+		return nil, fmt.Errorf("tcp listener requires a certificate, a key and a CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := c.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("couldn't parse CA certificates in %s", cfg.CAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// TCPListener is a listener that accepts connections over TCP from docker
+// daemons authenticated through mutual TLS.
+type TCPListener struct {
+	sock     net.Listener
+	c        commander
+	specPath string
+}
+
+func (t *TCPListener) Accept() (net.Conn, error) {
+	return t.sock.Accept()
+}
+
+func (t *TCPListener) Close() error {
+	err := t.sock.Close()
+	if err != nil {
+		return err
+	}
+
+	if t.specPath != "" {
+		t.c.Remove(t.specPath)
+	}
+
+	return nil
+}
+
+func (t *TCPListener) Addr() net.Addr {
+	return t.sock.Addr()
+}
+
+func NewTCPListener(c commander, dwgdCfg *Config) (net.Listener, error) {
+	if c == nil {
+		c = &execCommander{}
+	}
+	cfg := &dwgdCfg.TCP
+
+	tlsConfig, err := newServerTLSConfig(c, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := tls.Listen("tcp", cfg.Addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	specPath := ""
+	if cfg.SpecDir != "" {
+		spec, err := newPluginSpec(dwgdCfg.PluginName(), cfg)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		if err := c.MkdirAll(cfg.SpecDir, 0755); err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		specPath = path.Join(cfg.SpecDir, dwgdCfg.PluginName()+".json")
+		if err := c.WriteFile(specPath, spec, 0644); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		TraceLog.Printf("Written plugin spec file at %s\n", specPath)
+	}
+
+	return &TCPListener{
+		sock:     listener,
+		c:        c,
+		specPath: specPath,
 	}, nil
 }
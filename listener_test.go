@@ -0,0 +1,146 @@
+package dwgd
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPeerAllowlist(t *testing.T) {
+	tc := CommanderFixture()
+	tc.ReadFileFunc = func(name string) ([]byte, error) {
+		switch name {
+		case "/proc/100/cgroup":
+			return []byte("0::/system.slice/docker.service\n"), nil
+		case "/proc/200/cgroup":
+			return []byte("12:pids:/user.slice/user-1000.slice\n0::/user.slice/user-1000.slice/user@1000.service/app.slice/docker.service\n"), nil
+		}
+		return []byte("0::/system.slice/other.service\n"), nil
+	}
+
+	allowlist := &PeerAllowlist{
+		Uids:    []uint32{0},
+		Gids:    []uint32{999},
+		Cgroups: []string{"/system.slice/docker.service", "/user.slice/user-1000.slice/user@1000.service/app.slice/"},
+	}
+
+	tests := []struct {
+		name    string
+		cred    syscall.Ucred
+		allowed bool
+	}{
+		{"uid", syscall.Ucred{Pid: 1, Uid: 0, Gid: 1}, true},
+		{"gid", syscall.Ucred{Pid: 1, Uid: 1, Gid: 999}, true},
+		{"cgroup", syscall.Ucred{Pid: 100, Uid: 1, Gid: 1}, true},
+		{"descendant cgroup", syscall.Ucred{Pid: 200, Uid: 1000, Gid: 1000}, true},
+		{"not allowed", syscall.Ucred{Pid: 300, Uid: 1001, Gid: 1001}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := allowlist.Allows(tc, &tt.cred)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != tt.allowed {
+				t.Fatalf("mismatch: %t != %t", allowed, tt.allowed)
+			}
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		allowed, err := (&PeerAllowlist{}).Allows(tc, &syscall.Ucred{Pid: 300, Uid: 1001, Gid: 1001})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed {
+			t.Fatal("expected empty allowlist to allow every process")
+		}
+	})
+}
+
+func TestUnixListener_SetAllowlist(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "dwgd.sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &UnixListener{sock: sock, c: CommanderFixture(), sockPath: sockPath, pluginSockPath: sockPath}
+	defer u.Close()
+
+	// only another user is allowed at first
+	u.SetAllowlist(PeerAllowlist{Uids: []uint32{uint32(os.Getuid()) + 1}})
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := u.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() bool {
+		conn, err := net.Dial("unix", sockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		select {
+		case c := <-accepted:
+			c.Close()
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	if dial() {
+		t.Fatal("expected connection to be rejected")
+	}
+	u.SetAllowlist(PeerAllowlist{Uids: []uint32{uint32(os.Getuid())}})
+	if !dial() {
+		t.Fatal("expected connection to be accepted")
+	}
+}
+
+func TestNewPluginSpec(t *testing.T) {
+	cfg := &TCPConfig{
+		Addr:         "0.0.0.0:9443",
+		SpecAddr:     "192.168.122.1:9443",
+		SpecCAFile:   "/etc/dwgd/ca.pem",
+		SpecCertFile: "/etc/dwgd/docker.pem",
+		SpecKeyFile:  "/etc/dwgd/docker-key.pem",
+	}
+
+	data, err := newPluginSpec("dwgd", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &pluginSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &pluginSpec{
+		Name: "dwgd",
+		Addr: "https://192.168.122.1:9443",
+		TLSConfig: &pluginTLSConfig{
+			CAFile:   "/etc/dwgd/ca.pem",
+			CertFile: "/etc/dwgd/docker.pem",
+			KeyFile:  "/etc/dwgd/docker-key.pem",
+		},
+	}
+	if !cmp.Equal(spec, expected) {
+		t.Fatalf("mismatch: %#v != %#v", spec, expected)
+	}
+}
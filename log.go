@@ -1,23 +1,287 @@
 package dwgd
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	redacted = "[REDACTED]"
 )
 
 // Used for everything that can be considered a "result"
 // and should be printed to standard output
 var EventsLog = log.New(os.Stdout, "", log.Lmsgprefix)
 
+// Logger is the structured logger of dwgd, its records are written to
+// standard error as text or JSON, see ConfigureLogging.
+var Logger = slog.New(logHandler)
+
 // Used for messages that can give the user a context of
-// what the software is doing
-var DiagnosticsLog = log.New(os.Stderr, "", log.LstdFlags|log.LUTC)
+// what the software is doing, logged at the info level.
+var DiagnosticsLog = slog.NewLogLogger(logHandler, slog.LevelInfo)
+
+// Used for very detailed messages, logged at the debug level,
+// should not be enabled in a production environment.
+var TraceLog = slog.NewLogLogger(logHandler, slog.LevelDebug)
+
+var (
+	logLevel   = new(slog.LevelVar)
+	logHandler = &switchHandler{}
+)
+
+func init() {
+	logHandler.set(newLogHandler(os.Stderr, LogFormatText))
+}
+
+// switchHandler is a slog.Handler whose destination can be replaced while
+// loggers using it are around, e.g. to change the output format.
+type switchHandler struct {
+	mu sync.RWMutex
+	h  slog.Handler
+}
+
+func (s *switchHandler) set(h slog.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.h = h
+}
+
+func (s *switchHandler) get() slog.Handler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h
+}
+
+func (s *switchHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.get().Enabled(ctx, level)
+}
+
+func (s *switchHandler) Handle(ctx context.Context, r slog.Record) error {
+	return s.get().Handle(ctx, r)
+}
+
+func (s *switchHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &boundHandler{parent: s, attrs: attrs}
+}
+
+func (s *switchHandler) WithGroup(name string) slog.Handler {
+	return &boundHandler{parent: s, group: name}
+}
+
+// boundHandler adds attributes or a group to the records handled by a
+// switchHandler, following its changes of destination.
+type boundHandler struct {
+	parent slog.Handler
+	attrs  []slog.Attr
+	group  string
+}
+
+func (b *boundHandler) resolve() slog.Handler {
+	var h slog.Handler
+	switch p := b.parent.(type) {
+	case *switchHandler:
+		h = p.get()
+	case *boundHandler:
+		h = p.resolve()
+	}
+	if b.group != "" {
+		return h.WithGroup(b.group)
+	}
+	return h.WithAttrs(b.attrs)
+}
+
+func (b *boundHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return b.resolve().Enabled(ctx, level)
+}
+
+func (b *boundHandler) Handle(ctx context.Context, r slog.Record) error {
+	return b.resolve().Handle(ctx, r)
+}
+
+func (b *boundHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &boundHandler{parent: b, attrs: attrs}
+}
+
+func (b *boundHandler) WithGroup(name string) slog.Handler {
+	return &boundHandler{parent: b, group: name}
+}
+
+// newLogHandler returns a handler writing records to w in the given format,
+// with secrets redacted.
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.TimeValue(a.Value.Time().UTC())
+			}
+			if isSecretKey(a.Key) {
+				a.Value = slog.StringValue(redacted)
+			}
+			return a
+		},
+	}
+	if format == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// parseLogLevel returns the slog level called name.
+func parseLogLevel(name string) (slog.Level, error) {
+	switch name {
+	case LogLevelDebug:
+		return slog.LevelDebug, nil
+	case LogLevelInfo:
+		return slog.LevelInfo, nil
+	case LogLevelWarn:
+		return slog.LevelWarn, nil
+	case LogLevelError:
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q", name)
+}
+
+// ConfigureLogging sets the minimum level of the logged records and the
+// format they are written to w in, text or JSON.
+func ConfigureLogging(w io.Writer, level string, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	logLevel.Set(l)
+	logHandler.set(newLogHandler(w, format))
+	return nil
+}
+
+// SetLogPrefix adds the name of the instance to the logged records, used to
+// tell apart the logs of multiple instances running on the same host. The
+// loggers are rebuilt from logHandler, so the name replaces the previous one.
+func SetLogPrefix(prefix string) {
+	var h slog.Handler = logHandler
+	if prefix != "" {
+		h = h.WithAttrs([]slog.Attr{slog.String("instance", prefix)})
+	}
+	Logger = slog.New(h)
+	DiagnosticsLog = slog.NewLogLogger(h, slog.LevelInfo)
+	TraceLog = slog.NewLogLogger(h, slog.LevelDebug)
+}
+
+// newRequestID returns a random ID identifying the records logged while
+// handling a request.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// A request is the logger of a request of docker, remembering when it
+// started for the request metrics.
+type request struct {
+	*slog.Logger
+	method string
+	start  time.Time
+}
+
+// requestLogger returns the logger of a request of docker for the given
+// network and endpoint, which can be empty, logging the request itself.
+func requestLogger(method string, networkID string, endpointID string, r interface{}) *request {
+	attrs := []any{"request_id", newRequestID(), "method", method}
+	if networkID != "" {
+		attrs = append(attrs, "network_id", networkID)
+	}
+	if endpointID != "" {
+		attrs = append(attrs, "endpoint_id", endpointID)
+	}
+	l := Logger.With(attrs...)
+	l.Debug(method, "request", Jsonify(r))
+	return &request{Logger: l, method: method, start: time.Now()}
+}
+
+// logResult logs the outcome of a request and records it in the request
+// metrics, given the address of the error it returned, nil if the request
+// can't fail.
+func logResult(r *request, err *error) {
+	failed := err != nil && *err != nil
+	requestMetrics.observe(r.method, time.Since(r.start), failed)
+	if failed {
+		r.Error("Request failed", "error", *err)
+		return
+	}
+	r.Debug("Request succeeded")
+}
+
+// isSecretKey reports whether values under the given key are secrets:
+// seeds, private keys, preshared keys and the like.
+func isSecretKey(key string) bool {
+	k := strings.ToLower(key)
+	for _, secret := range []string{"seed", "privkey", "privatekey", "private_key", "psk", "presharedkey", "preshared_key", "secret"} {
+		if strings.Contains(k, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecrets replaces the secrets in the decoded JSON value v.
+func redactSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if isSecretKey(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactSecrets(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactSecrets(e)
+		}
+	}
+	return v
+}
 
-// Used for very detailed messages, should not be used
-// in a production environment.
-// Disabled by default.
-var TraceLog = log.New(&EmptyWriter{}, "", log.LstdFlags|log.LUTC)
+// logEvent writes an event to EventsLog as a line of key=value pairs, the
+// first being event=name. attrs holds pairs of keys and values.
+func logEvent(name string, attrs ...string) {
+	var b strings.Builder
+	b.WriteString("event=" + name)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		v := attrs[i+1]
+		if v == "" || strings.ContainsAny(v, " \"=\\") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(" " + attrs[i] + "=" + v)
+	}
+	EventsLog.Println(b.String())
+}
 
 type EmptyWriter struct{}
 
@@ -25,10 +289,21 @@ func (e *EmptyWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Jsonify returns the JSON encoding of data, for logging purposes: the
+// values of fields and keys holding secrets are redacted.
 func Jsonify(data interface{}) string {
 	j, err := json.Marshal(data)
 	if err != nil {
 		return ""
 	}
+
+	var v interface{}
+	if err := json.Unmarshal(j, &v); err != nil {
+		return ""
+	}
+	j, err = json.Marshal(redactSecrets(v))
+	if err != nil {
+		return ""
+	}
 	return string(j)
 }
@@ -0,0 +1,184 @@
+package dwgd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestJsonify(t *testing.T) {
+	n := NetworkFixture()
+	psk, _ := wgtypes.GenerateKey()
+	privkey := GeneratePrivateKey(n.seed, ClientFixture(n).ip)
+
+	values := []interface{}{
+		&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options: map[string]interface{}{
+				"com.docker.network.generic": map[string]interface{}{
+					"dwgd.seed":           string(n.seed),
+					"dwgd.webhook_secret": "s3cr3t",
+					"dwgd.pubkey":         n.pubkey.String(),
+				},
+			},
+		},
+		wgtypes.Config{
+			PrivateKey: privkey,
+			Peers:      []wgtypes.PeerConfig{{PublicKey: n.pubkey, PresharedKey: &psk}},
+		},
+	}
+	for _, v := range values {
+		j := Jsonify(v)
+		for _, secret := range []string{string(n.seed), "s3cr3t", privkey.String(), psk.String()} {
+			if strings.Contains(j, secret) {
+				t.Fatalf("secret %s not redacted: %s", secret, j)
+			}
+		}
+		if !strings.Contains(j, redacted) {
+			t.Fatalf("nothing redacted: %s", j)
+		}
+	}
+
+	if j := Jsonify(map[string]string{"dwgd.pubkey": "foo"}); j != `{"dwgd.pubkey":"foo"}` {
+		t.Fatalf("unexpected redaction: %s", j)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ConfigureLogging(&buf, LogLevelDebug, LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureLogging(os.Stderr, LogLevelInfo, LogFormatText)
+
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := NetworkFixture()
+	create := func() error {
+		return d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options: map[string]interface{}{
+				"com.docker.network.generic": map[string]interface{}{
+					"dwgd.seed":     string(n.seed),
+					"dwgd.endpoint": n.endpoint.String(),
+					"dwgd.pubkey":   n.pubkey.String(),
+				},
+			},
+		})
+	}
+	if err := create(); err != nil {
+		t.Fatal(err)
+	}
+	// the network already exists
+	if err := create(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if strings.Contains(buf.String(), string(n.seed)) {
+		t.Fatalf("seed not redacted: %s", buf.String())
+	}
+
+	requestIDs := make(map[string]bool)
+	failed := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %s", scanner.Text(), err)
+		}
+		if record["method"] != "CreateNetwork" {
+			continue
+		}
+		if record["network_id"] != n.id {
+			t.Fatalf("unexpected record: %v", record)
+		}
+		requestIDs[record["request_id"].(string)] = true
+		if record["level"] == "ERROR" {
+			failed++
+		}
+	}
+	if len(requestIDs) != 2 || failed != 1 {
+		t.Fatalf("unexpected records: %d requests, %d failed", len(requestIDs), failed)
+	}
+}
+
+func TestSetLogPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ConfigureLogging(&buf, LogLevelInfo, LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureLogging(os.Stderr, LogLevelInfo, LogFormatText)
+	defer SetLogPrefix("")
+
+	// the prefix replaces the previous one instead of being added again
+	SetLogPrefix("dwgd-a")
+	SetLogPrefix("dwgd-b")
+	Logger.Info("foo")
+	DiagnosticsLog.Print("bar")
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Count(line, `"instance"`) != 1 || !strings.Contains(line, `"instance":"dwgd-b"`) {
+			t.Fatalf("unexpected record: %s", line)
+		}
+	}
+}
+
+func TestRequestLogger_Helpers(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ConfigureLogging(&buf, LogLevelDebug, LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureLogging(os.Stderr, LogLevelInfo, LogFormatText)
+
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := MustCreateNetwork(t, d, true)
+	c := MustCreateEndpoint(t, d)
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records logged by the helpers carry the attributes of the request
+	// they are serving
+	expected := map[string]map[string]interface{}{
+		"Using WireGuard server interface": {"method": "CreateNetwork", "network_id": n.id},
+		"Updating configuration":           {"method": "Join", "network_id": n.id, "endpoint_id": c.id},
+	}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %s", scanner.Text(), err)
+		}
+		attrs, ok := expected[record["msg"].(string)]
+		if !ok {
+			continue
+		}
+		if record["request_id"] == nil {
+			t.Fatalf("record without request ID: %v", record)
+		}
+		for k, v := range attrs {
+			if record[k] != v {
+				t.Fatalf("unexpected %s in record: %v", k, record)
+			}
+		}
+		delete(expected, record["msg"].(string))
+	}
+	if len(expected) != 0 {
+		t.Fatalf("records not logged: %v", expected)
+	}
+}
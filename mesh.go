@@ -0,0 +1,316 @@
+package dwgd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MeshLocal makes the clients of a network living on the same host peer
+// with each other directly, instead of going through the network peer.
+const MeshLocal = "local"
+
+// pickListenPort brings the interface up so that WireGuard binds a free port
+// itself, and returns it. The interface is brought down again before
+// returning, since docker expects it down to move it, and WireGuard binds
+// the same port again once it's up in the sandbox.
+func (d *Driver) pickListenPort(ifname string) (port int, err error) {
+	if err := d.c.Run("ip", "link", "set", "up", "dev", ifname); err != nil {
+		return 0, err
+	}
+	defer func() {
+		err = errors.Join(err, d.c.Run("ip", "link", "set", "down", "dev", ifname))
+	}()
+
+	dev, err := d.wgc.Device(ifname)
+	if err != nil {
+		return 0, err
+	}
+	if dev.ListenPort == 0 {
+		return 0, fmt.Errorf("no listen port bound by %s", ifname)
+	}
+	return dev.ListenPort, nil
+}
+
+// MeshPeerConfig returns the configuration of c as a direct peer of the
+// other clients of its network.
+//
+// Client interfaces are created in dwgd's namespace, so their sockets stay
+// there even after the interface is moved to the sandbox: other clients
+// reach them on the loopback interface.
+func (c *Client) MeshPeerConfig() wgtypes.PeerConfig {
+	peer := c.PeerConfig()
+	peer.PersistentKeepaliveInterval = nil
+	peer.Endpoint = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.listenPort}
+	return peer
+}
+
+// meshPeers returns the clients of c's network that are currently joined
+// to a sandbox, except c itself.
+func (d *Driver) meshPeers(c *Client) ([]*Client, error) {
+	clients, err := d.s.ListClients(c.network.id)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]*Client, 0, len(clients))
+	for _, other := range clients {
+		if other.id == c.id || other.netns == "" {
+			continue
+		}
+		peers = append(peers, other)
+	}
+	return peers, nil
+}
+
+// clientDevice returns the interface of c inside its sandbox. The interface
+// gets renamed when it's moved there, so it is looked up by public key.
+func (d *Driver) clientDevice(c *Client) (*wgtypes.Device, error) {
+	devices, err := d.wgcFor(c.netns).Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey := c.PrivateKey().PublicKey()
+	for _, dev := range devices {
+		if dev.PublicKey == pubkey {
+			return dev, nil
+		}
+	}
+	return nil, fmt.Errorf("interface of EndpointID %s not found in %s", c.id, c.netns)
+}
+
+// updateMeshPeers adds peer to the interfaces of the given clients, or
+// removes it if remove is set. Clients whose interface can't be updated are
+// skipped, since they may be going away themselves.
+func (d *Driver) updateMeshPeers(l *slog.Logger, clients []*Client, peer wgtypes.PeerConfig, remove bool) {
+	peer.Remove = remove
+	for _, other := range clients {
+		dev, err := d.clientDevice(other)
+		if err == nil {
+			l.Debug("Updating mesh peers", "ifname", dev.Name, "netns", other.netns)
+			err = d.wgcFor(other.netns).ConfigureDevice(dev.Name, wgtypes.Config{
+				Peers: []wgtypes.PeerConfig{peer},
+			})
+		}
+		if err != nil {
+			l.Info("Couldn't update mesh peers", "peer_endpoint_id", other.id, "error", err)
+		}
+	}
+}
+
+// MeshGlobal extends MeshLocal to the clients of the network living on
+// other hosts, which are learnt through the shared store.
+const MeshGlobal = "global"
+
+// meshTTLIntervals is the number of sync intervals a mesh record outlives
+// its last refresh. Records are refreshed on every sync, so the ones of a
+// host that crashed or lost the store expire after a few missed syncs.
+const meshTTLIntervals = 3
+
+// A meshRecord describes a client of a global mesh network in the shared
+// store, so that the other hosts can add it as a peer.
+type meshRecord struct {
+	Host      string `json:"host"`
+	IP        string `json:"ip"`
+	PublicKey string `json:"public_key"`
+	Endpoint  string `json:"endpoint"`
+	Expires   int64  `json:"expires"` // unix time after which the record is ignored
+}
+
+func (r *meshRecord) peerConfig() (wgtypes.PeerConfig, error) {
+	pubkey, err := wgtypes.ParseKey(r.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", r.Endpoint)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
+	ip := net.ParseIP(r.IP)
+	if ip == nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("invalid IP %q", r.IP)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return wgtypes.PeerConfig{
+		PublicKey:         pubkey,
+		Endpoint:          endpoint,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        []net.IPNet{{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}},
+	}, nil
+}
+
+// meshPrefix returns the prefix of the keys of the clients of the network
+// with the given id in the shared store.
+func (d *Driver) meshPrefix(networkID string) string {
+	return d.storePrefix + "networks/" + networkID + "/peers/"
+}
+
+// publishMeshPeer records c in the shared store, or refreshes its record.
+func (d *Driver) publishMeshPeer(c *Client) error {
+	record := &meshRecord{
+		Host:      d.advertiseAddr,
+		IP:        c.ip.String(),
+		PublicKey: c.PrivateKey().PublicKey().String(),
+		Endpoint:  net.JoinHostPort(d.advertiseAddr, fmt.Sprint(c.listenPort)),
+		Expires:   time.Now().Add(d.meshTTL).Unix(),
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return d.store.Put(d.meshPrefix(c.network.id)+c.id, value)
+}
+
+// unpublishMeshPeer removes c from the shared store.
+func (d *Driver) unpublishMeshPeer(c *Client) error {
+	return d.store.Delete(d.meshPrefix(c.network.id) + c.id)
+}
+
+// remoteMeshPeers returns the clients of n living on other hosts.
+// Expired records are skipped, and deleted once they have been expired for
+// a whole TTL, so that a host coming back late doesn't lose its clients.
+func (d *Driver) remoteMeshPeers(l *slog.Logger, n *Network) ([]wgtypes.PeerConfig, error) {
+	data, err := d.store.List(d.meshPrefix(n.id))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	peers := make([]wgtypes.PeerConfig, 0, len(data))
+	for _, key := range sortedKeys(data) {
+		record := &meshRecord{}
+		if err := json.Unmarshal(data[key], record); err != nil {
+			l.Info("Ignoring invalid mesh record", "key", key, "error", err)
+			continue
+		}
+		if record.Host == d.advertiseAddr {
+			continue
+		}
+		if expires := time.Unix(record.Expires, 0); now.After(expires) {
+			if now.After(expires.Add(d.meshTTL)) {
+				l.Debug("Deleting expired mesh record", "key", key, "host", record.Host)
+				if err := d.store.Delete(key); err != nil {
+					l.Info("Couldn't delete expired mesh record", "key", key, "error", err)
+				}
+			}
+			continue
+		}
+		peer, err := record.peerConfig()
+		if err != nil {
+			l.Info("Ignoring invalid mesh record", "key", key, "error", err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// SyncGlobalMesh brings the peers of the local clients of global mesh
+// networks in line with the shared store: clients that appeared on other
+// hosts are added and the ones that went away, or whose records expired,
+// are removed. The records of the local clients are refreshed.
+func (d *Driver) SyncGlobalMesh() error {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range networks {
+		if n.mesh != MeshGlobal {
+			continue
+		}
+		if err := d.syncNetworkMesh(n); err != nil {
+			Logger.With("network_id", n.id).Info("Couldn't sync mesh", "error", err)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) syncNetworkMesh(n *Network) error {
+	l := Logger.With("network_id", n.id)
+	clients, err := d.s.ListClients(n.id)
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		if c.netns == "" {
+			continue
+		}
+		if err := d.publishMeshPeer(c); err != nil {
+			l.With("endpoint_id", c.id).Info("Couldn't refresh mesh record", "error", err)
+		}
+	}
+
+	remote, err := d.remoteMeshPeers(l, n)
+	if err != nil {
+		return err
+	}
+
+	known := map[wgtypes.Key]bool{n.pubkey: true}
+	for _, peer := range remote {
+		known[peer.PublicKey] = true
+	}
+	for _, c := range clients {
+		known[c.PrivateKey().PublicKey()] = true
+	}
+
+	for _, c := range clients {
+		if c.netns == "" {
+			continue
+		}
+		dev, err := d.clientDevice(c)
+		if err != nil {
+			l.With("endpoint_id", c.id).Info("Couldn't sync mesh peers", "error", err)
+			continue
+		}
+
+		peers := append([]wgtypes.PeerConfig(nil), remote...)
+		for _, p := range dev.Peers {
+			if !known[p.PublicKey] {
+				peers = append(peers, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+			}
+		}
+
+		err = d.wgcFor(c.netns).ConfigureDevice(dev.Name, wgtypes.Config{Peers: peers})
+		if err != nil {
+			l.With("endpoint_id", c.id).Info("Couldn't sync mesh peers", "error", err)
+		}
+	}
+	return nil
+}
+
+// triggerMeshSync asks the mesh sync loop to run as soon as possible.
+func (d *Driver) triggerMeshSync() {
+	select {
+	case d.meshSyncCh <- struct{}{}:
+	default:
+	}
+}
+
+// runMeshSync syncs global mesh networks every interval, or when triggered,
+// until stop is closed.
+func (d *Driver) runMeshSync(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-d.meshSyncCh:
+		}
+		if err := d.SyncGlobalMesh(); err != nil {
+			Logger.Info("Couldn't sync global mesh", "error", err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package dwgd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// requestDurationBuckets are the upper bounds of the buckets of the request
+// duration histograms, in seconds.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestMetrics records the requests of docker handled by every Driver
+// of the process.
+var requestMetrics = &requestStats{methods: make(map[string]*methodStats)}
+
+type methodStats struct {
+	count   uint64
+	errors  uint64
+	sum     float64  // total duration in seconds
+	buckets []uint64 // cumulative counts of requestDurationBuckets
+}
+
+type requestStats struct {
+	mu      sync.Mutex
+	methods map[string]*methodStats
+}
+
+// observe records a request to method that took d, and whether it failed.
+func (r *requestStats) observe(method string, d time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.methods[method]
+	if !ok {
+		m = &methodStats{buckets: make([]uint64, len(requestDurationBuckets))}
+		r.methods[method] = m
+	}
+	m.count++
+	if failed {
+		m.errors++
+	}
+	m.sum += d.Seconds()
+	for i, le := range requestDurationBuckets {
+		if d.Seconds() <= le {
+			m.buckets[i]++
+		}
+	}
+}
+
+// snapshot returns a copy of the stats of every method, sorted by name.
+func (r *requestStats) snapshot() ([]string, map[string]methodStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.methods))
+	stats := make(map[string]methodStats, len(r.methods))
+	for name, m := range r.methods {
+		names = append(names, name)
+		s := *m
+		s.buckets = append([]uint64(nil), m.buckets...)
+		stats[name] = s
+	}
+	sort.Strings(names)
+	return names, stats
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format,
+// remembering the first error.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (m *metricsWriter) printf(format string, a ...interface{}) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, a...)
+	}
+}
+
+// header writes the HELP and TYPE lines of the metric called name.
+func (m *metricsWriter) header(name string, typ string, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the metric called name, labels holds pairs of
+// label names and values.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+	}
+	if b.Len() > 0 {
+		m.printf("%s{%s} %s\n", name, b.String(), formatMetricValue(value))
+	} else {
+		m.printf("%s %s\n", name, formatMetricValue(value))
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeRequestMetrics writes the request counts and durations.
+func writeRequestMetrics(m *metricsWriter) {
+	names, stats := requestMetrics.snapshot()
+
+	m.header("dwgd_requests_total", "counter", "Requests of docker handled by the driver.")
+	for _, name := range names {
+		m.sample("dwgd_requests_total", float64(stats[name].count), "method", name)
+	}
+
+	m.header("dwgd_request_errors_total", "counter", "Requests of docker the driver failed to handle.")
+	for _, name := range names {
+		m.sample("dwgd_request_errors_total", float64(stats[name].errors), "method", name)
+	}
+
+	m.header("dwgd_request_duration_seconds", "histogram", "Time taken to handle the requests of docker.")
+	for _, name := range names {
+		s := stats[name]
+		for i, le := range requestDurationBuckets {
+			m.sample("dwgd_request_duration_seconds_bucket", float64(s.buckets[i]), "method", name, "le", formatMetricValue(le))
+		}
+		m.sample("dwgd_request_duration_seconds_bucket", float64(s.count), "method", name, "le", "+Inf")
+		m.sample("dwgd_request_duration_seconds_sum", s.sum, "method", name)
+		m.sample("dwgd_request_duration_seconds_count", float64(s.count), "method", name)
+	}
+}
+
+// WriteMetrics writes the metrics of d to w in the Prometheus text
+// exposition format: the number of networks and endpoints, the traffic and
+// handshakes of the endpoint interfaces and the requests of docker.
+func (d *Driver) WriteMetrics(w io.Writer) error {
+	networks, clients, joined, err := d.s.Counts()
+	if err != nil {
+		return err
+	}
+	devices, err := d.Devices()
+	if err != nil {
+		return err
+	}
+
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+	m.header("dwgd_networks", "gauge", "Networks managed by the driver.")
+	m.sample("dwgd_networks", float64(networks))
+	m.header("dwgd_endpoints", "gauge", "Endpoints of the networks managed by the driver.")
+	m.sample("dwgd_endpoints", float64(clients))
+	m.header("dwgd_endpoints_joined", "gauge", "Endpoints joined to a sandbox.")
+	m.sample("dwgd_endpoints_joined", float64(joined))
+
+	endpoints := make([]DeviceInfo, 0, len(devices))
+	for _, dev := range devices {
+		if dev.EndpointID != "" && dev.Error == "" {
+			endpoints = append(endpoints, dev)
+		}
+	}
+
+	now := time.Now()
+	m.header("dwgd_endpoint_receive_bytes_total", "counter", "Bytes received by the interface of the endpoint.")
+	for _, dev := range endpoints {
+		_, rx, _ := deviceStats(&dev)
+		m.sample("dwgd_endpoint_receive_bytes_total", float64(rx), "network_id", dev.NetworkID, "endpoint_id", dev.EndpointID)
+	}
+	m.header("dwgd_endpoint_transmit_bytes_total", "counter", "Bytes sent by the interface of the endpoint.")
+	for _, dev := range endpoints {
+		_, _, tx := deviceStats(&dev)
+		m.sample("dwgd_endpoint_transmit_bytes_total", float64(tx), "network_id", dev.NetworkID, "endpoint_id", dev.EndpointID)
+	}
+	m.header("dwgd_endpoint_last_handshake_seconds", "gauge", "Seconds since the last handshake of the interface of the endpoint, +Inf if none happened.")
+	for _, dev := range endpoints {
+		handshake, _, _ := deviceStats(&dev)
+		age := math.Inf(1)
+		if !handshake.IsZero() {
+			age = now.Sub(handshake).Seconds()
+		}
+		m.sample("dwgd_endpoint_last_handshake_seconds", age, "network_id", dev.NetworkID, "endpoint_id", dev.EndpointID)
+	}
+
+	d.healthMu.Lock()
+	ids := make([]string, 0, len(d.tunnels))
+	tunnels := make(map[string]tunnelHealth, len(d.tunnels))
+	for id, t := range d.tunnels {
+		ids = append(ids, id)
+		tunnels[id] = *t
+	}
+	staleEvents := d.staleEvents
+	d.healthMu.Unlock()
+	sort.Strings(ids)
+
+	m.header("dwgd_endpoint_stale", "gauge", "Whether the tunnel of the endpoint had no handshakes for longer than the threshold of its network.")
+	for _, id := range ids {
+		stale := 0.0
+		if tunnels[id].stale {
+			stale = 1
+		}
+		m.sample("dwgd_endpoint_stale", stale, "network_id", tunnels[id].networkID, "endpoint_id", id)
+	}
+	m.header("dwgd_endpoint_stale_events_total", "counter", "Tunnels of endpoints that went stale.")
+	m.sample("dwgd_endpoint_stale_events_total", float64(staleEvents))
+
+	writeRequestMetrics(m)
+	if m.err != nil {
+		return m.err
+	}
+	return m.w.Flush()
+}
+
+func (d *Driver) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	var b bytes.Buffer
+	if err := d.WriteMetrics(&b); err != nil {
+		DiagnosticsLog.Printf("Couldn't collect metrics: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// MetricsServer serves the metrics of the driver in the Prometheus format.
+type MetricsServer struct {
+	srv  *http.Server
+	sock net.Listener
+}
+
+func NewMetricsServer(cfg *Config, d *Driver) (*MetricsServer, error) {
+	sock, err := net.Listen("tcp", cfg.MetricsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, d.handleMetrics)
+	return &MetricsServer{
+		srv:  &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		sock: sock,
+	}, nil
+}
+
+func (m *MetricsServer) Addr() net.Addr {
+	return m.sock.Addr()
+}
+
+func (m *MetricsServer) Start() error {
+	err := m.srv.Serve(m.sock)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (m *MetricsServer) Stop() error {
+	return m.srv.Close()
+}
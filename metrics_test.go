@@ -0,0 +1,112 @@
+package dwgd
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDriver_WriteMetrics(t *testing.T) {
+	d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := MustCreateNetwork(t, d, true)
+	c := MustCreateEndpoint(t, d)
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: "unknown", SandboxKey: "/foo/bar"}); err == nil {
+		t.Fatal("expected error")
+	}
+	d.netnsWgc = func(path string) wgController {
+		sandboxWgc := WgControllerFixture()
+		sandboxWgc.DevicesFunc = func() ([]*wgtypes.Device, error) {
+			return []*wgtypes.Device{{
+				Name:      "wg0",
+				PublicKey: c.PrivateKey().PublicKey(),
+				Peers: []wgtypes.Peer{{
+					PublicKey:         n.pubkey,
+					LastHandshakeTime: time.Now().Add(-30 * time.Second),
+					ReceiveBytes:      1234,
+					TransmitBytes:     5678,
+				}},
+			}}, nil
+		}
+		return sandboxWgc
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(d.handleMetrics))
+	defer srv.Close()
+	res, err := srv.Client().Get(srv.URL + metricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	samples := make(map[string]string)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		samples[line[:i]] = line[i+1:]
+	}
+
+	expected := map[string]string{
+		"dwgd_networks":         "1",
+		"dwgd_endpoints":        "1",
+		"dwgd_endpoints_joined": "1",
+		`dwgd_endpoint_receive_bytes_total{network_id="n1",endpoint_id="c1"}`:  "1234",
+		`dwgd_endpoint_transmit_bytes_total{network_id="n1",endpoint_id="c1"}`: "5678",
+	}
+	for k, v := range expected {
+		if samples[k] != v {
+			t.Fatalf("expected %s %s, got %q", k, v, samples[k])
+		}
+	}
+	if age := samples[`dwgd_endpoint_last_handshake_seconds{network_id="n1",endpoint_id="c1"}`]; !strings.HasPrefix(age, "30") {
+		t.Fatalf("unexpected handshake age %q", age)
+	}
+	// the request metrics are shared by the drivers of the process
+	for _, k := range []string{
+		`dwgd_requests_total{method="Join"}`,
+		`dwgd_request_errors_total{method="Join"}`,
+		`dwgd_request_duration_seconds_bucket{method="Join",le="+Inf"}`,
+		`dwgd_request_duration_seconds_count{method="CreateNetwork"}`,
+	} {
+		if v, ok := samples[k]; !ok || v == "0" {
+			t.Fatalf("expected %s to be positive, got %q", k, v)
+		}
+	}
+}
+
+func TestMetricsWriter(t *testing.T) {
+	var b bytes.Buffer
+	m := &metricsWriter{w: bufio.NewWriter(&b)}
+	m.header("foo", "gauge", "Foo.")
+	m.sample("foo", 1.5, "a", `x"y\z`+"\n")
+	m.sample("foo", 0)
+	if err := m.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "# HELP foo Foo.\n# TYPE foo gauge\nfoo{a=\"x\\\"y\\\\z\\n\"} 1.5\nfoo 0\n"
+	if b.String() != expected {
+		t.Fatalf("mismatch: %q != %q", b.String(), expected)
+	}
+}
@@ -0,0 +1,2 @@
+ALTER TABLE network ADD COLUMN owner INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE client ADD COLUMN owner INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+ALTER TABLE network ADD COLUMN create_server BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE network ADD COLUMN privkey BLOB;
+ALTER TABLE network ADD COLUMN listen_port INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE network ADD COLUMN address TEXT NOT NULL DEFAULT '';
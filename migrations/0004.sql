@@ -0,0 +1 @@
+ALTER TABLE network ADD COLUMN ifname_netns TEXT NOT NULL DEFAULT '';
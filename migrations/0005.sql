@@ -0,0 +1,3 @@
+ALTER TABLE network ADD COLUMN mesh TEXT NOT NULL DEFAULT '';
+ALTER TABLE client ADD COLUMN netns TEXT NOT NULL DEFAULT '';
+ALTER TABLE client ADD COLUMN listen_port INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE network ADD COLUMN agent TEXT NOT NULL DEFAULT '';
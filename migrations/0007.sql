@@ -0,0 +1,2 @@
+ALTER TABLE network ADD COLUMN persist TEXT NOT NULL DEFAULT '';
+ALTER TABLE network ADD COLUMN persist_path TEXT NOT NULL DEFAULT '';
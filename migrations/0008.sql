@@ -0,0 +1,2 @@
+ALTER TABLE network ADD COLUMN provisioner TEXT NOT NULL DEFAULT '';
+ALTER TABLE network ADD COLUMN provisioner_options TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+ALTER TABLE network ADD COLUMN keymode TEXT NOT NULL DEFAULT '';
+ALTER TABLE network ADD COLUMN keydir TEXT NOT NULL DEFAULT '';
+ALTER TABLE client ADD COLUMN keyfile TEXT NOT NULL DEFAULT '';
+ALTER TABLE client ADD COLUMN privkey BLOB;
+CREATE UNIQUE INDEX client_keyfile ON client(network_id, keyfile) WHERE keyfile != '';
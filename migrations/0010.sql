@@ -0,0 +1,4 @@
+ALTER TABLE network ADD COLUMN allowed_ips TEXT NOT NULL DEFAULT '';
+ALTER TABLE network ADD COLUMN preshared_key BLOB;
+ALTER TABLE network ADD COLUMN keepalive INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE network ADD COLUMN mtu INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE network ADD COLUMN profile TEXT NOT NULL DEFAULT '';
+ALTER TABLE network ADD COLUMN profile_version TEXT NOT NULL DEFAULT '';
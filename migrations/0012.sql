@@ -0,0 +1 @@
+ALTER TABLE network ADD COLUMN stale_after INTEGER NOT NULL DEFAULT 0;
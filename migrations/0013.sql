@@ -0,0 +1,2 @@
+ALTER TABLE network ADD COLUMN wait_handshake INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE network ADD COLUMN wait_handshake_policy TEXT NOT NULL DEFAULT '';
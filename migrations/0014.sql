@@ -0,0 +1,5 @@
+ALTER TABLE network ADD COLUMN provisioner_secrets TEXT NOT NULL DEFAULT '';
+UPDATE network SET provisioner_secrets = json_object('dwgd.webhook_secret', json_extract(provisioner_options, '$."dwgd.webhook_secret"'))
+	WHERE provisioner_options != '' AND json_extract(provisioner_options, '$."dwgd.webhook_secret"') IS NOT NULL;
+UPDATE network SET provisioner_options = json_remove(provisioner_options, '$."dwgd.seed"', '$."dwgd.webhook_secret"')
+	WHERE provisioner_options != '';
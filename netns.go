@@ -0,0 +1,133 @@
+package dwgd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// netnsDir is where ip netns keeps the named network namespaces.
+const netnsDir = "/run/netns"
+
+// namedNetnsPath returns the path of the named network namespace given by
+// dwgd.ifname_netns, either as its name or as its path in netnsDir. Other
+// paths are rejected, since dwgd would enter any namespace they point to.
+func namedNetnsPath(name string) (string, error) {
+	base := strings.TrimPrefix(name, netnsDir+"/")
+	if base == "" || base == "." || base == ".." || strings.Contains(base, "/") {
+		return "", fmt.Errorf("invalid dwgd.ifname_netns option: %q, expected a namespace in %s", name, netnsDir)
+	}
+	return filepath.Join(netnsDir, base), nil
+}
+
+// inNetns runs fn in the network namespace at path.
+//
+// The namespace of the current thread is switched for the whole execution
+// of fn, so the goroutine is locked to its thread. If the original namespace
+// can't be restored, the thread is not unlocked and the runtime will get
+// rid of it once the goroutine exits.
+func inNetns(path string, fn func() error) error {
+	runtime.LockOSThread()
+
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+
+	target, err := os.Open(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("couldn't enter network namespace %s: %w", path, err)
+	}
+
+	fnErr := fn()
+
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		DiagnosticsLog.Printf("Couldn't restore network namespace after entering %s: %s\n", path, err)
+		return fnErr
+	}
+	runtime.UnlockOSThread()
+
+	return fnErr
+}
+
+// netnsWgController is a wgController operating on the WireGuard devices
+// living in the network namespace at path.
+type netnsWgController struct {
+	path string
+}
+
+func newNetnsWgController(path string) wgController {
+	return &netnsWgController{path: path}
+}
+
+func (n *netnsWgController) Device(name string) (*wgtypes.Device, error) {
+	var dev *wgtypes.Device
+	err := inNetns(n.path, func() error {
+		wgc, err := wgctrl.New()
+		if err != nil {
+			return err
+		}
+		defer wgc.Close()
+
+		dev, err = wgc.Device(name)
+		return err
+	})
+	return dev, err
+}
+
+func (n *netnsWgController) Devices() ([]*wgtypes.Device, error) {
+	var devs []*wgtypes.Device
+	err := inNetns(n.path, func() error {
+		wgc, err := wgctrl.New()
+		if err != nil {
+			return err
+		}
+		defer wgc.Close()
+
+		devs, err = wgc.Devices()
+		return err
+	})
+	return devs, err
+}
+
+func (n *netnsWgController) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	return inNetns(n.path, func() error {
+		wgc, err := wgctrl.New()
+		if err != nil {
+			return err
+		}
+		defer wgc.Close()
+
+		return wgc.ConfigureDevice(name, cfg)
+	})
+}
+
+// wgcFor returns the wgController for the network namespace at netns, or
+// the one of dwgd's namespace if netns is empty.
+func (d *Driver) wgcFor(netns string) wgController {
+	if netns == "" {
+		return d.wgc
+	}
+	return d.netnsWgc(netns)
+}
+
+// runIn runs a command in the network namespace at netns, or in dwgd's
+// namespace if netns is empty.
+func (d *Driver) runIn(netns string, name string, arg ...string) error {
+	return runInNetns(d.c, netns, name, arg...)
+}
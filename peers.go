@@ -0,0 +1,148 @@
+package dwgd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	PeerFormatWg       = "wg"
+	PeerFormatWgQuick  = "wg-quick"
+	PeerFormatNetworkd = "networkd"
+	PeerFormatJSON     = "json"
+
+	// maxGeneratedPeers bounds the size of the subnets peers are generated
+	// for, a /16 at most.
+	maxGeneratedPeers = 1 << 16
+)
+
+// A GeneratedPeer is the configuration a remote WireGuard peer needs for
+// the container with the given IP.
+type GeneratedPeer struct {
+	IP           net.IP
+	PublicKey    wgtypes.Key
+	PresharedKey *wgtypes.Key
+	AllowedIPs   string
+}
+
+// jsonPeer is the JSON representation of a GeneratedPeer.
+type jsonPeer struct {
+	IP           string `json:"ip"`
+	PublicKey    string `json:"public_key"`
+	PresharedKey string `json:"preshared_key,omitempty"`
+	AllowedIPs   string `json:"allowed_ips"`
+}
+
+// GeneratePeers returns the peers of every host address of subnet, whose
+// keys are derived from seed as the driver does. The network and broadcast
+// addresses of IPv4 subnets are skipped. If psk is not nil, it's used as
+// the preshared key of every peer.
+func GeneratePeers(subnet string, seed []byte, psk *wgtypes.Key) ([]*GeneratedPeer, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipnet.IP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("subnet %s is not an IPv4 subnet", subnet)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	size := uint64(1) << (bits - ones)
+	if size > maxGeneratedPeers {
+		return nil, fmt.Errorf("subnet %s is too large, at most %d addresses are supported", subnet, maxGeneratedPeers)
+	}
+
+	first, last := uint64(0), size-1
+	if size > 2 {
+		first, last = 1, size-2
+	}
+
+	base := binary.BigEndian.Uint32(ip4)
+	peers := make([]*GeneratedPeer, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, net.IPv4zero)
+		binary.BigEndian.PutUint32(ip[12:], base+uint32(i))
+
+		peers = append(peers, &GeneratedPeer{
+			IP:           ip,
+			PublicKey:    GeneratePrivateKey(seed, ip).PublicKey(),
+			PresharedKey: psk,
+			AllowedIPs:   ip.String() + "/32",
+		})
+	}
+	return peers, nil
+}
+
+// WritePeers writes peers to w in the given format: [Peer] sections for
+// wg and wg-quick, [WireGuardPeer] sections for systemd-networkd, or a JSON
+// array.
+func WritePeers(w io.Writer, peers []*GeneratedPeer, format string) error {
+	switch format {
+	case PeerFormatJSON:
+		jsonPeers := make([]jsonPeer, 0, len(peers))
+		for _, p := range peers {
+			jp := jsonPeer{IP: p.IP.String(), PublicKey: p.PublicKey.String(), AllowedIPs: p.AllowedIPs}
+			if p.PresharedKey != nil {
+				jp.PresharedKey = p.PresharedKey.String()
+			}
+			jsonPeers = append(jsonPeers, jp)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jsonPeers)
+	case PeerFormatWg, PeerFormatWgQuick, PeerFormatNetworkd:
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	section, sep := "[Peer]", " = "
+	if format == PeerFormatNetworkd {
+		section, sep = "[WireGuardPeer]", "="
+	}
+
+	for _, p := range peers {
+		if format == PeerFormatWgQuick {
+			if _, err := fmt.Fprintf(w, "# %s\n", p.IP); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s\nPublicKey%s%s\n", section, sep, p.PublicKey); err != nil {
+			return err
+		}
+		if p.PresharedKey != nil {
+			if _, err := fmt.Fprintf(w, "PresharedKey%s%s\n", sep, p.PresharedKey); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "AllowedIPs%s%s\n\n", sep, p.AllowedIPs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NetworkSeed returns the seed of the network with the given id, read
+// from the database at db.
+func NetworkSeed(db string, id string) ([]byte, error) {
+	s := &Storage{}
+	if err := s.OpenReadOnly(db); err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	n, err := s.GetNetwork(id)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, fmt.Errorf("NetworkID %s not found", id)
+	}
+	return n.seed, nil
+}
@@ -0,0 +1,95 @@
+package dwgd
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestGeneratePeers(t *testing.T) {
+	peers, err := GeneratePeers("10.0.0.0/30", []byte("supersecretseed"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].AllowedIPs != "10.0.0.1/32" || peers[1].AllowedIPs != "10.0.0.2/32" {
+		t.Fatalf("unexpected peers: %#v", peers)
+	}
+
+	// keys match the ones of `dwgd pubkey` and of the driver
+	expected := GeneratePrivateKey([]byte("supersecretseed"), net.ParseIP("10.0.0.2")).PublicKey()
+	if peers[1].PublicKey != expected {
+		t.Fatalf("mismatch: %s != %s", peers[1].PublicKey, expected)
+	}
+
+	if _, err := GeneratePeers("10.0.0.0/8", []byte("supersecretseed"), nil); err == nil {
+		t.Fatal("expected error for a too large subnet")
+	}
+}
+
+func TestWritePeers(t *testing.T) {
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := GeneratePeers("10.0.0.2/32", []byte("supersecretseed"), &psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := peers[0].PublicKey.String()
+
+	tests := map[string]string{
+		PeerFormatWg:       "[Peer]\nPublicKey = " + pubkey + "\nPresharedKey = " + psk.String() + "\nAllowedIPs = 10.0.0.2/32\n\n",
+		PeerFormatWgQuick:  "# 10.0.0.2\n[Peer]\nPublicKey = " + pubkey + "\nPresharedKey = " + psk.String() + "\nAllowedIPs = 10.0.0.2/32\n\n",
+		PeerFormatNetworkd: "[WireGuardPeer]\nPublicKey=" + pubkey + "\nPresharedKey=" + psk.String() + "\nAllowedIPs=10.0.0.2/32\n\n",
+	}
+	for format, expected := range tests {
+		var buf bytes.Buffer
+		if err := WritePeers(&buf, peers, format); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Fatalf("mismatch for %s: %q != %q", format, buf.String(), expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WritePeers(&buf, peers, PeerFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"public_key": "`+pubkey+`"`) {
+		t.Fatalf("unexpected JSON output: %s", buf.String())
+	}
+
+	if err := WritePeers(&buf, peers, "yaml"); err == nil {
+		t.Fatal("expected error for an unknown format")
+	}
+}
+
+func TestNetworkSeed(t *testing.T) {
+	db := DbPathFixture()
+	s := &Storage{}
+	if err := s.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	n := NetworkFixture()
+	if err := s.AddNetwork(n); err != nil {
+		t.Fatal(err)
+	}
+
+	seed, err := NetworkSeed(db, n.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(seed) != string(n.seed) {
+		t.Fatalf("mismatch: %s != %s", seed, n.seed)
+	}
+
+	if _, err := NetworkSeed(db, "missing"); err == nil {
+		t.Fatal("expected error for a missing network")
+	}
+}
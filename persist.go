@@ -0,0 +1,285 @@
+package dwgd
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	PersistWgQuick  = "wg-quick"
+	PersistNetworkd = "networkd"
+)
+
+// Directories holding the wg-quick configurations and the systemd-networkd
+// drop-ins. dwgd.persist_path can only name files inside them.
+var (
+	wgQuickDir  = "/etc/wireguard"
+	networkdDir = "/etc/systemd/network"
+)
+
+// lockDir holds the lock files of the files dwgd writes in directories it
+// doesn't own. It doesn't depend on the run directory of the instance, so
+// that all the instances writing a file take the same lock.
+var lockDir = filepath.Join(defaultDwgdRunDir, "locks")
+
+// fileIn returns the path of the file given by option, either as its name
+// or as its path in dir. Other paths are rejected, since dwgd writes to the
+// file as root.
+func fileIn(dir string, option string, name string) (string, error) {
+	base := strings.TrimPrefix(name, dir+"/")
+	if base == "" || base == "." || base == ".." || strings.Contains(base, "/") {
+		return "", fmt.Errorf("invalid %s option: %q, expected a file in %s", option, name, dir)
+	}
+	return filepath.Join(dir, base), nil
+}
+
+// parsePersistOptions fills the fields of n describing where its peers are
+// persisted, which only makes sense in ifname mode.
+func parsePersistOptions(n *Network, m map[string]interface{}) error {
+	mode, ok := m["dwgd.persist"].(string)
+	if !ok {
+		return nil
+	}
+	if n.ifname == "" {
+		return fmt.Errorf("dwgd.persist requires the dwgd.ifname option")
+	}
+
+	n.persist = mode
+	name, _ := m["dwgd.persist_path"].(string)
+	var err error
+	switch mode {
+	case PersistWgQuick:
+		if name == "" {
+			name = n.ifname + ".conf"
+		}
+		if n.persistPath, err = fileIn(wgQuickDir, "dwgd.persist_path", name); err != nil {
+			return err
+		}
+		if _, err := os.Stat(n.persistPath); err != nil {
+			return fmt.Errorf("wg-quick configuration of %s: %w", n.ifname, err)
+		}
+	case PersistNetworkd:
+		if name == "" {
+			name = n.ifname + ".netdev.d"
+		}
+		if n.persistPath, err = fileIn(networkdDir, "dwgd.persist_path", name); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid dwgd.persist option: %q", mode)
+	}
+	return nil
+}
+
+// withFileLock runs fn while holding an exclusive lock on path, which is
+// created if missing. Files replaced through writeFileAtomic can't be
+// locked themselves, so a separate lock file is used.
+func withFileLock(path string, fn func() error) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(f.Fd()), unix.LOCK_UN)
+
+	return fn()
+}
+
+// withPathLock runs fn while holding an exclusive lock on path, through a
+// lock file in lockDir named after it rather than one next to path.
+func withPathLock(path string, fn func() error) error {
+	if err := os.MkdirAll(lockDir, 0700); err != nil {
+		return err
+	}
+	return withFileLock(filepath.Join(lockDir, url.PathEscape(path)+".lock"), fn)
+}
+
+// writeFileAtomic replaces the content of path with data, so that readers
+// either see the old content or the new one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func managedBlockMarkers(networkID string) (string, string) {
+	return "# BEGIN dwgd " + networkID, "# END dwgd " + networkID
+}
+
+// replaceManagedBlock returns conf with the block managed for the network
+// with the given id replaced by block, or removed if block is empty.
+func replaceManagedBlock(conf []byte, networkID string, block []byte) []byte {
+	begin, end := managedBlockMarkers(networkID)
+
+	var out bytes.Buffer
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(conf), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == begin:
+			inBlock = true
+		case trimmed == end:
+			inBlock = false
+		case !inBlock:
+			out.WriteString(line)
+		}
+	}
+
+	if len(block) == 0 {
+		return out.Bytes()
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteString("\n")
+	}
+	fmt.Fprintf(&out, "%s\n%s%s\n", begin, block, end)
+	return out.Bytes()
+}
+
+// joinedPeers returns the peers of the clients of n currently joined to a
+// sandbox.
+func (d *Driver) joinedPeers(n *Network) ([]*GeneratedPeer, []*Client, error) {
+	clients, err := d.s.ListClients(n.id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peers := make([]*GeneratedPeer, 0, len(clients))
+	joined := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		if c.netns == "" {
+			continue
+		}
+		peers = append(peers, &GeneratedPeer{
+			IP:         c.ip,
+			PublicKey:  c.PrivateKey().PublicKey(),
+			AllowedIPs: c.ip.String() + "/32",
+		})
+		joined = append(joined, c)
+	}
+	return peers, joined, nil
+}
+
+// persistPeers writes the peers of the clients of n currently joined to
+// a sandbox to the persistent configuration of its server interface, so
+// that they survive a restart of wg-quick or systemd-networkd.
+func (d *Driver) persistPeers(l *slog.Logger, n *Network) error {
+	switch n.persist {
+	case PersistWgQuick:
+		return d.persistWgQuick(l, n)
+	case PersistNetworkd:
+		return d.persistNetworkd(l, n)
+	}
+	return nil
+}
+
+// persistWgQuick regenerates the managed block of n in its wg-quick
+// configuration file.
+func (d *Driver) persistWgQuick(l *slog.Logger, n *Network) error {
+	peers, _, err := d.joinedPeers(n)
+	if err != nil {
+		return err
+	}
+
+	var block bytes.Buffer
+	if err := WritePeers(&block, peers, PeerFormatWgQuick); err != nil {
+		return err
+	}
+
+	return withPathLock(n.persistPath, func() error {
+		fi, err := os.Stat(n.persistPath)
+		if err != nil {
+			return err
+		}
+		conf, err := os.ReadFile(n.persistPath)
+		if err != nil {
+			return err
+		}
+		l.Debug("Persisting peers", "peers", len(peers), "path", n.persistPath)
+		return writeFileAtomic(n.persistPath, replaceManagedBlock(conf, n.id, block.Bytes()), fi.Mode().Perm())
+	})
+}
+
+// networkdDropInPrefix returns the prefix of the drop-ins of the clients
+// of the network with the given id.
+func networkdDropInPrefix(networkID string) string {
+	if len(networkID) > 12 {
+		networkID = networkID[:12]
+	}
+	return "dwgd-" + networkID + "-"
+}
+
+// persistNetworkd writes a drop-in for each client of n joined to a
+// sandbox, and removes the drop-ins of the other ones.
+func (d *Driver) persistNetworkd(l *slog.Logger, n *Network) error {
+	peers, joined, err := d.joinedPeers(n)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(n.persistPath, 0755); err != nil {
+		return err
+	}
+
+	prefix := networkdDropInPrefix(n.id)
+	return withPathLock(n.persistPath, func() error {
+		wanted := make(map[string]bool)
+		for i, c := range joined {
+			var content bytes.Buffer
+			fmt.Fprintf(&content, "# Managed by dwgd, EndpointID %s\n", c.id)
+			if err := WritePeers(&content, peers[i:i+1], PeerFormatNetworkd); err != nil {
+				return err
+			}
+
+			name := prefix + c.id + ".conf"
+			wanted[name] = true
+			// the drop-in contains no secrets, networkd needs to read it
+			if err := writeFileAtomic(filepath.Join(n.persistPath, name), content.Bytes(), 0644); err != nil {
+				return err
+			}
+		}
+
+		entries, err := os.ReadDir(n.persistPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), prefix) && !wanted[e.Name()] {
+				l.Debug("Removing drop-in", "name", e.Name())
+				if err := os.Remove(filepath.Join(n.persistPath, e.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
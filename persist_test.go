@@ -0,0 +1,205 @@
+package dwgd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+func TestReplaceManagedBlock(t *testing.T) {
+	conf := "[Interface]\nPrivateKey = foo\n"
+	block := "[Peer]\nPublicKey = bar\n"
+
+	withBlock := replaceManagedBlock([]byte(conf), "n1", []byte(block))
+	expected := conf + "# BEGIN dwgd n1\n" + block + "# END dwgd n1\n"
+	if string(withBlock) != expected {
+		t.Fatalf("mismatch: %q != %q", withBlock, expected)
+	}
+
+	// the blocks of other networks are left alone
+	other := replaceManagedBlock(withBlock, "n2", []byte(block))
+	replaced := replaceManagedBlock(other, "n1", []byte("[Peer]\nPublicKey = baz\n"))
+	if !strings.Contains(string(replaced), "# BEGIN dwgd n2\n"+block) || strings.Count(string(replaced), "PublicKey = bar") != 1 {
+		t.Fatalf("unexpected configuration: %q", replaced)
+	}
+
+	removed := replaceManagedBlock(replaceManagedBlock(replaced, "n1", nil), "n2", nil)
+	if string(removed) != conf {
+		t.Fatalf("mismatch: %q != %q", removed, conf)
+	}
+}
+
+func TestDriver_Persist(t *testing.T) {
+	join := func(t *testing.T, options map[string]interface{}) (*Driver, *Client) {
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := NetworkFixture()
+		c := ClientFixture(n)
+		options["dwgd.seed"] = string(n.seed)
+		options["dwgd.ifname"] = n.ifname
+		err = d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options:   map[string]interface{}{"com.docker.network.generic": options},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  n.id,
+			EndpointID: c.id,
+			Interface:  &network.EndpointInterface{Address: c.ip.String() + "/32"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+			t.Fatal(err)
+		}
+		return d, c
+	}
+
+	defer func(wgQuick, networkd, locks string) {
+		wgQuickDir, networkdDir, lockDir = wgQuick, networkd, locks
+	}(wgQuickDir, networkdDir, lockDir)
+	wgQuickDir = t.TempDir()
+	networkdDir = t.TempDir()
+	lockDir = t.TempDir()
+
+	t.Run("wg-quick", func(t *testing.T) {
+		path := filepath.Join(wgQuickDir, "dwgd0.conf")
+		conf := "[Interface]\nPrivateKey = foo\nListenPort = 51820\n"
+		if err := os.WriteFile(path, []byte(conf), 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		d, c := join(t, map[string]interface{}{
+			"dwgd.persist":      "wg-quick",
+			"dwgd.persist_path": "dwgd0.conf",
+		})
+		defer d.Close()
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkey := GeneratePrivateKey(c.network.seed, net.ParseIP(c.ip.String())).PublicKey()
+		expected := fmt.Sprintf("%s# BEGIN dwgd n1\n# 10.0.0.2\n[Peer]\nPublicKey = %s\nAllowedIPs = 10.0.0.2/32\n\n# END dwgd n1\n", conf, pubkey)
+		if string(buf) != expected {
+			t.Fatalf("mismatch: %q != %q", buf, expected)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Fatalf("unexpected mode: %s", fi.Mode())
+		}
+
+		if err := d.Leave(&network.LeaveRequest{NetworkID: "n1", EndpointID: c.id}); err != nil {
+			t.Fatal(err)
+		}
+		buf, err = os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != conf {
+			t.Fatalf("mismatch: %q != %q", buf, conf)
+		}
+
+		// the lock file is kept out of the configuration directory
+		entries, err := os.ReadDir(wgQuickDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("unexpected files in %s: %v", wgQuickDir, entries)
+		}
+		if _, err := os.Stat(filepath.Join(lockDir, url.PathEscape(path)+".lock")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("networkd", func(t *testing.T) {
+		dir := filepath.Join(networkdDir, "dwgd0.netdev.d")
+
+		d, c := join(t, map[string]interface{}{
+			"dwgd.persist": "networkd",
+		})
+		defer d.Close()
+
+		dropIn := filepath.Join(dir, "dwgd-n1-c1.conf")
+		buf, err := os.ReadFile(dropIn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(buf), "[WireGuardPeer]\n") || !strings.Contains(string(buf), "AllowedIPs=10.0.0.2/32\n") {
+			t.Fatalf("unexpected drop-in: %q", buf)
+		}
+
+		if err := d.Leave(&network.LeaveRequest{NetworkID: "n1", EndpointID: c.id}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(dropIn); !os.IsNotExist(err) {
+			t.Fatalf("drop-in not removed: %v", err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("unexpected files in %s: %v", dir, entries)
+		}
+	})
+
+	t.Run("missing wg-quick configuration", func(t *testing.T) {
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		n := NetworkFixture()
+		err = d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options: map[string]interface{}{"com.docker.network.generic": map[string]interface{}{
+				"dwgd.seed":         string(n.seed),
+				"dwgd.ifname":       n.ifname,
+				"dwgd.persist":      "wg-quick",
+				"dwgd.persist_path": "missing.conf",
+			}},
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestFileIn(t *testing.T) {
+	for name, expected := range map[string]string{
+		"wg0.conf":                "/etc/wireguard/wg0.conf",
+		"/etc/wireguard/wg0.conf": "/etc/wireguard/wg0.conf",
+	} {
+		path, err := fileIn("/etc/wireguard", "dwgd.persist_path", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != expected {
+			t.Fatalf("mismatch: %s != %s", path, expected)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "../shadow", "/etc/shadow", "/etc/wireguard/../shadow", "keys/wg0.conf"} {
+		if _, err := fileIn("/etc/wireguard", "dwgd.persist_path", name); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+}
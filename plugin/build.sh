@@ -0,0 +1,28 @@
+#!/bin/bash
+
+# Builds the rootfs of the dwgd managed plugin and creates the plugin.
+# Usage: plugin/build.sh [plugin name] [version]
+
+set -euo pipefail
+
+SCRIPT_DIR=$(cd -- "$(dirname -- "${BASH_SOURCE[0]}")" &>/dev/null && pwd)
+REPO_DIR=${SCRIPT_DIR}/..
+BUILD_DIR=${REPO_DIR}/dist/plugin
+
+PLUGIN_NAME=${1:-leomos/dwgd}
+VERSION=${2:-$(git -C ${REPO_DIR} describe --tags --always)}
+IMAGE=dwgd-plugin-rootfs:${VERSION}
+
+rm -rf ${BUILD_DIR}
+mkdir -p ${BUILD_DIR}/rootfs
+
+docker build --build-arg VERSION=${VERSION} -f ${SCRIPT_DIR}/Dockerfile -t ${IMAGE} ${REPO_DIR}
+container=$(docker create ${IMAGE})
+docker export ${container} | tar -x -C ${BUILD_DIR}/rootfs
+docker rm -v ${container}
+docker rmi ${IMAGE}
+
+cp ${SCRIPT_DIR}/config.json ${BUILD_DIR}/config.json
+
+docker plugin rm -f ${PLUGIN_NAME} 2>/dev/null || true
+docker plugin create ${PLUGIN_NAME} ${BUILD_DIR}
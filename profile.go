@@ -0,0 +1,119 @@
+package dwgd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const defaultProfilesDir = "/etc/dwgd/profiles"
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// A Profile holds driver options shared by several networks, so that they
+// don't need to be repeated at every docker network create.
+type Profile struct {
+	Name    string
+	Version string            // version field of the profile, or the hash of its content if missing
+	Options map[string]string // driver options, with the dwgd. prefix
+}
+
+// parseProfile parses the content of the profile called name. Every
+// top-level key but version is a driver option, without the dwgd. prefix:
+//
+//	version = 3
+//	seed = "supersecretseed"
+//	endpoint = "example.com:51820"
+func parseProfile(name string, data []byte) (*Profile, error) {
+	values, err := parseTOML(data)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+
+	sum := sha256.Sum256(data)
+	p := &Profile{
+		Name:    name,
+		Version: "sha256:" + hex.EncodeToString(sum[:])[:12],
+		Options: make(map[string]string),
+	}
+	for k, v := range values {
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case bool:
+			s = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("profile %s: unsupported value for %s", name, k)
+		}
+
+		if k == "version" {
+			p.Version = s
+			continue
+		}
+		p.Options["dwgd."+k] = s
+	}
+	return p, nil
+}
+
+// loadProfile reads the profile called name from the profiles directory.
+func (d *Driver) loadProfile(name string) (*Profile, error) {
+	if !profileNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid profile name %q", name)
+	}
+
+	d.settingsMu.RLock()
+	path := filepath.Join(d.profilesDir, name+".toml")
+	d.settingsMu.RUnlock()
+
+	data, err := d.c.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	return parseProfile(name, data)
+}
+
+// resolveOptions returns the options of a network merged with the ones of
+// the profile given by dwgd.profile, if any, and with the default network
+// options. The options of the network take precedence over the ones of the
+// profile, which take precedence over the defaults.
+func (d *Driver) resolveOptions(l *slog.Logger, n *Network, m map[string]interface{}) (map[string]interface{}, error) {
+	d.settingsMu.RLock()
+	defaults := d.networkDefaults
+	d.settingsMu.RUnlock()
+
+	merged := make(map[string]interface{}, len(defaults)+len(m))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+
+	// the profile can come from the defaults too
+	name, ok := m["dwgd.profile"].(string)
+	if !ok {
+		name = defaults["dwgd.profile"]
+	}
+	if name != "" {
+		p, err := d.loadProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		l.Debug("Using profile", "profile", p.Name, "version", p.Version)
+
+		for k, v := range p.Options {
+			merged[k] = v
+		}
+		n.profile = p.Name
+		n.profileVersion = p.Version
+	}
+
+	for k, v := range m {
+		merged[k] = v
+	}
+	return merged, nil
+}
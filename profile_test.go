@@ -0,0 +1,84 @@
+package dwgd
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+func TestDriver_Profile(t *testing.T) {
+	n := NetworkFixture()
+	profiles := map[string]string{
+		"/etc/dwgd/profiles/corp.toml": `version = 3
+seed = "` + string(n.seed) + `"
+pubkey = "` + n.pubkey.String() + `"
+endpoint = "198.51.100.1:51820"
+route = "10.0.0.0/8"
+`,
+		// without a version, the hash of the profile is used
+		"/etc/dwgd/profiles/lab.toml": `seed = "foo"
+pubkey = "` + n.pubkey.String() + `"
+endpoint = "198.51.100.2:51820"
+`,
+	}
+
+	tc := CommanderFixture()
+	tc.ReadFileFunc = func(name string) ([]byte, error) {
+		if p, ok := profiles[name]; ok {
+			return []byte(p), nil
+		}
+		return nil, fs.ErrNotExist
+	}
+	cfg := ConfigFixture()
+	cfg.ProfilesDir = "/etc/dwgd/profiles"
+	d, err := NewDriver(cfg, tc, WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	create := func(id string, options map[string]interface{}) (*Network, error) {
+		err := d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{"com.docker.network.generic": options},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return d.s.GetNetwork(id)
+	}
+
+	// the options of the network take precedence over the profile
+	corp, err := create("corp", map[string]interface{}{
+		"dwgd.profile":  "corp",
+		"dwgd.endpoint": n.endpoint.String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(corp.seed) != string(n.seed) || corp.pubkey != n.pubkey || corp.route != "10.0.0.0/8" {
+		t.Fatalf("profile not applied: %#v", corp)
+	}
+	if corp.endpoint.String() != n.endpoint.String() {
+		t.Fatalf("mismatch: %s != %s", corp.endpoint, n.endpoint)
+	}
+	if corp.profile != "corp" || corp.profileVersion != "3" {
+		t.Fatalf("unexpected profile: %q %q", corp.profile, corp.profileVersion)
+	}
+
+	lab, err := create("lab", map[string]interface{}{"dwgd.profile": "lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lab.profile != "lab" || !strings.HasPrefix(lab.profileVersion, "sha256:") {
+		t.Fatalf("unexpected profile: %q %q", lab.profile, lab.profileVersion)
+	}
+
+	for _, name := range []string{"missing", "../corp", ".hidden"} {
+		if _, err := create("invalid", map[string]interface{}{"dwgd.profile": name}); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package dwgd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	ProvisionerInterface = "interface"
+	ProvisionerNone      = "none"
+	ProvisionerAgent     = "agent"
+	ProvisionerFile      = "file"
+	ProvisionerWebhook   = "webhook"
+)
+
+// ServerInfo describes the WireGuard peer the clients of a network connect
+// to.
+type ServerInfo struct {
+	PublicKey wgtypes.Key
+	Endpoint  *net.UDPAddr // default endpoint, used if dwgd.endpoint is missing
+}
+
+// A PeerProvisioner manages the WireGuard peer the clients of a network
+// connect to, e.g. a local interface or a remote host.
+type PeerProvisioner interface {
+	// Describe returns the peer the clients connect to. It's called when the
+	// network is created.
+	Describe() (*ServerInfo, error)
+	// Register adds the peer of a client joining the network.
+	Register(peer wgtypes.PeerConfig) error
+	// Unregister removes the peer of a client leaving the network.
+	Unregister(peer wgtypes.PeerConfig) error
+}
+
+// A ProvisionerFactory returns the provisioner of n. options holds the
+// driver options the network was created with among the ones the
+// provisioner has been registered with.
+// Factories are called every time the provisioner is needed, so they
+// must be cheap and shouldn't keep any state.
+type ProvisionerFactory func(d *Driver, n *Network, options map[string]string) (PeerProvisioner, error)
+
+// registeredProvisioner is a provisioner together with the driver options
+// it reads.
+type registeredProvisioner struct {
+	factory ProvisionerFactory
+	options []string
+}
+
+var (
+	provisionersMu sync.RWMutex
+	provisioners   = make(map[string]registeredProvisioner)
+)
+
+// RegisterProvisioner makes a provisioner available through the
+// dwgd.provisioner option under the given name. options are the driver
+// options the provisioner reads: only these are stored with the networks
+// using it. It panics if a provisioner with the same name is already
+// registered.
+func RegisterProvisioner(name string, factory ProvisionerFactory, options ...string) {
+	provisionersMu.Lock()
+	defer provisionersMu.Unlock()
+
+	if _, ok := provisioners[name]; ok {
+		panic("dwgd: provisioner " + name + " registered twice")
+	}
+	provisioners[name] = registeredProvisioner{factory: factory, options: options}
+}
+
+// setProvisionerOptions keeps the options of m read by the provisioner of
+// n, the secret ones apart from the others.
+func setProvisionerOptions(n *Network, m map[string]interface{}) {
+	provisionersMu.RLock()
+	registered := provisioners[n.provisioner]
+	provisionersMu.RUnlock()
+
+	n.provisionerOptions = make(map[string]string)
+	n.provisionerSecrets = make(map[string]string)
+	for _, k := range registered.options {
+		v, ok := m[k].(string)
+		switch {
+		case !ok:
+		case isSecretKey(k):
+			n.provisionerSecrets[k] = v
+		default:
+			n.provisionerOptions[k] = v
+		}
+	}
+}
+
+// Provisioners returns the names of the registered provisioners.
+func Provisioners() []string {
+	provisionersMu.RLock()
+	defer provisionersMu.RUnlock()
+
+	names := make([]string, 0, len(provisioners))
+	for name := range provisioners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterProvisioner(ProvisionerInterface, newInterfaceProvisioner)
+	RegisterProvisioner(ProvisionerNone, newNoneProvisioner)
+	RegisterProvisioner(ProvisionerAgent, newAgentProvisioner)
+	RegisterProvisioner(ProvisionerFile, newFileProvisioner, "dwgd.provisioner_path")
+	RegisterProvisioner(ProvisionerWebhook, newWebhookProvisioner, "dwgd.webhook_url", "dwgd.webhook_secret")
+}
+
+// defaultProvisioner returns the provisioner used by n when none has been
+// chosen through dwgd.provisioner, matching the behaviour of the modes
+// that predate provisioners.
+func defaultProvisioner(n *Network) string {
+	switch {
+	case n.ifname != "":
+		return ProvisionerInterface
+	case n.agent != "":
+		return ProvisionerAgent
+	}
+	return ProvisionerNone
+}
+
+// A requestLogged provisioner logs through the logger of the request it
+// serves, which provisionerFor hands to it.
+type requestLogged interface {
+	setLogger(l *slog.Logger)
+}
+
+// provisionerLogger implements requestLogged for the builtin provisioners.
+type provisionerLogger struct {
+	l *slog.Logger
+}
+
+func (p *provisionerLogger) setLogger(l *slog.Logger) {
+	p.l = l
+}
+
+// provisionerFor returns the provisioner of n, logging through l.
+func (d *Driver) provisionerFor(l *slog.Logger, n *Network) (PeerProvisioner, error) {
+	name := n.provisioner
+	if name == "" {
+		name = defaultProvisioner(n)
+	}
+
+	provisionersMu.RLock()
+	registered, ok := provisioners[name]
+	provisionersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provisioner %q", name)
+	}
+
+	options := make(map[string]string, len(n.provisionerOptions)+len(n.provisionerSecrets))
+	for k, v := range n.provisionerOptions {
+		options[k] = v
+	}
+	for k, v := range n.provisionerSecrets {
+		options[k] = v
+	}
+	p, err := registered.factory(d, n, options)
+	if err != nil {
+		return nil, err
+	}
+	if rl, ok := p.(requestLogged); ok {
+		rl.setLogger(l)
+	}
+	return p, nil
+}
+
+// pubkeyInfo describes the peer of a network created with dwgd.pubkey.
+func pubkeyInfo(n *Network) (*ServerInfo, error) {
+	if n.pubkey == (wgtypes.Key{}) {
+		return nil, fmt.Errorf("dwgd.pubkey option missing")
+	}
+	return &ServerInfo{PublicKey: n.pubkey}, nil
+}
+
+// interfaceProvisioner manages a WireGuard interface living on this host:
+// this is ifname mode.
+type interfaceProvisioner struct {
+	provisionerLogger
+
+	wgc    wgController
+	ifname string
+}
+
+func newInterfaceProvisioner(d *Driver, n *Network, options map[string]string) (PeerProvisioner, error) {
+	if n.ifname == "" {
+		return nil, fmt.Errorf("provisioner %s requires the dwgd.ifname option", ProvisionerInterface)
+	}
+	return &interfaceProvisioner{
+		provisionerLogger: provisionerLogger{l: Logger},
+		wgc:               d.wgcFor(n.ifnameNetns),
+		ifname:            n.ifname,
+	}, nil
+}
+
+func (p *interfaceProvisioner) Describe() (*ServerInfo, error) {
+	iface, err := p.wgc.Device(p.ifname)
+	if err != nil {
+		p.l.Debug("Interface not recognized", "ifname", p.ifname)
+		return nil, err
+	}
+	p.l.Debug("Using WireGuard server interface", "ifname", iface.Name)
+
+	return &ServerInfo{
+		PublicKey: iface.PublicKey,
+		Endpoint:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: iface.ListenPort},
+	}, nil
+}
+
+func (p *interfaceProvisioner) Register(peer wgtypes.PeerConfig) error {
+	return updateServerPeer(p.l, p.wgc, p.ifname, peer)
+}
+
+func (p *interfaceProvisioner) Unregister(peer wgtypes.PeerConfig) error {
+	peer.Remove = true
+	return updateServerPeer(p.l, p.wgc, p.ifname, peer)
+}
+
+// noneProvisioner leaves the configuration of the peer to the user: this is
+// pubkey mode.
+type noneProvisioner struct {
+	n *Network
+}
+
+func newNoneProvisioner(d *Driver, n *Network, options map[string]string) (PeerProvisioner, error) {
+	return &noneProvisioner{n: n}, nil
+}
+
+func (p *noneProvisioner) Describe() (*ServerInfo, error) {
+	return pubkeyInfo(p.n)
+}
+
+func (p *noneProvisioner) Register(peer wgtypes.PeerConfig) error {
+	return nil
+}
+
+func (p *noneProvisioner) Unregister(peer wgtypes.PeerConfig) error {
+	return nil
+}
+
+// agentProvisioner manages the peer through the dwgd agent running on it.
+type agentProvisioner struct {
+	provisionerLogger
+
+	n      *Network
+	client *agentClient
+}
+
+func newAgentProvisioner(d *Driver, n *Network, options map[string]string) (PeerProvisioner, error) {
+	u, err := url.Parse(n.agent)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid dwgd.agent option: %q", n.agent)
+	}
+	if d.agentTLS == nil {
+		return nil, fmt.Errorf("dwgd.agent requires the agent TLS credentials to be configured")
+	}
+	return &agentProvisioner{
+		provisionerLogger: provisionerLogger{l: Logger},
+		n:                 n,
+		client:            d.agentClient(n.agent),
+	}, nil
+}
+
+func (p *agentProvisioner) Describe() (*ServerInfo, error) {
+	return pubkeyInfo(p.n)
+}
+
+func (p *agentProvisioner) Register(peer wgtypes.PeerConfig) error {
+	p.l.Debug("Adding peer through agent", "public_key", peer.PublicKey.String(), "agent", p.n.agent)
+	return p.client.UpdatePeer(peer)
+}
+
+func (p *agentProvisioner) Unregister(peer wgtypes.PeerConfig) error {
+	p.l.Debug("Removing peer through agent", "public_key", peer.PublicKey.String(), "agent", p.n.agent)
+	peer.Remove = true
+	return p.client.UpdatePeer(peer)
+}
+
+// fileProvisioner keeps the peers of the network as [Peer] sections in a
+// file, for external tools to pick up.
+type fileProvisioner struct {
+	n    *Network
+	path string
+}
+
+// provisionerDir holds the files of the file provisioner.
+// dwgd.provisioner_path can only name files inside it.
+var provisionerDir = "/etc/dwgd/peers"
+
+func newFileProvisioner(d *Driver, n *Network, options map[string]string) (PeerProvisioner, error) {
+	name := options["dwgd.provisioner_path"]
+	if name == "" {
+		return nil, fmt.Errorf("provisioner %s requires the dwgd.provisioner_path option", ProvisionerFile)
+	}
+	path, err := fileIn(provisionerDir, "dwgd.provisioner_path", name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileProvisioner{n: n, path: path}, nil
+}
+
+func (p *fileProvisioner) Describe() (*ServerInfo, error) {
+	return pubkeyInfo(p.n)
+}
+
+// update replaces the block of peer in the file with block, or removes it
+// if block is empty.
+func (p *fileProvisioner) update(peer wgtypes.PeerConfig, block []byte) error {
+	return withPathLock(p.path, func() error {
+		conf, err := os.ReadFile(p.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		id := p.n.id + " " + peer.PublicKey.String()
+		return writeFileAtomic(p.path, replaceManagedBlock(conf, id, block), 0600)
+	})
+}
+
+func (p *fileProvisioner) Register(peer wgtypes.PeerConfig) error {
+	generated := &GeneratedPeer{PublicKey: peer.PublicKey, PresharedKey: peer.PresharedKey}
+	for _, ipnet := range peer.AllowedIPs {
+		generated.IP = ipnet.IP
+		generated.AllowedIPs = ipnet.String()
+	}
+
+	var block bytes.Buffer
+	if err := WritePeers(&block, []*GeneratedPeer{generated}, PeerFormatWgQuick); err != nil {
+		return err
+	}
+	return p.update(peer, block.Bytes())
+}
+
+func (p *fileProvisioner) Unregister(peer wgtypes.PeerConfig) error {
+	return p.update(peer, nil)
+}
+
+// webhookEvent is the body of the requests sent by webhookProvisioner.
+type webhookEvent struct {
+	Event      string   `json:"event"` // register or unregister
+	NetworkID  string   `json:"network_id"`
+	PublicKey  string   `json:"public_key"`
+	AllowedIPs []string `json:"allowed_ips"`
+}
+
+// webhookProvisioner notifies an HTTP endpoint of the peers to add and
+// remove. If a secret is set, requests are signed with HMAC-SHA256 in the
+// X-Dwgd-Signature header.
+type webhookProvisioner struct {
+	n      *Network
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookProvisioner(d *Driver, n *Network, options map[string]string) (PeerProvisioner, error) {
+	u, err := url.Parse(options["dwgd.webhook_url"])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("provisioner %s requires a valid dwgd.webhook_url option", ProvisionerWebhook)
+	}
+	return &webhookProvisioner{
+		n:      n,
+		url:    u.String(),
+		secret: options["dwgd.webhook_secret"],
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *webhookProvisioner) Describe() (*ServerInfo, error) {
+	return pubkeyInfo(p.n)
+}
+
+func (p *webhookProvisioner) notify(event string, peer wgtypes.PeerConfig) error {
+	ev := &webhookEvent{Event: event, NetworkID: p.n.id, PublicKey: peer.PublicKey.String()}
+	for _, ipnet := range peer.AllowedIPs {
+		ev.AllowedIPs = append(ev.AllowedIPs, ipnet.String())
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.secret != "" {
+		mac := hmac.New(sha256.New, []byte(p.secret))
+		mac.Write(body)
+		req.Header.Set("X-Dwgd-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook %s: %s: %s", p.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (p *webhookProvisioner) Register(peer wgtypes.PeerConfig) error {
+	return p.notify("register", peer)
+}
+
+func (p *webhookProvisioner) Unregister(peer wgtypes.PeerConfig) error {
+	return p.notify("unregister", peer)
+}
@@ -0,0 +1,238 @@
+package dwgd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testProvisioner records the peers it's asked to register and unregister.
+type testProvisioner struct {
+	registered   []wgtypes.Key
+	unregistered []wgtypes.Key
+}
+
+func (p *testProvisioner) Describe() (*ServerInfo, error) {
+	return &ServerInfo{PublicKey: DeviceFixture().PublicKey}, nil
+}
+
+func (p *testProvisioner) Register(peer wgtypes.PeerConfig) error {
+	p.registered = append(p.registered, peer.PublicKey)
+	return nil
+}
+
+func (p *testProvisioner) Unregister(peer wgtypes.PeerConfig) error {
+	p.unregistered = append(p.unregistered, peer.PublicKey)
+	return nil
+}
+
+var testProvisionerInstance = &testProvisioner{}
+
+func init() {
+	RegisterProvisioner("test", func(d *Driver, n *Network, options map[string]string) (PeerProvisioner, error) {
+		return testProvisionerInstance, nil
+	}, "dwgd.test_option")
+}
+
+func TestDriver_Provisioner(t *testing.T) {
+	// joinAndLeave creates a network with the given options and an endpoint
+	// joining and leaving it, returning the public key of the endpoint.
+	joinAndLeave := func(t *testing.T, options map[string]interface{}) (*Network, wgtypes.Key) {
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		n := NetworkFixture()
+		c := ClientFixture(n)
+		options["dwgd.seed"] = string(n.seed)
+		options["dwgd.endpoint"] = n.endpoint.String()
+		err = d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options:   map[string]interface{}{"com.docker.network.generic": options},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  n.id,
+			EndpointID: c.id,
+			Interface:  &network.EndpointInterface{Address: c.ip.String() + "/32"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := d.s.GetNetwork(n.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		joined, err := d.s.GetClient(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Leave(&network.LeaveRequest{NetworkID: n.id, EndpointID: c.id}); err != nil {
+			t.Fatal(err)
+		}
+		return stored, joined.PeerConfig().PublicKey
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		*testProvisionerInstance = testProvisioner{}
+		n, key := joinAndLeave(t, map[string]interface{}{"dwgd.provisioner": "test", "dwgd.test_option": "foo"})
+
+		if n.pubkey != DeviceFixture().PublicKey {
+			t.Fatalf("mismatch: %s != %s", n.pubkey, DeviceFixture().PublicKey)
+		}
+		// only the options read by the provisioner are kept
+		expectedOptions := map[string]string{"dwgd.test_option": "foo"}
+		if n.provisioner != "test" || !cmp.Equal(n.provisionerOptions, expectedOptions) {
+			t.Fatalf("unexpected provisioner: %q %v", n.provisioner, n.provisionerOptions)
+		}
+		expected := &testProvisioner{registered: []wgtypes.Key{key}, unregistered: []wgtypes.Key{key}}
+		if !cmp.Equal(testProvisionerInstance, expected, cmp.AllowUnexported(testProvisioner{})) {
+			t.Fatalf("mismatch: %#v != %#v", testProvisionerInstance, expected)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		defer func(dir, locks string) { provisionerDir, lockDir = dir, locks }(provisionerDir, lockDir)
+		provisionerDir = t.TempDir()
+		lockDir = t.TempDir()
+		path := filepath.Join(provisionerDir, "peers.conf")
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		n := NetworkFixture()
+		n.provisioner = ProvisionerFile
+		for _, name := range []string{"/etc/shadow", "../peers.conf"} {
+			n.provisionerOptions = map[string]string{"dwgd.provisioner_path": name}
+			if _, err := d.provisionerFor(Logger, n); err == nil {
+				t.Fatalf("%s: expected error", name)
+			}
+		}
+
+		n.provisionerOptions = map[string]string{"dwgd.provisioner_path": "peers.conf"}
+		p, err := d.provisionerFor(Logger, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := ClientFixture(n).PeerConfig()
+		if err := p.Register(peer); err != nil {
+			t.Fatal(err)
+		}
+		conf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(conf), "# BEGIN dwgd "+n.id+" "+peer.PublicKey.String()) ||
+			!strings.Contains(string(conf), "PublicKey = "+peer.PublicKey.String()) {
+			t.Fatalf("unexpected file: %q", conf)
+		}
+
+		if err := p.Unregister(peer); err != nil {
+			t.Fatal(err)
+		}
+		conf, err = os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conf) != 0 {
+			t.Fatalf("unexpected file: %q", conf)
+		}
+		// the lock file is kept out of the directory of the file
+		entries, err := os.ReadDir(provisionerDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("unexpected files in %s: %v", provisionerDir, entries)
+		}
+	})
+
+	t.Run("webhook", func(t *testing.T) {
+		secret := "s3cr3t"
+		events := make([]webhookEvent, 0)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			if r.Header.Get("X-Dwgd-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+				http.Error(w, "bad signature", http.StatusUnauthorized)
+				return
+			}
+			var ev webhookEvent
+			if err := json.Unmarshal(body, &ev); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			events = append(events, ev)
+		}))
+		defer srv.Close()
+
+		n, key := joinAndLeave(t, map[string]interface{}{
+			"dwgd.provisioner":    ProvisionerWebhook,
+			"dwgd.pubkey":         NetworkFixture().pubkey.String(),
+			"dwgd.webhook_url":    srv.URL,
+			"dwgd.webhook_secret": secret,
+		})
+
+		// the secret is kept apart from the other options
+		if !cmp.Equal(n.provisionerOptions, map[string]string{"dwgd.webhook_url": srv.URL}) ||
+			!cmp.Equal(n.provisionerSecrets, map[string]string{"dwgd.webhook_secret": secret}) {
+			t.Fatalf("unexpected options: %v %v", n.provisionerOptions, n.provisionerSecrets)
+		}
+
+		allowed := []string{ClientFixture(n).ip.String() + "/32"}
+		expected := []webhookEvent{
+			{Event: "register", NetworkID: n.id, PublicKey: key.String(), AllowedIPs: allowed},
+			{Event: "unregister", NetworkID: n.id, PublicKey: key.String(), AllowedIPs: allowed},
+		}
+		if !cmp.Equal(events, expected) {
+			t.Fatalf("mismatch: %#v != %#v", events, expected)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		d, err := NewDriver(ConfigFixture(), CommanderFixture(), WgControllerFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		n := NetworkFixture()
+		err = d.CreateNetwork(&network.CreateNetworkRequest{
+			NetworkID: n.id,
+			Options: map[string]interface{}{
+				"com.docker.network.generic": map[string]interface{}{
+					"dwgd.seed":        string(n.seed),
+					"dwgd.endpoint":    n.endpoint.String(),
+					"dwgd.pubkey":      n.pubkey.String(),
+					"dwgd.provisioner": "foo",
+				},
+			},
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
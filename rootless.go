@@ -2,63 +2,317 @@ package dwgd
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"math"
+	"net"
+	"net/http"
+	"os"
 	"path"
-	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/illarion/gonotify/v2"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	xdgRuntimeRoot    = "/run/user/"
-	dockerPidFileName = "docker.pid"
+	defaultXdgRuntimeRoot        = "/run/user"
+	dockerPidFileName            = "docker.pid"
+	rootlesskitStateDirName      = "dockerd-rootless"
+	rootlesskitChildPidFileName  = "child_pid"
+	rootlesskitApiSockFileName   = "api.sock"
+	rootlesskitApiRequestTimeout = 2 * time.Second
 )
 
-var (
-	userXdgRuntimeDirRegex = regexp.MustCompile(xdgRuntimeRoot + `\d+`)
-)
+// rootlesskitInfo is the subset of the response of rootlesskit's
+// GET /v1/info endpoint we are interested in.
+type rootlesskitInfo struct {
+	ChildPID int `json:"childPID"`
+}
 
-func moveToRootlessNamespaceIfNecessary(c commander, sandboxKey string, ifname string) error {
-	match := userXdgRuntimeDirRegex.FindString(sandboxKey)
-	if match == "" {
-		return nil
+// queryRootlesskitApi asks the rootlesskit instance listening on sockPath
+// for its child PID. It is a variable so that it can be mocked in unit tests.
+var queryRootlesskitApi = func(sockPath string) (*rootlesskitInfo, error) {
+	client := &http.Client{
+		Timeout: rootlesskitApiRequestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockPath)
+			},
+		},
 	}
 
-	data, err := c.ReadFile(path.Join(match, dockerPidFileName))
+	resp, err := client.Get("http://rootlesskit/v1/info")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rootlesskit api returned status %d", resp.StatusCode)
+	}
+
+	info := &rootlesskitInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
 	}
+	return info, nil
+}
 
-	pid, err := strconv.Atoi(string(data))
+func readPidFile(c commander, name string) (int, error) {
+	data, err := c.ReadFile(name)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	TraceLog.Printf("Moving %s to rootless namespace with PID %d\n", ifname, pid)
-	if err := c.Run("ip", "link", "set", ifname, "netns", fmt.Sprint(pid)); err != nil {
-		return err
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// rootlessDaemonPid returns the PID of a process living in the namespaces
+// of the rootless docker daemon whose XDG_RUNTIME_DIR is runtimeDir.
+//
+// rootlesskit's state directory is preferred: its child_pid file (or its
+// API socket) points directly to the process that created the namespaces.
+// If it is not available we fall back to dockerd's own PID file.
+func rootlessDaemonPid(l *slog.Logger, c commander, runtimeDir string) (int, error) {
+	stateDir := path.Join(runtimeDir, rootlesskitStateDirName)
+
+	pid, err := readPidFile(c, path.Join(stateDir, rootlesskitChildPidFileName))
+	if err == nil {
+		return pid, nil
 	}
+	l.Debug("Couldn't read rootlesskit child PID", "state_dir", stateDir, "error", err)
 
-	return nil
+	info, err := queryRootlesskitApi(path.Join(stateDir, rootlesskitApiSockFileName))
+	if err == nil && info.ChildPID > 0 {
+		return info.ChildPID, nil
+	}
+	if err != nil {
+		l.Debug("Couldn't query rootlesskit api", "state_dir", stateDir, "error", err)
+	}
+
+	return readPidFile(c, path.Join(runtimeDir, dockerPidFileName))
 }
 
-// returns (pid, socket path, error)
-func generateSockSymlinkFromDockerPidFile(c commander, dockerPidFileFullPath string) (int, string, error) {
-	data, err := c.ReadFile(dockerPidFileFullPath)
+// runtimeDirOf returns the XDG_RUNTIME_DIR, among the ones contained in
+// root, that contains name.
+func runtimeDirOf(root string, name string) (string, bool) {
+	root = path.Clean(root)
+	name = path.Clean(name)
+
+	rel := strings.TrimPrefix(name, root+"/")
+	if rel == name || rel == "" {
+		return "", false
+	}
+
+	return path.Join(root, strings.SplitN(rel, "/", 2)[0]), true
+}
+
+// nsID identifies a namespace by the device and inode of its nsfs file.
+type nsID struct {
+	dev uint64
+	ino uint64
+}
+
+// userNamespaceOf returns the user namespace of the process with the given
+// PID. It is a variable so that it can be mocked in unit tests.
+var userNamespaceOf = func(pid int) (nsID, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path.Join("/proc", strconv.Itoa(pid), "ns", "user"), &st); err != nil {
+		return nsID{}, err
+	}
+	return nsID{dev: uint64(st.Dev), ino: st.Ino}, nil
+}
+
+// netnsOwnerOf returns the user namespace owning the network namespace
+// bind mounted at name. It is a variable so that it can be mocked in unit
+// tests.
+var netnsOwnerOf = func(name string) (nsID, error) {
+	f, err := os.Open(name)
 	if err != nil {
-		return 0, "", err
+		return nsID{}, err
+	}
+	defer f.Close()
+
+	nstype, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_NSTYPE)
+	if err != nil || nstype != unix.CLONE_NEWNET {
+		return nsID{}, fmt.Errorf("%s is not a network namespace", name)
+	}
+	fd, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_USERNS)
+	if err != nil {
+		return nsID{}, fmt.Errorf("couldn't get the owner of network namespace %s: %w", name, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nsID{}, err
+	}
+	return nsID{dev: uint64(st.Dev), ino: st.Ino}, nil
+}
+
+// rootlessRuntimeDirs returns the XDG_RUNTIME_DIRs contained in roots, the
+// one whose path contains sandboxKey first, if any, and whether there is
+// such a directory.
+func rootlessRuntimeDirs(l *slog.Logger, c commander, roots []string, sandboxKey string) ([]string, bool) {
+	dirs := make([]string, 0)
+	matched := ""
+	for _, root := range roots {
+		if runtimeDir, ok := runtimeDirOf(root, sandboxKey); ok && matched == "" {
+			matched = runtimeDir
+			dirs = append([]string{runtimeDir}, dirs...)
+		}
+		entries, err := c.ReadDir(root)
+		if err != nil {
+			l.Debug("Couldn't list rootless runtime root", "root", root, "error", err)
+			continue
+		}
+		for _, entry := range entries {
+			runtimeDir := path.Join(root, entry.Name())
+			if entry.IsDir() && runtimeDir != matched {
+				dirs = append(dirs, runtimeDir)
+			}
+		}
 	}
+	return dirs, matched != ""
+}
+
+// rootlessNamespacePid resolves the network namespace that sandboxKey lives
+// in. If the sandbox belongs to a rootless docker daemon, the PID of a
+// process living in its namespaces is returned, together with true.
+//
+// The sandbox key is a path in the mount namespace of the daemon that
+// created it, and the network namespace bind mounted there is owned by the
+// user namespace of the daemon. Each rootless daemon is checked in turn,
+// starting from the one whose runtime dir contains the sandbox key: the
+// sandbox is reached through its root and the owner of its network
+// namespace compared with the user namespace of the daemon. Sandboxes
+// owned by dwgd's own user namespace don't belong to rootless daemons.
+func rootlessNamespacePid(l *slog.Logger, c commander, roots []string, sandboxKey string) (int, bool, error) {
+	self, err := userNamespaceOf(os.Getpid())
+	if err != nil {
+		return 0, false, err
+	}
+	if owner, err := netnsOwnerOf(sandboxKey); err == nil && owner == self {
+		return 0, false, nil
+	}
+
+	// The error of the runtime dir containing the sandbox key, if any, is
+	// the most relevant one since it's checked first.
+	runtimeDirs, matched := rootlessRuntimeDirs(l, c, roots, sandboxKey)
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, runtimeDir := range runtimeDirs {
+		pid, err := rootlessDaemonPid(l, c, runtimeDir)
+		if err != nil {
+			l.Debug("Couldn't find rootless daemon", "runtime_dir", runtimeDir, "error", err)
+			fail(fmt.Errorf("couldn't find rootless daemon for %s: %w", runtimeDir, err))
+			continue
+		}
+
+		userns, err := userNamespaceOf(pid)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		nsSandboxKey := path.Join("/proc", fmt.Sprint(pid), "root", sandboxKey)
+		owner, err := netnsOwnerOf(nsSandboxKey)
+		if err != nil {
+			fail(fmt.Errorf("sandbox %s not found in namespace of PID %d: %w", sandboxKey, pid, err))
+			continue
+		}
+		if owner == userns {
+			return pid, true, nil
+		}
+		fail(fmt.Errorf("sandbox %s is not owned by the rootless daemon with PID %d", sandboxKey, pid))
+	}
+
+	// A sandbox key inside a runtime dir must belong to a rootless daemon,
+	// otherwise it's a sandbox of the rootful daemon.
+	if matched {
+		return 0, false, firstErr
+	}
+	return 0, false, nil
+}
+
+// nsGetOwnerUid is NS_GET_OWNER_UID, missing from golang.org/x/sys/unix on
+// most architectures.
+const nsGetOwnerUid = 0xb704
+
+// userNamespaceOwnerOf returns the UID owning the user namespace of the
+// process with the given PID, i.e. the user a rootless daemon runs as. It
+// is a variable so that it can be mocked in unit tests.
+var userNamespaceOwnerOf = func(pid int) (uint32, error) {
+	f, err := os.Open(path.Join("/proc", strconv.Itoa(pid), "ns", "user"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return unix.IoctlGetUint32(int(f.Fd()), nsGetOwnerUid)
+}
 
-	pid, err := strconv.Atoi(string(data))
+// rootlessSandboxPid resolves the network namespace that sandboxKey lives
+// in on behalf of t, as rootlessNamespacePid does, returning 0 if it
+// doesn't belong to a rootless daemon. Tenants other than root can only use
+// the sandboxes of a rootless daemon running as themselves.
+func rootlessSandboxPid(l *slog.Logger, c commander, roots []string, sandboxKey string, t tenant) (int, error) {
+	pid, ok, err := rootlessNamespacePid(l, c, roots, sandboxKey)
+	if err != nil {
+		return 0, err
+	}
+	if t.uid == rootUid {
+		return pid, nil
+	}
+	if !ok {
+		return 0, fmt.Errorf("sandbox %s doesn't belong to a rootless daemon of UID %d", sandboxKey, t.uid)
+	}
+	owner, err := userNamespaceOwnerOf(pid)
+	if err != nil {
+		return 0, err
+	}
+	if owner != t.uid {
+		return 0, fmt.Errorf("sandbox %s belongs to the rootless daemon of UID %d, not of UID %d", sandboxKey, owner, t.uid)
+	}
+	return pid, nil
+}
+
+// moveToRootlessNamespaceIfNecessary moves ifname to the namespaces of the
+// rootless docker daemon with the given PID, if not 0, as returned by
+// rootlessSandboxPid. It returns the path through which dwgd can reach the
+// sandbox network namespace.
+func moveToRootlessNamespaceIfNecessary(l *slog.Logger, c commander, pid int, sandboxKey string, ifname string) (string, error) {
+	if pid == 0 {
+		return sandboxKey, nil
+	}
+
+	l.Debug("Moving interface to rootless namespace", "ifname", ifname, "pid", pid)
+	if err := c.Run("ip", "link", "set", ifname, "netns", fmt.Sprint(pid)); err != nil {
+		return "", err
+	}
+
+	return path.Join("/proc", fmt.Sprint(pid), "root", sandboxKey), nil
+}
+
+// returns (pid, socket path, error)
+func generateSockSymlinkFromRuntimeDir(c commander, runtimeDir string, fullDwgdSockPath string, dockerPluginSockPath string) (int, string, error) {
+	pid, err := rootlessDaemonPid(Logger, c, runtimeDir)
 	if err != nil {
 		return 0, "", err
 	}
 
-	fullDwgdSockPath := path.Join(dwgdRunDir, dwgdSockName)
-	dockerPluginSockPath := path.Join(dockerPluginSockDir, dwgdSockName)
 	if err := c.Run("nsenter", "-U", "-n", "-m", "-t", fmt.Sprint(pid), "ln", "-s", "-f", fullDwgdSockPath, dockerPluginSockPath); err != nil {
 		TraceLog.Printf("Couldn't create symlink on rootless ns (PID: %d): %s\n", pid, err)
 		return 0, "", err
@@ -70,48 +324,82 @@ func generateSockSymlinkFromDockerPidFile(c commander, dockerPidFileFullPath str
 
 type RootlessSymlinker struct {
 	c                  commander
+	roots              []string
+	sockPath           string // path of the dwgd socket
+	pluginSockPath     string // path of the symlink inside the rootless namespaces
+	mu                 sync.Mutex
 	socketSymlinkPerNs map[int]string
 	stopCh             chan int
 	inotify            *gonotify.Inotify
 }
 
-func NewRootlessSymlinker(c commander) (*RootlessSymlinker, error) {
+func NewRootlessSymlinker(c commander, cfg *Config) (*RootlessSymlinker, error) {
 	if c == nil {
 		c = &execCommander{}
 	}
 
-	path, err := c.LookPath("nsenter")
+	roots := cfg.RootlessRuntimeRoots
+	if len(roots) == 0 {
+		roots = []string{defaultXdgRuntimeRoot}
+	}
+
+	nsenterPath, err := c.LookPath("nsenter")
 	if err != nil {
 		TraceLog.Printf("Couldn't find 'nsenter' utility: %s", err)
 		return nil, err
 	} else {
-		TraceLog.Printf("Using 'nsenter' utility at the following path: %s", path)
+		TraceLog.Printf("Using 'nsenter' utility at the following path: %s", nsenterPath)
 	}
 
 	return &RootlessSymlinker{
 		c:                  c,
+		roots:              roots,
+		sockPath:           path.Join(cfg.RunDir, cfg.SockName()),
+		pluginSockPath:     path.Join(cfg.PluginSockDir, cfg.SockName()),
 		socketSymlinkPerNs: make(map[int]string),
 		stopCh:             make(chan int),
 	}, nil
 }
 
+// runtimeDirOf returns the XDG_RUNTIME_DIR that name belongs to.
+func (r *RootlessSymlinker) runtimeDirOf(name string) (string, bool) {
+	for _, root := range r.roots {
+		if runtimeDir, ok := runtimeDirOf(root, name); ok {
+			return runtimeDir, true
+		}
+	}
+	return "", false
+}
+
 func (r *RootlessSymlinker) handleEvent(ev gonotify.InotifyEvent) {
-	if ev.Mask&(gonotify.IN_CREATE|gonotify.IN_ISDIR) != 0 {
-		if !userXdgRuntimeDirRegex.MatchString(ev.Name) {
+	runtimeDir, ok := r.runtimeDirOf(ev.Name)
+	if !ok {
+		return
+	}
+
+	if ev.Mask&gonotify.IN_CREATE != 0 && ev.Mask&gonotify.IN_ISDIR != 0 {
+		// We are interested in new XDG_RUNTIME_DIRs and in rootlesskit's
+		// state directory inside them.
+		if ev.Name != runtimeDir && ev.Name != path.Join(runtimeDir, rootlesskitStateDirName) {
 			return
 		}
-		r.inotify.AddWatch(ev.Name, gonotify.IN_CLOSE_WRITE)
+		r.inotify.AddWatch(ev.Name, gonotify.IN_CREATE|gonotify.IN_CLOSE_WRITE)
 	} else if ev.Mask&gonotify.IN_CLOSE_WRITE != 0 {
-		if !userXdgRuntimeDirRegex.MatchString(ev.Name) {
+		switch ev.Name {
+		case path.Join(runtimeDir, dockerPidFileName):
+		case path.Join(runtimeDir, rootlesskitStateDirName, rootlesskitChildPidFileName):
+		default:
 			return
 		}
 
 		TraceLog.Printf("Creating symlink from %s\n", ev.Name)
 		retries := 5
 		for i := 0; i < retries; i++ {
-			pid, sockPath, err := generateSockSymlinkFromDockerPidFile(r.c, ev.Name)
+			pid, sockPath, err := generateSockSymlinkFromRuntimeDir(r.c, runtimeDir, r.sockPath, r.pluginSockPath)
 			if err == nil {
+				r.mu.Lock()
 				r.socketSymlinkPerNs[pid] = sockPath
+				r.mu.Unlock()
 				return
 			}
 			TraceLog.Printf("Error during creation of socket symlink: %s\n", err)
@@ -123,64 +411,102 @@ func (r *RootlessSymlinker) handleEvent(ev gonotify.InotifyEvent) {
 
 }
 
-func (r *RootlessSymlinker) Start() error {
-	// We create a context to handle inotify's lifecyle.
-	// When the symlinker is stopped we want to stop
-	// cleanly also the inotify instance.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	inotify, err := gonotify.NewInotify(ctx)
-	if err != nil {
-		return err
-	}
-	r.inotify = inotify
-
-	// Before starting watching for events we list all the folders
-	// in the xdgRuntimeRoot: if there already are some instances
-	// of docker rootless running we can handle those
-	entries, err := r.c.ReadDir(xdgRuntimeRoot)
+// scanRoot handles the XDG_RUNTIME_DIRs that already exist in root,
+// creating "fake" inotify events for them.
+func (r *RootlessSymlinker) scanRoot(root string) error {
+	entries, err := r.c.ReadDir(root)
 	if err != nil {
 		return err
 	}
 	for _, entry := range entries {
-		// If we find any directory whose name is a number
-		// we assume that it could be a user's XDG_RUNTIME_DIR
-		// We handle this situation creating a "fake" inotify
-		// event.
 		if !entry.IsDir() {
 			continue
 		}
-		fullPath := path.Join(xdgRuntimeRoot, entry.Name())
-		isNumber := userXdgRuntimeDirRegex.MatchString(fullPath)
-		if !isNumber {
-			continue
-		}
+		runtimeDir := path.Join(root, entry.Name())
 		r.handleEvent(gonotify.InotifyEvent{
-			Name: fullPath,
+			Name: runtimeDir,
 			Mask: gonotify.IN_CREATE | gonotify.IN_ISDIR,
 		})
 
-		// We also search for a <dockerPidFileName> file
-		// inside the directory and handle a constructed event.
-		subEntries, err := r.c.ReadDir(fullPath)
+		// If rootlesskit's state directory exists we watch it too.
+		stateDir := path.Join(runtimeDir, rootlesskitStateDirName)
+		stateEntries, err := r.c.ReadDir(stateDir)
+		if err == nil {
+			r.handleEvent(gonotify.InotifyEvent{
+				Name: stateDir,
+				Mask: gonotify.IN_CREATE | gonotify.IN_ISDIR,
+			})
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		// We also search for the files that tell us that a daemon is
+		// running and handle a constructed event: a single one is enough
+		// since the PID is resolved from the whole runtime dir.
+		subEntries, err := r.c.ReadDir(runtimeDir)
 		if err != nil {
 			return err
 		}
+		candidates := make([]string, 0)
+		for _, stateEntry := range stateEntries {
+			if stateEntry.Name() == rootlesskitChildPidFileName {
+				candidates = append(candidates, path.Join(stateDir, stateEntry.Name()))
+			}
+		}
 		for _, subEntry := range subEntries {
 			if subEntry.Name() == dockerPidFileName {
-				r.handleEvent(gonotify.InotifyEvent{
-					Name: path.Join(fullPath, subEntry.Name()),
-					Mask: gonotify.IN_CLOSE_WRITE,
-				})
+				candidates = append(candidates, path.Join(runtimeDir, subEntry.Name()))
 			}
 		}
+		if len(candidates) > 0 {
+			r.handleEvent(gonotify.InotifyEvent{
+				Name: candidates[0],
+				Mask: gonotify.IN_CLOSE_WRITE,
+			})
+		}
 	}
+	return nil
+}
 
-	err = r.inotify.AddWatch(xdgRuntimeRoot, gonotify.IN_CREATE|gonotify.IN_ISDIR)
+func (r *RootlessSymlinker) Start() error {
+	// We create a context to handle inotify's lifecyle.
+	// When the symlinker is stopped we want to stop
+	// cleanly also the inotify instance.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inotify, err := gonotify.NewInotify(ctx)
 	if err != nil {
 		return err
 	}
+	r.inotify = inotify
+
+	// Before starting watching for events we list all the folders
+	// in the runtime roots: if there already are some instances
+	// of docker rootless running we can handle those.
+	// Roots that don't exist are skipped: if none of them exists
+	// there can't be any rootless daemon and we are not needed.
+	watched := 0
+	for _, root := range r.roots {
+		if err := r.scanRoot(root); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				TraceLog.Printf("Skipping rootless runtime root %s: %s\n", root, err)
+				continue
+			}
+			return err
+		}
+
+		err = r.inotify.AddWatch(root, gonotify.IN_CREATE|gonotify.IN_ISDIR)
+		if err != nil {
+			return err
+		}
+		watched++
+	}
+	if watched == 0 {
+		TraceLog.Println("No rootless runtime root found, symlinker not needed")
+		<-r.stopCh
+		return nil
+	}
 
 	TraceLog.Println("Starting to listen for events")
 	for {
@@ -210,6 +536,8 @@ func (r *RootlessSymlinker) Stop() error {
 	r.stopCh <- 0
 	close(r.stopCh)
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	for pid, path := range r.socketSymlinkPerNs {
 		if err := r.c.Run("nsenter", "-U", "-n", "-m", "-t", fmt.Sprint(pid), "rm", "-f", path); err != nil {
 			TraceLog.Printf("Couldn't remove symlink on rootless ns (PID: %d): %s\n", pid, err)
@@ -218,3 +546,26 @@ func (r *RootlessSymlinker) Stop() error {
 	}
 	return nil
 }
+
+// A RootlessNamespace is the namespace of a rootless docker daemon the
+// plugin socket has been symlinked into.
+type RootlessNamespace struct {
+	PID     int    `json:"pid"`     // PID of the namespace's init process
+	Symlink string `json:"symlink"` // path of the symlink inside the namespace
+}
+
+// Namespaces returns the rootless namespaces the plugin socket has been
+// symlinked into, sorted by PID.
+func (r *RootlessSymlinker) Namespaces() []RootlessNamespace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	namespaces := make([]RootlessNamespace, 0, len(r.socketSymlinkPerNs))
+	for pid, symlink := range r.socketSymlinkPerNs {
+		namespaces = append(namespaces, RootlessNamespace{PID: pid, Symlink: symlink})
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].PID < namespaces[j].PID
+	})
+	return namespaces
+}
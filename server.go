@@ -0,0 +1,175 @@
+package dwgd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// parseServerOptions fills the fields of n needed to create its server
+// interface, using the options of the network and its IPAM data.
+func parseServerOptions(n *Network, m map[string]interface{}, ipv4Data []*network.IPAMData) error {
+	privkey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	n.privkey = &privkey
+
+	if payload, ok := m["dwgd.listen_port"].(string); ok {
+		n.listenPort, err = strconv.Atoi(payload)
+		if err != nil {
+			return fmt.Errorf("invalid dwgd.listen_port option: %w", err)
+		}
+	}
+
+	// The server interface takes the gateway address of the network, so
+	// that containers can reach it as their gateway.
+	if len(ipv4Data) == 0 || ipv4Data[0].Gateway == "" {
+		return fmt.Errorf("dwgd.create_server requires a gateway address")
+	}
+	n.address = ipv4Data[0].Gateway
+
+	return nil
+}
+
+// setupServer creates and configures the WireGuard interface of n, which
+// must be managed by dwgd.
+//
+// The interface is always created in dwgd's namespace and then moved in
+// its own one, if any: this way its socket stays in dwgd's namespace,
+// as described in https://www.wireguard.com/netns/.
+func (d *Driver) setupServer(l *slog.Logger, n *Network) error {
+	l.Debug("Creating server interface", "ifname", n.ifname)
+	if err := d.links.Add(n.ifname); err != nil {
+		return err
+	}
+
+	cfg := wgtypes.Config{
+		PrivateKey: n.privkey,
+	}
+	if n.listenPort != 0 {
+		cfg.ListenPort = &n.listenPort
+	}
+	if err := d.wgc.ConfigureDevice(n.ifname, cfg); err != nil {
+		d.links.Delete("", n.ifname)
+		return err
+	}
+
+	if n.ifnameNetns != "" {
+		l.Debug("Moving server interface", "ifname", n.ifname, "netns", n.ifnameNetns)
+		if err := d.c.Run("ip", "link", "set", n.ifname, "netns", n.ifnameNetns); err != nil {
+			d.links.Delete("", n.ifname)
+			return err
+		}
+	}
+
+	if err := d.runIn(n.ifnameNetns, "ip", "address", "add", n.address, "dev", n.ifname); err != nil {
+		d.teardownServer(l, n)
+		return err
+	}
+
+	if err := d.runIn(n.ifnameNetns, "ip", "link", "set", "up", "dev", n.ifname); err != nil {
+		d.teardownServer(l, n)
+		return err
+	}
+
+	// If no listen port was requested, one has been picked when the
+	// interface went up: we keep it so that the endpoint of the network
+	// doesn't change when the interface is recreated.
+	if n.listenPort == 0 {
+		iface, err := d.wgcFor(n.ifnameNetns).Device(n.ifname)
+		if err != nil {
+			d.teardownServer(l, n)
+			return err
+		}
+		n.listenPort = iface.ListenPort
+	}
+
+	return nil
+}
+
+// teardownServer deletes the WireGuard interface of n.
+func (d *Driver) teardownServer(l *slog.Logger, n *Network) error {
+	l.Debug("Deleting server interface", "ifname", n.ifname)
+	return d.links.Delete(n.ifnameNetns, n.ifname)
+}
+
+// restoreServers recreates the server interfaces managed by dwgd that don't
+// exist anymore, e.g. after a reboot, together with the peers of their
+// joined clients.
+func (d *Driver) restoreServers() error {
+	networks, err := d.s.ListNetworks()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range networks {
+		if !n.createServer {
+			continue
+		}
+
+		// Userspace interfaces don't survive dwgd: if they are still
+		// reachable it's through a stale socket, they are recreated anyway.
+		wgc := d.wgcFor(n.ifnameNetns)
+		_, err := wgc.Device(n.ifname)
+		if u, ok := d.links.(*userspaceBackend); ok && !u.has(n.ifname) {
+			err = os.ErrNotExist
+		}
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		l := Logger.With("network_id", n.id)
+		l.Info("Restoring server interface", "ifname", n.ifname)
+		if err := d.setupServer(l, n); err != nil {
+			return err
+		}
+
+		clients, err := d.s.ListClients(n.id)
+		if err != nil {
+			return err
+		}
+		peers := make([]wgtypes.PeerConfig, 0, len(clients))
+		for _, c := range clients {
+			// Endpoints that never joined, or that left, have no peer.
+			if c.netns == "" {
+				continue
+			}
+			peers = append(peers, c.PeerConfig())
+		}
+		if err := wgc.ConfigureDevice(n.ifname, wgtypes.Config{Peers: peers}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateServerPeer adds peer to the server interface called ifname, or
+// removes it if peer.Remove is set. The other peers of the interface are
+// left untouched.
+func updateServerPeer(l *slog.Logger, wgc wgController, ifname string, peer wgtypes.PeerConfig) error {
+	iface, err := wgc.Device(ifname)
+	if err != nil {
+		return err
+	}
+
+	cfg := wgtypes.Config{
+		PrivateKey:   &iface.PrivateKey,
+		ListenPort:   &iface.ListenPort,
+		FirewallMark: &iface.FirewallMark,
+		ReplacePeers: false,
+		Peers:        []wgtypes.PeerConfig{peer},
+	}
+	l.Debug("Updating configuration", "ifname", iface.Name, "config", Jsonify(cfg))
+
+	return wgc.ConfigureDevice(iface.Name, cfg)
+}
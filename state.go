@@ -0,0 +1,539 @@
+package dwgd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+const (
+	OutputFormatTable = "table"
+	OutputFormatJSON  = "json"
+)
+
+// A StateReader gives access to the state of dwgd, either asking the
+// running daemon or reading it directly.
+type StateReader interface {
+	Source() string // where the state is read from, for humans
+	Networks() ([]NetworkInfo, error)
+	Network(id string) (*NetworkInfo, error) // the network with its clients, nil if it doesn't exist
+	Clients(networkID string) ([]ClientInfo, error)
+	Devices() ([]DeviceInfo, error)
+	Rootless() ([]RootlessNamespace, error)
+	Close() error
+}
+
+// AdminClient reads the state of a running dwgd through its admin socket.
+type AdminClient struct {
+	sockPath string
+	client   *http.Client
+}
+
+func NewAdminClient(sockPath string) *AdminClient {
+	return &AdminClient{
+		sockPath: sockPath,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", sockPath)
+				},
+			},
+		},
+	}
+}
+
+// get decodes the response to a GET request of path into v. It returns
+// false if the resource doesn't exist.
+func (a *AdminClient) get(path string, v interface{}) (bool, error) {
+	res, err := a.client.Get("http://dwgd" + path)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		e := struct {
+			Error string `json:"error"`
+		}{}
+		if err := json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&e); err != nil || e.Error == "" {
+			return false, fmt.Errorf("admin API replied with status %d", res.StatusCode)
+		}
+		return false, fmt.Errorf("admin API: %s", e.Error)
+	}
+	return true, json.NewDecoder(res.Body).Decode(v)
+}
+
+// Healthz returns an error if the daemon is not reachable or not healthy.
+func (a *AdminClient) Healthz() error {
+	_, err := a.get(AdminHealthzPath, &struct{}{})
+	return err
+}
+
+func (a *AdminClient) Source() string {
+	return "admin socket " + a.sockPath
+}
+
+func (a *AdminClient) Networks() ([]NetworkInfo, error) {
+	networks := make([]NetworkInfo, 0)
+	_, err := a.get(AdminNetworksPath, &networks)
+	return networks, err
+}
+
+func (a *AdminClient) Network(id string) (*NetworkInfo, error) {
+	n := &NetworkInfo{}
+	found, err := a.get(AdminNetworksPath+"/"+url.PathEscape(id), n)
+	if err != nil || !found {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (a *AdminClient) Clients(networkID string) ([]ClientInfo, error) {
+	path := AdminClientsPath
+	if networkID != "" {
+		path += "?" + url.Values{"network": {networkID}}.Encode()
+	}
+	clients := make([]ClientInfo, 0)
+	_, err := a.get(path, &clients)
+	return clients, err
+}
+
+func (a *AdminClient) Devices() ([]DeviceInfo, error) {
+	devices := make([]DeviceInfo, 0)
+	_, err := a.get(AdminDevicesPath, &devices)
+	return devices, err
+}
+
+func (a *AdminClient) Rootless() ([]RootlessNamespace, error) {
+	namespaces := make([]RootlessNamespace, 0)
+	_, err := a.get(AdminRootlessPath, &namespaces)
+	return namespaces, err
+}
+
+func (a *AdminClient) Close() error {
+	a.client.CloseIdleConnections()
+	return nil
+}
+
+// LocalState reads the state of dwgd from its database and from the
+// WireGuard interfaces of the host, for when the daemon is not running.
+type LocalState struct {
+	db    string
+	d     *Driver
+	wgErr error // why the WireGuard interfaces can't be read, if they can't
+}
+
+func OpenLocalState(db string) (*LocalState, error) {
+	s := &Storage{}
+	if err := s.OpenReadOnly(db); err != nil {
+		return nil, err
+	}
+
+	l := &LocalState{
+		db: db,
+		d:  &Driver{c: &execCommander{}, s: s, netnsWgc: newNetnsWgController},
+	}
+	wgc, err := wgctrl.New()
+	if err != nil {
+		l.wgErr = err
+	} else {
+		l.d.wgc = wgc
+	}
+	return l, nil
+}
+
+func (l *LocalState) Source() string {
+	return "database " + l.db
+}
+
+func (l *LocalState) Networks() ([]NetworkInfo, error) {
+	return l.d.NetworkInfos()
+}
+
+func (l *LocalState) Network(id string) (*NetworkInfo, error) {
+	return l.d.NetworkInfo(id)
+}
+
+func (l *LocalState) Clients(networkID string) ([]ClientInfo, error) {
+	return l.d.ClientInfos(networkID)
+}
+
+func (l *LocalState) Devices() ([]DeviceInfo, error) {
+	if l.wgErr != nil {
+		return nil, l.wgErr
+	}
+	return l.d.Devices()
+}
+
+// Rootless returns no namespaces: they are only known to the running daemon.
+func (l *LocalState) Rootless() ([]RootlessNamespace, error) {
+	return nil, nil
+}
+
+func (l *LocalState) Close() error {
+	return l.d.s.Close()
+}
+
+// OpenStateReader returns a StateReader asking the daemon listening on the
+// admin socket at sockPath or, if it can't be reached, reading the database
+// at db.
+func OpenStateReader(sockPath string, db string) (StateReader, error) {
+	a := NewAdminClient(sockPath)
+	err := a.Healthz()
+	if err == nil {
+		return a, nil
+	}
+	TraceLog.Printf("Couldn't reach the admin socket, reading the database: %s\n", err)
+	a.Close()
+	return OpenLocalState(db)
+}
+
+// deviceOf returns the interface of the given endpoint, or of the network
+// if endpointID is empty, nil if it's not among devices.
+func deviceOf(devices []DeviceInfo, networkID string, endpointID string) *DeviceInfo {
+	for i := range devices {
+		if devices[i].NetworkID == networkID && devices[i].EndpointID == endpointID {
+			return &devices[i]
+		}
+	}
+	return nil
+}
+
+// deviceStats returns the latest handshake and the bytes received and sent
+// through all the peers of dev.
+func deviceStats(dev *DeviceInfo) (time.Time, int64, int64) {
+	var handshake time.Time
+	var rx, tx int64
+	for _, p := range dev.Peers {
+		if p.LastHandshake.After(handshake) {
+			handshake = p.LastHandshake
+		}
+		rx += p.ReceiveBytes
+		tx += p.TransmitBytes
+	}
+	return handshake, rx, tx
+}
+
+// formatHandshake returns how long before now the handshake happened.
+func formatHandshake(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
+
+// formatBytes returns n in a human readable form, with binary prefixes.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// statsColumns returns the last handshake, received and sent bytes columns
+// of dev, dashes if it's nil or it couldn't be read.
+func statsColumns(dev *DeviceInfo, now time.Time) string {
+	if dev == nil || dev.Error != "" {
+		return "-\t-\t-"
+	}
+	handshake, rx, tx := deviceStats(dev)
+	return fmt.Sprintf("%s\t%s\t%s", formatHandshake(handshake, now), formatBytes(rx), formatBytes(tx))
+}
+
+// shortID truncates a docker ID as docker does in its own listings.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// orDash returns s, or a dash if it's empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// NetworkState is a network together with the live state of its
+// interface, if dwgd manages one, and of its endpoints.
+type NetworkState struct {
+	NetworkInfo
+	Device    *DeviceInfo   `json:"device,omitempty"`
+	Endpoints []ClientState `json:"endpoints,omitempty"`
+}
+
+// ClientState is an endpoint together with the live state of its
+// interface, if it's joined to a sandbox.
+type ClientState struct {
+	ClientInfo
+	Device *DeviceInfo `json:"device,omitempty"`
+}
+
+func writeJSONOutput(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func checkOutputFormat(format string) error {
+	if format != OutputFormatTable && format != OutputFormatJSON {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return nil
+}
+
+// WriteNetworks writes the networks to w, as a table or as JSON, with the
+// live state of their interfaces found in devices.
+func WriteNetworks(w io.Writer, networks []NetworkInfo, devices []DeviceInfo, format string) error {
+	if err := checkOutputFormat(format); err != nil {
+		return err
+	}
+
+	states := make([]NetworkState, 0, len(networks))
+	for _, n := range networks {
+		n.Clients = nil
+		states = append(states, NetworkState{NetworkInfo: n, Device: deviceOf(devices, n.ID, "")})
+	}
+	if format == OutputFormatJSON {
+		return writeJSONOutput(w, states)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK ID\tIFNAME\tPUBLIC KEY\tENDPOINT\tMESH\tPROFILE\tLAST HANDSHAKE\tRX\tTX")
+	for _, s := range states {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", shortID(s.ID), orDash(s.Ifname), s.PublicKey,
+			orDash(s.Endpoint), orDash(s.Mesh), orDash(s.Profile), statsColumns(s.Device, now))
+	}
+	return tw.Flush()
+}
+
+// WriteClients writes the endpoints to w, as a table or as JSON, with the
+// live state of their interfaces found in devices.
+func WriteClients(w io.Writer, clients []ClientInfo, devices []DeviceInfo, format string) error {
+	if err := checkOutputFormat(format); err != nil {
+		return err
+	}
+
+	states := make([]ClientState, 0, len(clients))
+	for _, c := range clients {
+		states = append(states, ClientState{ClientInfo: c, Device: deviceOf(devices, c.NetworkID, c.ID)})
+	}
+	if format == OutputFormatJSON {
+		return writeJSONOutput(w, states)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	writeClientsTable(tw, states, time.Now())
+	return tw.Flush()
+}
+
+func writeClientsTable(tw *tabwriter.Writer, states []ClientState, now time.Time) {
+	fmt.Fprintln(tw, "ENDPOINT ID\tNETWORK ID\tIP\tIFNAME\tPUBLIC KEY\tSANDBOX\tLAST HANDSHAKE\tRX\tTX")
+	for _, s := range states {
+		ifname := s.Ifname
+		if s.Device != nil && s.Device.Name != "" {
+			ifname = s.Device.Name
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", shortID(s.ID), shortID(s.NetworkID), s.IP, ifname,
+			s.PublicKey, orDash(s.Netns), statsColumns(s.Device, now))
+	}
+}
+
+// WriteNetwork writes the network n, including its endpoints, to w, as a
+// list of properties followed by a table or as JSON, with the live state of
+// the interfaces found in devices.
+func WriteNetwork(w io.Writer, n *NetworkInfo, devices []DeviceInfo, format string) error {
+	if err := checkOutputFormat(format); err != nil {
+		return err
+	}
+
+	state := NetworkState{NetworkInfo: *n, Device: deviceOf(devices, n.ID, "")}
+	state.Clients = nil
+	state.Endpoints = make([]ClientState, 0, len(n.Clients))
+	for _, c := range n.Clients {
+		state.Endpoints = append(state.Endpoints, ClientState{ClientInfo: c, Device: deviceOf(devices, c.NetworkID, c.ID)})
+	}
+	if format == OutputFormatJSON {
+		return writeJSONOutput(w, state)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	properties := []struct{ name, value string }{
+		{"ID", n.ID},
+		{"Owner", fmt.Sprint(n.Owner)},
+		{"Interface", n.Ifname},
+		{"Interface netns", n.IfnameNetns},
+		{"Public key", n.PublicKey},
+		{"Endpoint", n.Endpoint},
+		{"Route", n.Route},
+		{"Allowed IPs", strings.Join(n.AllowedIPs, ", ")},
+		{"Address", n.Address},
+		{"Mesh", n.Mesh},
+		{"Agent", n.Agent},
+		{"Provisioner", n.Provisioner},
+		{"Persist", strings.TrimSpace(n.Persist + " " + n.PersistPath)},
+		{"Keymode", strings.TrimSpace(n.Keymode + " " + n.Keydir)},
+		{"Profile", strings.TrimSpace(n.Profile + " " + n.ProfileVersion)},
+	}
+	if n.ListenPort != 0 {
+		properties = append(properties, struct{ name, value string }{"Listen port", fmt.Sprint(n.ListenPort)})
+	}
+	if n.MTU != 0 {
+		properties = append(properties, struct{ name, value string }{"MTU", fmt.Sprint(n.MTU)})
+	}
+	for _, p := range properties {
+		if p.value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", p.name, p.value)
+		}
+	}
+	if state.Device != nil {
+		if state.Device.Error != "" {
+			fmt.Fprintf(tw, "Interface error:\t%s\n", state.Device.Error)
+		} else {
+			handshake, rx, tx := deviceStats(state.Device)
+			fmt.Fprintf(tw, "Peers:\t%d\n", len(state.Device.Peers))
+			fmt.Fprintf(tw, "Last handshake:\t%s\n", formatHandshake(handshake, now))
+			fmt.Fprintf(tw, "Received:\t%s\n", formatBytes(rx))
+			fmt.Fprintf(tw, "Sent:\t%s\n", formatBytes(tx))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	writeClientsTable(tw, state.Endpoints, now)
+	return tw.Flush()
+}
+
+// Status summarizes the state of dwgd.
+type Status struct {
+	Running      bool                `json:"running"` // whether the state has been read from the running daemon
+	Source       string              `json:"source"`
+	Networks     int                 `json:"networks"`
+	Endpoints    int                 `json:"endpoints"`
+	Joined       int                 `json:"joined"` // endpoints joined to a sandbox
+	Devices      []DeviceInfo        `json:"devices"`
+	DevicesError string              `json:"devices_error,omitempty"` // set if the interfaces couldn't be read
+	Rootless     []RootlessNamespace `json:"rootless,omitempty"`
+}
+
+// ReadStatus returns the status of dwgd read through r.
+func ReadStatus(r StateReader) (*Status, error) {
+	networks, err := r.Networks()
+	if err != nil {
+		return nil, err
+	}
+	clients, err := r.Clients("")
+	if err != nil {
+		return nil, err
+	}
+	rootless, err := r.Rootless()
+	if err != nil {
+		return nil, err
+	}
+
+	_, running := r.(*AdminClient)
+	s := &Status{
+		Running:   running,
+		Source:    r.Source(),
+		Networks:  len(networks),
+		Endpoints: len(clients),
+		Devices:   make([]DeviceInfo, 0),
+		Rootless:  rootless,
+	}
+	for _, c := range clients {
+		if c.Joined {
+			s.Joined++
+		}
+	}
+
+	devices, err := r.Devices()
+	if err != nil {
+		s.DevicesError = err.Error()
+	} else {
+		s.Devices = devices
+	}
+	return s, nil
+}
+
+// WriteStatus writes s to w, as a summary followed by a table of the
+// interfaces or as JSON.
+func WriteStatus(w io.Writer, s *Status, format string) error {
+	if err := checkOutputFormat(format); err != nil {
+		return err
+	}
+	if format == OutputFormatJSON {
+		return writeJSONOutput(w, s)
+	}
+
+	daemon := "running"
+	if !s.Running {
+		daemon = "not reachable"
+	}
+	fmt.Fprintf(w, "Daemon:     %s, read from %s\n", daemon, s.Source)
+	fmt.Fprintf(w, "Networks:   %d\n", s.Networks)
+	fmt.Fprintf(w, "Endpoints:  %d (%d joined)\n", s.Endpoints, s.Joined)
+	if s.Running {
+		fmt.Fprintf(w, "Rootless:   %d namespaces\n", len(s.Rootless))
+	}
+	fmt.Fprintln(w)
+
+	if s.DevicesError != "" {
+		_, err := fmt.Fprintf(w, "Couldn't read the WireGuard interfaces: %s\n", s.DevicesError)
+		return err
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tNETWORK ID\tENDPOINT ID\tNETNS\tPEERS\tLAST HANDSHAKE\tRX\tTX")
+	failed := make([]DeviceInfo, 0)
+	for _, dev := range s.Devices {
+		if dev.Error != "" {
+			failed = append(failed, dev)
+			continue
+		}
+		dev := dev
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", dev.Name, shortID(dev.NetworkID), orDash(shortID(dev.EndpointID)),
+			orDash(dev.Netns), len(dev.Peers), statsColumns(&dev, now))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, dev := range failed {
+		owner := "network " + shortID(dev.NetworkID)
+		if dev.EndpointID != "" {
+			owner = "endpoint " + shortID(dev.EndpointID)
+		}
+		if _, err := fmt.Fprintf(w, "Couldn't read the interface of %s: %s\n", owner, dev.Error); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package dwgd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestStateReader(t *testing.T) {
+	cfg := ConfigFixture()
+	d, err := NewDriver(cfg, CommanderFixture(), WgControllerFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := MustCreateNetwork(t, d, true)
+	c := MustCreateEndpoint(t, d)
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sockPath := filepath.Join(t.TempDir(), "admin.sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: newAdminHandler(d, nil)}
+	go srv.Serve(sock)
+	defer srv.Close()
+
+	check := func(t *testing.T, r StateReader) {
+		networks, err := r.Networks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []NetworkInfo{newNetworkInfo(n)}; !cmp.Equal(networks, expected) {
+			t.Fatalf("mismatch: %#v != %#v", networks, expected)
+		}
+
+		info, err := r.Network(n.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info == nil || len(info.Clients) != 1 || info.Clients[0].ID != c.id {
+			t.Fatalf("unexpected network: %#v", info)
+		}
+		info, err = r.Network("unknown")
+		if err != nil || info != nil {
+			t.Fatalf("expected no network, got %#v, %v", info, err)
+		}
+
+		clients, err := r.Clients(n.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clients) != 1 || !clients[0].Joined || clients[0].Netns != "/foo/bar" {
+			t.Fatalf("unexpected clients: %#v", clients)
+		}
+	}
+
+	t.Run("admin socket", func(t *testing.T) {
+		r, err := OpenStateReader(sockPath, cfg.Db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, ok := r.(*AdminClient); !ok {
+			t.Fatalf("expected an admin client, got %T", r)
+		}
+		check(t, r)
+
+		devices, err := r.Devices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 2 || devices[0].Name != n.ifname {
+			t.Fatalf("unexpected devices: %#v", devices)
+		}
+	})
+
+	t.Run("database", func(t *testing.T) {
+		r, err := OpenStateReader(filepath.Join(t.TempDir(), "missing.sock"), cfg.Db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, ok := r.(*LocalState); !ok {
+			t.Fatalf("expected a local state, got %T", r)
+		}
+		check(t, r)
+	})
+}
+
+func TestWriteState(t *testing.T) {
+	now := time.Now()
+	n := NetworkInfo{ID: "0123456789abcdef", Ifname: "dwgd0", PublicKey: "pubkey", Endpoint: "192.0.2.1:51820"}
+	c := ClientInfo{ID: "fedcba9876543210", NetworkID: n.ID, IP: "10.0.0.2", Ifname: "wg-fedcba987654", PublicKey: "clientkey", Joined: true, Netns: "/foo/bar"}
+	n.Clients = []ClientInfo{c}
+	devices := []DeviceInfo{
+		{NetworkID: n.ID, Name: "dwgd0", Peers: []PeerInfo{{PublicKey: "clientkey", ReceiveBytes: 1536, TransmitBytes: 100, LastHandshake: now.Add(-time.Minute)}}},
+		{NetworkID: n.ID, EndpointID: c.ID, Netns: "/foo/bar", Error: "interface not found"},
+	}
+
+	t.Run("networks", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := WriteNetworks(&b, []NetworkInfo{n}, devices, OutputFormatTable); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "0123456789ab  dwgd0") {
+			t.Fatalf("unexpected output:\n%s", b.String())
+		}
+		for _, s := range []string{"1m0s ago", "1.5 KiB", "100 B"} {
+			if !strings.Contains(lines[1], s) {
+				t.Fatalf("%q not found in:\n%s", s, b.String())
+			}
+		}
+
+		b.Reset()
+		if err := WriteNetworks(&b, []NetworkInfo{n}, devices, OutputFormatJSON); err != nil {
+			t.Fatal(err)
+		}
+		var states []NetworkState
+		if err := json.Unmarshal(b.Bytes(), &states); err != nil {
+			t.Fatal(err)
+		}
+		if len(states) != 1 || states[0].ID != n.ID || states[0].Device == nil || states[0].Clients != nil {
+			t.Fatalf("unexpected output:\n%s", b.String())
+		}
+	})
+
+	t.Run("network", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := WriteNetwork(&b, &n, devices, OutputFormatTable); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"ID:", n.ID, "Peers:", "Received:", "1.5 KiB", "fedcba987654", "clientkey"} {
+			if !strings.Contains(b.String(), s) {
+				t.Fatalf("%q not found in:\n%s", s, b.String())
+			}
+		}
+	})
+
+	t.Run("endpoints", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := WriteClients(&b, []ClientInfo{c}, devices, OutputFormatTable); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		fields := strings.Fields(lines[len(lines)-1])
+		if len(lines) != 2 || !cmp.Equal(fields[5:], []string{"/foo/bar", "-", "-", "-"}) {
+			t.Fatalf("unexpected output:\n%s", b.String())
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		var b bytes.Buffer
+		s := &Status{Source: "database /tmp/dwgd.db", Networks: 1, Endpoints: 1, Joined: 1, Devices: devices}
+		if err := WriteStatus(&b, s, OutputFormatTable); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"not reachable, read from database /tmp/dwgd.db", "1 (1 joined)", "dwgd0", "Couldn't read the interface of endpoint fedcba987654: interface not found"} {
+			if !strings.Contains(b.String(), s) {
+				t.Fatalf("%q not found in:\n%s", s, b.String())
+			}
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if err := WriteClients(&bytes.Buffer{}, nil, nil, "yaml"); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{0: "0 B", 1023: "1023 B", 1024: "1.0 KiB", 5 << 20: "5.0 MiB", 3 << 30: "3.0 GiB"} {
+		if got := formatBytes(n); got != expected {
+			t.Fatalf("%d: expected %s, got %s", n, expected, got)
+		}
+	}
+}
+
+func TestDeviceStats(t *testing.T) {
+	now := time.Now()
+	dev := newDeviceInfo(DeviceInfo{}, &wgtypes.Device{Peers: []wgtypes.Peer{
+		{LastHandshakeTime: now.Add(-time.Hour), ReceiveBytes: 1, TransmitBytes: 2},
+		{LastHandshakeTime: now, ReceiveBytes: 3, TransmitBytes: 4},
+	}}, nil)
+
+	handshake, rx, tx := deviceStats(&dev)
+	if !handshake.Equal(now) || rx != 4 || tx != 6 {
+		t.Fatalf("unexpected stats: %s %d %d", handshake, rx, tx)
+	}
+	if got := formatHandshake(time.Time{}, now); got != "never" {
+		t.Fatalf("expected never, got %s", got)
+	}
+}
@@ -0,0 +1,275 @@
+package dwgd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A SharedStore holds the state shared by the dwgd instances running on
+// different hosts, such as the peers of global networks.
+// Keys are slash separated paths.
+type SharedStore interface {
+	Put(key string, value []byte) error
+	Delete(key string) error
+	// List returns the keys starting with prefix, together with their values.
+	List(prefix string) (map[string][]byte, error)
+	Close() error
+}
+
+// newSharedStore returns the store described by spec, an URL whose scheme
+// selects the backend:
+//
+//   - memory: an in-process store, only useful for tests and single hosts;
+//   - file:///path/to/store.json: a JSON file, e.g. on a shared filesystem;
+//   - etcd://host:2379 or etcd+https://host:2379: an etcd v3 cluster,
+//     through its JSON gateway.
+//
+// tlsConfig is used to connect to etcd+https stores, the default settings
+// are used if nil.
+func newSharedStore(spec string, tlsConfig *tls.Config) (SharedStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store %q: %w", spec, err)
+	}
+	if tlsConfig != nil && u.Scheme != "etcd+https" {
+		return nil, fmt.Errorf("TLS settings can't be used with store %q", spec)
+	}
+
+	switch u.Scheme {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid store %q: missing path", spec)
+		}
+		return newFileStore(u.Path), nil
+	case "etcd":
+		return newEtcdStore("http://"+u.Host, nil), nil
+	case "etcd+https":
+		return newEtcdStore("https://"+u.Host, tlsConfig), nil
+	}
+	return nil, fmt.Errorf("unknown store %q", spec)
+}
+
+// memoryStore is a SharedStore living in memory.
+type memoryStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string][]byte)}
+}
+
+func (m *memoryStore) Put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memoryStore) List(prefix string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return filterPrefix(m.data, prefix), nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func filterPrefix(data map[string][]byte, prefix string) map[string][]byte {
+	res := make(map[string][]byte)
+	for k, v := range data {
+		if strings.HasPrefix(k, prefix) {
+			res[k] = append([]byte(nil), v...)
+		}
+	}
+	return res
+}
+
+// fileStore is a SharedStore kept in a JSON file. Every operation locks
+// a file next to it, so it can be shared by multiple processes, and the
+// file is replaced atomically, so readers never see a partial write.
+type fileStore struct {
+	path string
+}
+
+func newFileStore(path string) *fileStore {
+	return &fileStore{path: path}
+}
+
+// update runs fn on the content of the store while holding an exclusive
+// lock on it, and writes the content back if write is set.
+func (f *fileStore) update(write bool, fn func(data map[string][]byte)) error {
+	return withFileLock(f.path+".lock", func() error {
+		buf, err := os.ReadFile(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		data := make(map[string][]byte)
+		if len(buf) > 0 {
+			if err := json.Unmarshal(buf, &data); err != nil {
+				return fmt.Errorf("corrupted store %s: %w", f.path, err)
+			}
+		}
+
+		fn(data)
+		if !write {
+			return nil
+		}
+
+		buf, err = json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(f.path, buf, 0600)
+	})
+}
+
+func (f *fileStore) Put(key string, value []byte) error {
+	return f.update(true, func(data map[string][]byte) {
+		data[key] = value
+	})
+}
+
+func (f *fileStore) Delete(key string) error {
+	return f.update(true, func(data map[string][]byte) {
+		delete(data, key)
+	})
+}
+
+func (f *fileStore) List(prefix string) (map[string][]byte, error) {
+	var res map[string][]byte
+	err := f.update(false, func(data map[string][]byte) {
+		res = filterPrefix(data, prefix)
+	})
+	return res, err
+}
+
+func (f *fileStore) Close() error {
+	return nil
+}
+
+// etcdStore is a SharedStore backed by an etcd v3 cluster, reached through
+// the JSON gateway so we don't need the gRPC client.
+type etcdStore struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newEtcdStore(endpoint string, tlsConfig *tls.Config) *etcdStore {
+	return &etcdStore{
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+// call posts req to the gateway method at path and decodes the response
+// into res, if not nil.
+func (e *etcdStore) call(path string, req interface{}, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("etcd %s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (e *etcdStore) Put(key string, value []byte) error {
+	return e.call("/v3/kv/put", &etcdKeyValue{Key: []byte(key), Value: value}, nil)
+}
+
+func (e *etcdStore) Delete(key string) error {
+	return e.call("/v3/kv/deleterange", &etcdRangeRequest{Key: []byte(key)}, nil)
+}
+
+func (e *etcdStore) List(prefix string) (map[string][]byte, error) {
+	res := &etcdRangeResponse{}
+	req := &etcdRangeRequest{Key: []byte(prefix), RangeEnd: prefixRangeEnd([]byte(prefix))}
+	if err := e.call("/v3/kv/range", req, res); err != nil {
+		return nil, err
+	}
+
+	data := make(map[string][]byte)
+	for _, kv := range res.Kvs {
+		data[string(kv.Key)] = kv.Value
+	}
+	return data, nil
+}
+
+func (e *etcdStore) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// prefixRangeEnd returns the end of the etcd range matching every key
+// starting with prefix.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// every key is greater than or equal to prefix
+	return []byte{0}
+}
+
+// sortedKeys returns the keys of data in lexical order.
+func sortedKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,171 @@
+package dwgd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeEtcdGateway implements the subset of the etcd v3 JSON gateway used
+// by etcdStore.
+type fakeEtcdGateway struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (g *fakeEtcdGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	req := &etcdKeyValue{}
+	rangeReq := &etcdRangeRequest{}
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+
+	switch r.URL.Path {
+	case "/v3/kv/put":
+		json.Unmarshal(body.Bytes(), req)
+		g.data[string(req.Key)] = req.Value
+		w.Write([]byte("{}"))
+	case "/v3/kv/deleterange":
+		json.Unmarshal(body.Bytes(), rangeReq)
+		delete(g.data, string(rangeReq.Key))
+		w.Write([]byte("{}"))
+	case "/v3/kv/range":
+		json.Unmarshal(body.Bytes(), rangeReq)
+		res := &etcdRangeResponse{}
+		for _, k := range sortedKeys(g.data) {
+			if k >= string(rangeReq.Key) && k < string(rangeReq.RangeEnd) {
+				res.Kvs = append(res.Kvs, etcdKeyValue{Key: []byte(k), Value: g.data[k]})
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testSharedStore(t *testing.T, s SharedStore) {
+	t.Helper()
+	defer s.Close()
+
+	for k, v := range map[string]string{"a/1": "one", "a/2": "two", "b/1": "three"} {
+		if err := s.Put(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("a/2"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.List("a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]byte{"a/1": []byte("one")}
+	if !cmp.Equal(data, expected) {
+		t.Fatalf("mismatch: %#v != %#v", data, expected)
+	}
+}
+
+func TestSharedStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		s, err := newSharedStore("memory:", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSharedStore(t, s)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := newSharedStore("file://"+filepath.Join(dir, "store.json"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSharedStore(t, s)
+
+		// the store is replaced through a temporary file, which is gone
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(entries))
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if expected := []string{"store.json", "store.json.lock"}; !cmp.Equal(names, expected) {
+			t.Fatalf("mismatch: %v != %v", names, expected)
+		}
+	})
+
+	t.Run("etcd", func(t *testing.T) {
+		srv := httptest.NewServer(&fakeEtcdGateway{data: make(map[string][]byte)})
+		defer srv.Close()
+
+		s, err := newSharedStore("etcd://"+strings.TrimPrefix(srv.URL, "http://"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSharedStore(t, s)
+	})
+
+	t.Run("etcd+https", func(t *testing.T) {
+		srv := httptest.NewTLSServer(&fakeEtcdGateway{data: make(map[string][]byte)})
+		defer srv.Close()
+
+		spec := "etcd+https://" + strings.TrimPrefix(srv.URL, "https://")
+		s, err := newSharedStore(spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("a/1", []byte("one")); err == nil {
+			t.Fatal("expected the certificate of the store to be rejected")
+		}
+		s.Close()
+
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		s, err = newSharedStore(spec, &tls.Config{RootCAs: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSharedStore(t, s)
+	})
+
+	t.Run("tls without https", func(t *testing.T) {
+		if _, err := newSharedStore("etcd://localhost:2379", &tls.Config{}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := newSharedStore("consul://localhost", nil); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	tests := map[string]string{
+		"a/":     "a0",
+		"a\xff":  "b",
+		"\xff":   "\x00",
+		"dwgd/n": "dwgd/o",
+	}
+	for prefix, expected := range tests {
+		if end := string(prefixRangeEnd([]byte(prefix))); end != expected {
+			t.Fatalf("mismatch for %q: %q != %q", prefix, end, expected)
+		}
+	}
+}
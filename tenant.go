@@ -0,0 +1,272 @@
+package dwgd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// rootUid is the UID of the tenant that can operate on every network.
+const rootUid = 0
+
+// A tenant identifies the user on whose behalf a docker daemon is calling
+// the driver. Every rootless docker daemon is a different tenant, while the
+// rootful one runs as root.
+type tenant struct {
+	uid uint32
+}
+
+func (t tenant) owns(owner uint32) bool {
+	return t.uid == rootUid || t.uid == owner
+}
+
+var rootTenant = tenant{uid: rootUid}
+
+// tlsHandshakeTimeout bounds the TLS handshake of the docker daemons
+// connecting through TCP, so that idle connections don't pile up.
+var tlsHandshakeTimeout = 10 * time.Second
+
+// hostOptions are the options naming resources of the host dwgd runs on as
+// root: interfaces, namespaces, files and services reached with the
+// credentials of dwgd. Rootless tenants can't pass them, they can only get
+// them from the profiles and the network defaults of the administrator.
+var hostOptions = []string{
+	"dwgd.ifname",
+	"dwgd.ifname_netns",
+	"dwgd.persist",
+	"dwgd.persist_path",
+	"dwgd.provisioner_path",
+	"dwgd.webhook_url",
+	"dwgd.agent",
+	"dwgd.keydir",
+	"dwgd.conf",
+}
+
+// checkOptions rejects the host options among the ones passed by t to
+// docker network create.
+func (t tenant) checkOptions(m map[string]interface{}) error {
+	if t.uid == rootUid {
+		return nil
+	}
+	for _, name := range hostOptions {
+		if _, ok := m[name]; ok {
+			return fmt.Errorf("option %s can't be passed by UID %d, it must come from a profile", name, t.uid)
+		}
+	}
+	return nil
+}
+
+// peerCredentials returns the credentials of the process that opened conn.
+func peerCredentials(conn net.Conn) (*syscall.Ucred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("connection from %s is not a unix socket", conn.RemoteAddr())
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	return cred, nil
+}
+
+// tenantOf returns the tenant of the peer that opened conn.
+// Docker daemons connecting through TLS have been authenticated with
+// their client certificate and are trusted as root.
+func tenantOf(conn net.Conn) (tenant, error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+			return tenant{}, err
+		}
+		if err := tc.Handshake(); err != nil {
+			return tenant{}, err
+		}
+		if err := tc.SetDeadline(time.Time{}); err != nil {
+			return tenant{}, err
+		}
+		return rootTenant, nil
+	}
+
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		return tenant{}, err
+	}
+	return tenant{uid: cred.Uid}, nil
+}
+
+// tenantDriver is a view of a Driver restricted to the networks and clients
+// owned by a tenant.
+type tenantDriver struct {
+	*Driver
+
+	t tenant
+}
+
+// ForTenant returns a network.Driver that records t as the owner of the
+// networks and clients it creates and rejects operations on the ones
+// owned by other tenants.
+func (d *Driver) ForTenant(t tenant) network.Driver {
+	return &tenantDriver{Driver: d, t: t}
+}
+
+func (td *tenantDriver) checkNetwork(id string) error {
+	n, err := td.s.GetNetwork(id)
+	if err != nil {
+		return err
+	}
+	if n != nil && !td.t.owns(n.owner) {
+		DiagnosticsLog.Printf("Rejected request of UID %d for NetworkID %s owned by UID %d\n", td.t.uid, id, n.owner)
+		return fmt.Errorf("NetworkID %s not found", id)
+	}
+	return nil
+}
+
+func (td *tenantDriver) checkClient(id string) error {
+	c, err := td.s.GetClient(id)
+	if err != nil {
+		return err
+	}
+	if c != nil && !td.t.owns(c.owner) {
+		DiagnosticsLog.Printf("Rejected request of UID %d for EndpointID %s owned by UID %d\n", td.t.uid, id, c.owner)
+		return fmt.Errorf("EndpointID %s not found", id)
+	}
+	return nil
+}
+
+func (td *tenantDriver) CreateNetwork(r *network.CreateNetworkRequest) error {
+	return td.createNetwork(r, td.t)
+}
+
+func (td *tenantDriver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
+	if err := td.checkNetwork(r.NetworkID); err != nil {
+		return err
+	}
+	return td.Driver.DeleteNetwork(r)
+}
+
+func (td *tenantDriver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	if err := td.checkNetwork(r.NetworkID); err != nil {
+		return nil, err
+	}
+	return td.createEndpoint(r, td.t)
+}
+
+func (td *tenantDriver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
+	if err := td.checkClient(r.EndpointID); err != nil {
+		return err
+	}
+	return td.Driver.DeleteEndpoint(r)
+}
+
+func (td *tenantDriver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, error) {
+	if err := td.checkClient(r.EndpointID); err != nil {
+		return nil, err
+	}
+	return td.Driver.EndpointInfo(r)
+}
+
+func (td *tenantDriver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
+	if err := td.checkClient(r.EndpointID); err != nil {
+		return nil, err
+	}
+	return td.join(r, td.t)
+}
+
+func (td *tenantDriver) Leave(r *network.LeaveRequest) error {
+	if err := td.checkClient(r.EndpointID); err != nil {
+		return err
+	}
+	return td.Driver.Leave(r)
+}
+
+// connListener is a net.Listener that returns a single, already accepted,
+// connection. Once the connection has been handed out, Accept blocks until
+// it gets closed.
+type connListener struct {
+	conn   net.Conn
+	addr   net.Addr
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{addr: conn.LocalAddr(), closed: make(chan struct{})}
+	l.conn = &notifyingConn{Conn: conn, l: l}
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn := l.conn
+	if conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// notifyingConn closes its connListener when it gets closed.
+type notifyingConn struct {
+	net.Conn
+
+	l *connListener
+}
+
+func (c *notifyingConn) Close() error {
+	c.l.Close()
+	return c.Conn.Close()
+}
+
+// serveTenants accepts connections from l and serves each of them with
+// a handler bound to the tenant of the peer that opened it.
+func serveTenants(l net.Listener, d *Driver) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			t, err := tenantOf(conn)
+			if err != nil {
+				DiagnosticsLog.Printf("Couldn't identify peer %s: %s\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+
+			TraceLog.Printf("Accepted connection from UID %d\n", t.uid)
+			cl := newConnListener(conn)
+			err = network.NewHandler(d.ForTenant(t)).Serve(cl)
+			if err != nil && err != net.ErrClosed {
+				TraceLog.Printf("Couldn't serve connection: %s\n", err)
+			}
+		}()
+	}
+}
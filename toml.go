@@ -0,0 +1,164 @@
+package dwgd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML used by the dwgd configuration and
+// profile files: comments, [table] headers, bare or quoted keys, and
+// string, integer, boolean and single-line array values.
+// Tables are returned as nested maps, integers as int64 and arrays as
+// []interface{}.
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || strings.HasPrefix(line, "[[") || !isTOMLComment(line[end+1:]) {
+				return nil, fmt.Errorf("line %d: invalid table header", lineno)
+			}
+			name, rest, err := parseTOMLKey(strings.TrimSpace(line[1:end]))
+			if err != nil || rest != "" {
+				return nil, fmt.Errorf("line %d: invalid table name", lineno)
+			}
+			if _, ok := root[name]; ok {
+				return nil, fmt.Errorf("line %d: table %s defined twice", lineno, name)
+			}
+			table = make(map[string]interface{})
+			root[name] = table
+			continue
+		}
+
+		key, rest, err := parseTOMLKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		rest = strings.TrimSpace(rest)
+		if !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		value, rest, err := parseTOMLValue(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineno, key, err)
+		}
+		if !isTOMLComment(rest) {
+			return nil, fmt.Errorf("line %d: unexpected %q after value", lineno, rest)
+		}
+		if _, ok := table[key]; ok {
+			return nil, fmt.Errorf("line %d: key %s defined twice", lineno, key)
+		}
+		table[key] = value
+	}
+	return root, scanner.Err()
+}
+
+// isTOMLComment returns whether s is empty or only holds a comment.
+func isTOMLComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// parseTOMLKey parses the bare or quoted key at the beginning of s and
+// returns it together with the rest of s.
+func parseTOMLKey(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		v, rest, err := parseTOMLString(s)
+		if err != nil {
+			return "", "", err
+		}
+		return v, rest, nil
+	}
+
+	i := 0
+	for i < len(s) && (s[i] == '_' || s[i] == '-' ||
+		(s[i] >= 'a' && s[i] <= 'z') || (s[i] >= 'A' && s[i] <= 'Z') || (s[i] >= '0' && s[i] <= '9')) {
+		i++
+	}
+	if i == 0 {
+		return "", "", fmt.Errorf("invalid key")
+	}
+	return s[:i], s[i:], nil
+}
+
+// parseTOMLString parses the basic or literal string at the beginning of
+// s and returns it together with the rest of s.
+func parseTOMLString(s string) (string, string, error) {
+	if s[0] == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string: %w", err)
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// parseTOMLValue parses the value at the beginning of s and returns it
+// together with the rest of s.
+func parseTOMLValue(s string) (interface{}, string, error) {
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("value missing")
+	case s[0] == '"' || s[0] == '\'':
+		return parseTOMLString(s)
+	case s[0] == '[':
+		values := make([]interface{}, 0)
+		rest := strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(rest, "]") {
+			v, r, err := parseTOMLValue(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, v)
+			rest = strings.TrimSpace(r)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("unterminated array")
+			}
+		}
+		return values, rest[1:], nil
+	}
+
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	token, rest := s[:end], s[end:]
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(token, "_", ""), 0, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported value %q", token)
+	}
+	return n, rest, nil
+}
@@ -0,0 +1,61 @@
+package dwgd
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTOML(t *testing.T) {
+	data := `# comment
+name = "dwgd" # trailing comment
+literal = 'C:\path'
+escaped = "a \"b\"\n"
+count = 1_000
+enabled = true
+"quoted key" = false
+
+[allow]
+uids = [1000, 1001]
+cgroups = ["/system.slice/docker.service", ]
+empty = []
+`
+	values, err := parseTOML([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"name":       "dwgd",
+		"literal":    `C:\path`,
+		"escaped":    "a \"b\"\n",
+		"count":      int64(1000),
+		"enabled":    true,
+		"quoted key": false,
+		"allow": map[string]interface{}{
+			"uids":    []interface{}{int64(1000), int64(1001)},
+			"cgroups": []interface{}{"/system.slice/docker.service"},
+			"empty":   []interface{}{},
+		},
+	}
+	if !cmp.Equal(values, expected) {
+		t.Fatalf("mismatch: %#v != %#v", values, expected)
+	}
+
+	invalid := map[string]string{
+		"missing value":      "a =\n",
+		"missing equal":      "a 1\n",
+		"unterminated":       "a = \"foo\n",
+		"trailing garbage":   "a = 1 2\n",
+		"duplicate key":      "a = 1\na = 2\n",
+		"duplicate table":    "[t]\n[t]\n",
+		"array of tables":    "[[t]]\n",
+		"unsupported value":  "a = 1979-05-27\n",
+		"unterminated array": "a = [1, 2\n",
+	}
+	for name, data := range invalid {
+		if _, err := parseTOML([]byte(data)); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
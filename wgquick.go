@@ -0,0 +1,137 @@
+package dwgd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A wgQuickPeer is the upstream peer defined by a wg-quick client
+// configuration.
+type wgQuickPeer struct {
+	publicKey    wgtypes.Key
+	presharedKey *wgtypes.Key
+	endpoint     string
+	allowedIPs   []net.IPNet
+	keepalive    int // seconds, -1 if disabled and 0 if not set
+	mtu          int // MTU of the [Interface], 0 if not set
+}
+
+// parseWgQuickConfig returns the peer defined by the wg-quick client
+// configuration conf, which must have exactly one [Peer] section. Only the
+// MTU is taken from the [Interface] section, keys and addresses of the
+// clients are managed by dwgd.
+func parseWgQuickConfig(conf []byte) (*wgQuickPeer, error) {
+	p := &wgQuickPeer{}
+	peers := 0
+	section := ""
+	hasPublicKey := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(conf))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section == "peer" {
+				peers++
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch {
+		case section == "interface" && key == "mtu":
+			p.mtu, err = strconv.Atoi(value)
+		case section == "peer" && peers > 1:
+			// reported below
+		case section == "peer" && key == "publickey":
+			p.publicKey, err = wgtypes.ParseKey(value)
+			hasPublicKey = true
+		case section == "peer" && key == "presharedkey":
+			var psk wgtypes.Key
+			psk, err = wgtypes.ParseKey(value)
+			p.presharedKey = &psk
+		case section == "peer" && key == "endpoint":
+			p.endpoint = value
+		case section == "peer" && key == "allowedips":
+			for _, cidr := range strings.Split(value, ",") {
+				var ipnet *net.IPNet
+				if _, ipnet, err = net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+					break
+				}
+				p.allowedIPs = append(p.allowedIPs, *ipnet)
+			}
+		case section == "peer" && key == "persistentkeepalive":
+			if value == "off" {
+				p.keepalive = -1
+				break
+			}
+			p.keepalive, err = strconv.Atoi(value)
+			if err == nil && p.keepalive == 0 {
+				p.keepalive = -1
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid %s: %w", lineno, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if peers != 1 {
+		return nil, fmt.Errorf("expected exactly one [Peer] section, found %d", peers)
+	}
+	if !hasPublicKey {
+		return nil, fmt.Errorf("PublicKey of [Peer] missing")
+	}
+	return p, nil
+}
+
+// parseConfOption fills the fields of n describing its peer from the
+// wg-quick configuration file given by the dwgd.conf option, if any.
+// It returns the endpoint found in the file, empty if missing.
+func (d *Driver) parseConfOption(l *slog.Logger, n *Network, m map[string]interface{}) (string, error) {
+	path, ok := m["dwgd.conf"].(string)
+	if !ok {
+		return "", nil
+	}
+
+	conf, err := d.c.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	p, err := parseWgQuickConfig(conf)
+	if err != nil {
+		return "", fmt.Errorf("dwgd.conf %s: %w", path, err)
+	}
+	l.Debug("Using peer from wg-quick configuration", "public_key", p.publicKey.String(), "path", path)
+
+	n.pubkey = p.publicKey
+	n.presharedKey = p.presharedKey
+	n.allowedIPs = p.allowedIPs
+	n.keepalive = p.keepalive
+	n.mtu = p.mtu
+	return p.endpoint, nil
+}
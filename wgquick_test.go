@@ -0,0 +1,136 @@
+package dwgd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const wgQuickConfFixture = `[Interface]
+# managed by the provider
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.64.0.2/32
+MTU = 1380
+DNS = 10.64.0.1
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=
+Endpoint = 198.51.100.1:51820
+AllowedIPs = 10.64.0.0/16, 192.0.2.0/24
+AllowedIPs = 203.0.113.0/24
+PersistentKeepalive = 15
+`
+
+func TestParseWgQuickConfig(t *testing.T) {
+	p, err := parseWgQuickConfig([]byte(wgQuickConfFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	psk, _ := wgtypes.ParseKey("FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=")
+	pubkey, _ := wgtypes.ParseKey("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	allowedIPs := make([]net.IPNet, 0)
+	for _, cidr := range []string{"10.64.0.0/16", "192.0.2.0/24", "203.0.113.0/24"} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		allowedIPs = append(allowedIPs, *ipnet)
+	}
+	expected := &wgQuickPeer{
+		publicKey:    pubkey,
+		presharedKey: &psk,
+		endpoint:     "198.51.100.1:51820",
+		allowedIPs:   allowedIPs,
+		keepalive:    15,
+		mtu:          1380,
+	}
+	if !cmp.Equal(p, expected, cmp.AllowUnexported(wgQuickPeer{})) {
+		t.Fatalf("mismatch: %#v != %#v", p, expected)
+	}
+
+	invalid := map[string]string{
+		"no peer":       "[Interface]\nMTU = 1380\n",
+		"two peers":     "[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\n[Peer]\n",
+		"no public key": "[Peer]\nEndpoint = 198.51.100.1:51820\n",
+		"bad key":       "[Peer]\nPublicKey = foo\n",
+		"bad line":      "[Peer]\nPublicKey\n",
+		"bad mtu":       "[Interface]\nMTU = big\n",
+	}
+	for name, conf := range invalid {
+		if _, err := parseWgQuickConfig([]byte(conf)); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDriver_Conf(t *testing.T) {
+	tc := CommanderFixture()
+	tc.ReadFileFunc = func(name string) ([]byte, error) {
+		if name == "/etc/wireguard/provider.conf" {
+			return []byte(wgQuickConfFixture), nil
+		}
+		return []byte{}, nil
+	}
+	var configured wgtypes.Config
+	wgc := WgControllerFixture()
+	wgc.ConfigureDeviceFunc = func(name string, cfg wgtypes.Config) error {
+		configured = cfg
+		return nil
+	}
+	d, err := NewDriver(ConfigFixture(), tc, wgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := NetworkFixture()
+	c := ClientFixture(n)
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: n.id,
+		Options: map[string]interface{}{
+			"com.docker.network.generic": map[string]interface{}{
+				"dwgd.seed": string(n.seed),
+				"dwgd.conf": "/etc/wireguard/provider.conf",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  n.id,
+		EndpointID: c.id,
+		Interface:  &network.EndpointInterface{Address: c.ip.String() + "/32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Join(&network.JoinRequest{NetworkID: n.id, EndpointID: c.id, SandboxKey: "/foo/bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedHistory := [][]string{
+		{"ip", "link", "add", "name", c.ifname, "type", "wireguard"},
+		{"ip", "link", "set", "dev", c.ifname, "mtu", "1380"},
+	}
+	if !cmp.Equal(tc.RunHistory, expectedHistory) {
+		t.Fatalf("mismatch: %#v != %#v", tc.RunHistory, expectedHistory)
+	}
+
+	p, _ := parseWgQuickConfig([]byte(wgQuickConfFixture))
+	keepalive := 15 * time.Second
+	expected := wgtypes.PeerConfig{
+		Endpoint:                    &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51820},
+		PublicKey:                   p.publicKey,
+		PresharedKey:                p.presharedKey,
+		PersistentKeepaliveInterval: &keepalive,
+		AllowedIPs:                  p.allowedIPs,
+		ReplaceAllowedIPs:           true,
+	}
+	if len(configured.Peers) != 1 || !cmp.Equal(configured.Peers[0], expected) {
+		t.Fatalf("mismatch: %#v != %#v", configured.Peers, expected)
+	}
+}